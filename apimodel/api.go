@@ -1,6 +1,8 @@
 package apimodel
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/ringoid/commons"
 )
@@ -10,6 +12,8 @@ const (
 	IsDebugLogEnabled     = false
 )
 
+//String() methods of the requests and responses mask tokens, pins, emails and keys,
+//so the values could be logged as is
 type CreateReq struct {
 	Email                      string   `json:"email"`
 	AuthSessionId              string   `json:"authSessionId"`
@@ -23,9 +27,15 @@ type CreateReq struct {
 	ReferralId                 string   `json:"referralId"`
 	PrivateKey                 string   `json:"privateKey"`
 	AppSettings                Settings `json:"settings"`
+	//see Attribution, all fields are optional
+	Attribution Attribution `json:"attribution"`
 }
 
 func (req CreateReq) String() string {
+	req.Email = MaskEmail(req.Email)
+	req.AuthSessionId = MaskToken(req.AuthSessionId)
+	req.PrivateKey = MaskToken(req.PrivateKey)
+	req.Attribution = req.Attribution.Masked()
 	return fmt.Sprintf("%#v", req)
 }
 
@@ -35,21 +45,150 @@ type CreateResp struct {
 	CustomerId  string `json:"customerId"`
 }
 
+//Settings of the user, quiet hours and digest options are honored by the push service (see README)
 type Settings struct {
-	Locale         string `json:"locale"`
-	Push           bool   `json:"push"`
-	PushNewLike    bool   `json:"pushNewLike"`
-	PushNewMessage bool   `json:"pushNewMessage"`
-	PushNewMatch   bool   `json:"pushNewMatch"`
-	PushVibration  bool   `json:"pushVibration"`
-	TimeZone       int    `json:"timeZone"`
+	Locale           string `json:"locale"`
+	Push             bool   `json:"push"`
+	PushNewLike      bool   `json:"pushNewLike"`
+	PushNewMessage   bool   `json:"pushNewMessage"`
+	PushNewMatch     bool   `json:"pushNewMatch"`
+	PushVibration    bool   `json:"pushVibration"`
+	TimeZone         int    `json:"timeZone" validate:"min=-12,max=14"`
+	TimeZoneName     string `json:"timeZoneName" sanitize:"line" validate:"optional,timezone"`
+	QuietHours       bool   `json:"quietHours"`
+	QuietHoursStart  int    `json:"quietHoursStart" validate:"min=0,max=1439"`
+	QuietHoursEnd    int    `json:"quietHoursEnd" validate:"min=0,max=1439"`
+	DigestNewLike    bool   `json:"digestNewLike"`
+	DigestNewMatch   bool   `json:"digestNewMatch"`
+	DigestNewMessage bool   `json:"digestNewMessage"`
+	//fields which were present in the create request, 0 is a valid bound of quiet hours
+	present map[string]bool
 }
 
 func (resp Settings) String() string {
 	return fmt.Sprintf("%#v", resp)
 }
 
+//UnmarshalJSON remembers which fields were present (and not null) in the create request
+func (resp *Settings) UnmarshalJSON(data []byte) error {
+	type plainSettings Settings
+	err := json.Unmarshal(data, (*plainSettings)(resp))
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	resp.present = make(map[string]bool)
+	for key, value := range raw {
+		if string(bytes.TrimSpace(value)) != "null" {
+			resp.present[key] = true
+		}
+	}
+	return nil
+}
+
+//Validate sanitizes and checks settings of the create request, field names are prefixed with settings.
+//Both bounds are required when quiet hours are enabled.
+func (resp *Settings) Validate() []FieldError {
+	var result []FieldError
+	for _, each := range Validate(resp) {
+		each.Field = "settings." + each.Field
+		result = append(result, each)
+	}
+	if resp.QuietHours {
+		for _, each := range []string{"quietHoursStart", "quietHoursEnd"} {
+			if !resp.present[each] {
+				result = append(result, FieldError{Field: "settings." + each, Message: "is required when quiet hours are enabled"})
+			}
+		}
+	}
+	return result
+}
+
+//SettingsPatch is the update_settings request, it has the same fields as Settings,
+//nil field means that the setting was not sent and is not changed
+type SettingsPatch struct {
+	AccessToken      string  `json:"accessToken"`
+	Locale           *string `json:"locale" sanitize:"line" validate:"locale"`
+	Push             *bool   `json:"push"`
+	PushNewLike      *bool   `json:"pushNewLike"`
+	PushNewMessage   *bool   `json:"pushNewMessage"`
+	PushNewMatch     *bool   `json:"pushNewMatch"`
+	PushVibration    *bool   `json:"vibration"`
+	TimeZone         *int    `json:"timeZone" validate:"min=-12,max=14"`
+	TimeZoneName     *string `json:"timeZoneName" sanitize:"line" validate:"timezone"`
+	QuietHours       *bool   `json:"quietHours"`
+	QuietHoursStart  *int    `json:"quietHoursStart" validate:"min=0,max=1439"`
+	QuietHoursEnd    *int    `json:"quietHoursEnd" validate:"min=0,max=1439"`
+	DigestNewLike    *bool   `json:"digestNewLike"`
+	DigestNewMatch   *bool   `json:"digestNewMatch"`
+	DigestNewMessage *bool   `json:"digestNewMessage"`
+	Version          *int64  `json:"version" validate:"min=0"`
+}
+
+//Changes returns sent settings by the request param names
+func (req SettingsPatch) Changes() map[string]interface{} {
+	changes := make(map[string]interface{})
+	if req.Locale != nil {
+		changes["locale"] = *req.Locale
+	}
+	if req.Push != nil {
+		changes["push"] = *req.Push
+	}
+	if req.PushNewLike != nil {
+		changes["pushNewLike"] = *req.PushNewLike
+	}
+	if req.PushNewMessage != nil {
+		changes["pushNewMessage"] = *req.PushNewMessage
+	}
+	if req.PushNewMatch != nil {
+		changes["pushNewMatch"] = *req.PushNewMatch
+	}
+	if req.PushVibration != nil {
+		changes["vibration"] = *req.PushVibration
+	}
+	if req.TimeZone != nil {
+		changes["timeZone"] = *req.TimeZone
+	}
+	if req.TimeZoneName != nil {
+		changes["timeZoneName"] = *req.TimeZoneName
+	}
+	if req.QuietHours != nil {
+		changes["quietHours"] = *req.QuietHours
+	}
+	if req.QuietHoursStart != nil {
+		changes["quietHoursStart"] = *req.QuietHoursStart
+	}
+	if req.QuietHoursEnd != nil {
+		changes["quietHoursEnd"] = *req.QuietHoursEnd
+	}
+	if req.DigestNewLike != nil {
+		changes["digestNewLike"] = *req.DigestNewLike
+	}
+	if req.DigestNewMatch != nil {
+		changes["digestNewMatch"] = *req.DigestNewMatch
+	}
+	if req.DigestNewMessage != nil {
+		changes["digestNewMessage"] = *req.DigestNewMessage
+	}
+	return changes
+}
+
+func (req SettingsPatch) String() string {
+	version := "none"
+	if req.Version != nil {
+		version = fmt.Sprintf("%d", *req.Version)
+	}
+	return fmt.Sprintf("SettingsPatch{AccessToken:%q, Changes:%v, Version:%s}", MaskToken(req.AccessToken), req.Changes(), version)
+}
+
 func (resp CreateResp) String() string {
+	resp.AccessToken = MaskToken(resp.AccessToken)
 	return fmt.Sprintf("%#v", resp)
 }
 
@@ -59,49 +198,121 @@ type DeleteReq struct {
 }
 
 func (req DeleteReq) String() string {
+	req.AccessToken = MaskToken(req.AccessToken)
+	return fmt.Sprintf("%#v", req)
+}
+
+//InternalIssueCampaignCodeReq issues referral code for a marketing campaign,
+//empty code means generate a new one, 0 expiresAt (unix time in seconds) means the code never expires
+type InternalIssueCampaignCodeReq struct {
+	WarmUpRequest bool   `json:"warmUpRequest"`
+	Code          string `json:"code"`
+	Campaign      string `json:"campaign"`
+	ExpiresAt     int64  `json:"expiresAt"`
+}
+
+func (req InternalIssueCampaignCodeReq) String() string {
 	return fmt.Sprintf("%#v", req)
 }
 
+type InternalIssueCampaignCodeResp struct {
+	Code         string `json:"code"`
+	ErrorCode    string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+func (resp InternalIssueCampaignCodeResp) String() string {
+	return fmt.Sprintf("%#v", resp)
+}
+
 type ClaimRequest struct {
 	AccessToken string `json:"accessToken"`
 	ReferralId  string `json:"referralId"`
 }
 
 func (req ClaimRequest) String() string {
+	req.AccessToken = MaskToken(req.AccessToken)
 	return fmt.Sprintf("%#v", req)
 }
 
+//coded fields are validated by ranges of the codes which clients know, 0 means not set,
+//text fields are sanitized and limited by length
 type UpdateProfileRequest struct {
 	AccessToken   string `json:"accessToken"`
-	Property      int    `json:"property"`
-	Transport     int    `json:"transport"`
-	Income        int    `json:"income"`
-	Height        int    `json:"height"`
-	Education     int    `json:"educationLevel"`
-	HairColor     int    `json:"hairColor"`
-	Children      int    `json:"children"`
-	Name          string `json:"name"`
-	JobTitle      string `json:"jobTitle"`
-	Company       string `json:"company"`
-	EducationText string `json:"education"`
-	About         string `json:"about"`
-	Instagram     string `json:"instagram"`
-	TikTok        string `json:"tikTok"`
-	WhereLive     string `json:"whereLive"`
-	WhereFrom     string `json:"whereFrom"`
-	StatusText    string `json:"statusText"`
+	Property      int    `json:"property" validate:"min=0,max=50"`
+	Transport     int    `json:"transport" validate:"min=0,max=60"`
+	Income        int    `json:"income" validate:"min=0,max=70"`
+	Height        int    `json:"height" validate:"optional,min=90,max=250"`
+	Education     int    `json:"educationLevel" validate:"min=0,max=70"`
+	HairColor     int    `json:"hairColor" validate:"min=0,max=70"`
+	Children      int    `json:"children" validate:"min=0,max=50"`
+	Name          string `json:"name" sanitize:"line" validate:"max=64"`
+	JobTitle      string `json:"jobTitle" sanitize:"line" validate:"max=128"`
+	Company       string `json:"company" sanitize:"line" validate:"max=128"`
+	EducationText string `json:"education" sanitize:"line" validate:"max=128"`
+	About         string `json:"about" sanitize:"text" validate:"max=1024"`
+	Instagram     string `json:"instagram" sanitize:"line" validate:"max=64"`
+	TikTok        string `json:"tikTok" sanitize:"line" validate:"max=64"`
+	WhereLive     string `json:"whereLive" sanitize:"line" validate:"max=128"`
+	WhereFrom     string `json:"whereFrom" sanitize:"line" validate:"max=128"`
+	StatusText    string `json:"statusText" sanitize:"line" validate:"max=256"`
+	//version which client has seen (see get_profile), update fails if the profile has another one
+	Version *int64 `json:"version"`
+	//in partial mode only fields which are present in the request are updated,
+	//field with null value is removed from the profile
+	Partial bool            `json:"partial"`
+	Present map[string]bool `json:"-"`
+	Cleared map[string]bool `json:"-"`
+}
+
+//UnmarshalJSON remembers which fields were present in the request and which of them were null
+func (req *UpdateProfileRequest) UnmarshalJSON(data []byte) error {
+	type plainRequest UpdateProfileRequest
+	err := json.Unmarshal(data, (*plainRequest)(req))
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	req.Present = make(map[string]bool)
+	req.Cleared = make(map[string]bool)
+	for key, value := range raw {
+		if string(bytes.TrimSpace(value)) == "null" {
+			req.Cleared[key] = true
+		} else {
+			req.Present[key] = true
+		}
+	}
+	return nil
 }
 
 func (req UpdateProfileRequest) String() string {
+	req.AccessToken = MaskToken(req.AccessToken)
 	return fmt.Sprintf("%#v", req)
 }
 
+//UpdateResponse is returned by profile and settings updates, client should send the version with the next update
+type UpdateResponse struct {
+	commons.BaseResponse
+	Version int64 `json:"version"`
+}
+
+func (resp UpdateResponse) String() string {
+	return fmt.Sprintf("%#v", resp)
+}
+
 type LoginWithEmailRequest struct {
 	Email  string `json:"email"`
 	Locale string `json:"locale"`
 }
 
 func (req LoginWithEmailRequest) String() string {
+	req.Email = MaskEmail(req.Email)
 	return fmt.Sprintf("%#v", req)
 }
 
@@ -111,6 +322,7 @@ type LoginWithEmailResponse struct {
 }
 
 func (req LoginWithEmailResponse) String() string {
+	req.AuthSessionId = MaskToken(req.AuthSessionId)
 	return fmt.Sprintf("%#v", req)
 }
 
@@ -121,6 +333,9 @@ type VerifyEmailRequest struct {
 }
 
 func (req VerifyEmailRequest) String() string {
+	req.AuthSessionId = MaskToken(req.AuthSessionId)
+	req.Email = MaskEmail(req.Email)
+	req.PinCode = MaskToken(req.PinCode)
 	return fmt.Sprintf("%#v", req)
 }
 
@@ -130,6 +345,7 @@ type VerifyEmailResponse struct {
 }
 
 func (req VerifyEmailResponse) String() string {
+	req.AccessToken = MaskToken(req.AccessToken)
 	return fmt.Sprintf("%#v", req)
 }
 
@@ -139,6 +355,8 @@ type ChangeEmailRequest struct {
 }
 
 func (req ChangeEmailRequest) String() string {
+	req.AccessToken = MaskToken(req.AccessToken)
+	req.NewEmail = MaskEmail(req.NewEmail)
 	return fmt.Sprintf("%#v", req)
 }
 
@@ -167,8 +385,55 @@ type GetProfileResponse struct {
 	WhereLive      string `json:"whereLive"`
 	WhereFrom      string `json:"whereFrom"`
 	StatusText     string `json:"statusText"`
+	Version        int64  `json:"version"`
 }
 
 func (req GetProfileResponse) String() string {
 	return fmt.Sprintf("%#v", req)
 }
+
+type GetSettingsResponse struct {
+	commons.BaseResponse
+	Settings
+	//current offset of the user's time zone, derived from the name if there is one
+	TimeZoneOffset int   `json:"timeZoneOffsetMinutes"`
+	Version        int64 `json:"version"`
+}
+
+func (resp GetSettingsResponse) String() string {
+	return fmt.Sprintf("%#v", resp)
+}
+
+type GetReferralCodeResponse struct {
+	commons.BaseResponse
+	ReferralCode string `json:"referralCode"`
+}
+
+func (resp GetReferralCodeResponse) String() string {
+	return fmt.Sprintf("%#v", resp)
+}
+
+type ReferralRewardStatus struct {
+	ReferralRewardRule
+	Earned bool `json:"earned"`
+}
+
+type GetReferralStatsResponse struct {
+	commons.BaseResponse
+	ReferralCode string                 `json:"referralCode"`
+	JoinedCount  int                    `json:"joinedCount"`
+	Rewards      []ReferralRewardStatus `json:"rewards"`
+}
+
+func (resp GetReferralStatsResponse) String() string {
+	return fmt.Sprintf("%#v", resp)
+}
+
+type LogoutRequest struct {
+	AccessToken string `json:"accessToken"`
+}
+
+func (req LogoutRequest) String() string {
+	req.AccessToken = MaskToken(req.AccessToken)
+	return fmt.Sprintf("%#v", req)
+}
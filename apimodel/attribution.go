@@ -0,0 +1,138 @@
+package apimodel
+
+import (
+	"fmt"
+	"sort"
+	"github.com/ringoid/commons"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	//UserProfile column (map) and the field of the created event with the attribution of the signup
+	AttributionColumnName = "attribution"
+	AttributionEventField = "attribution"
+
+	maxDeepLinkParams           = 20
+	maxDeepLinkParamKeyLength   = 64
+	maxDeepLinkParamValueLength = 512
+)
+
+//Attribution says where the user came from (utm like fields, play store install referrer, params of the deep link
+//which opened the app). Legacy clients send campaigns in referralId and privateKey, these fields are still accepted.
+type Attribution struct {
+	Source          string            `json:"source,omitempty" sanitize:"line" validate:"max=128"`
+	Medium          string            `json:"medium,omitempty" sanitize:"line" validate:"max=128"`
+	Campaign        string            `json:"campaign,omitempty" sanitize:"line" validate:"max=256"`
+	InstallReferrer string            `json:"installReferrer,omitempty" sanitize:"line" validate:"max=1024"`
+	DeepLinkParams  map[string]string `json:"deepLinkParams,omitempty"`
+}
+
+func (a Attribution) String() string {
+	return fmt.Sprintf("%#v", a.Masked())
+}
+
+//Masked returns the copy for the logs, install referrer and deep link params often carry click ids and tokens
+func (a Attribution) Masked() Attribution {
+	a.InstallReferrer = MaskToken(a.InstallReferrer)
+	if len(a.DeepLinkParams) != 0 {
+		params := make(map[string]string, len(a.DeepLinkParams))
+		for key, value := range a.DeepLinkParams {
+			params[key] = MaskToken(value)
+		}
+		a.DeepLinkParams = params
+	}
+	return a
+}
+
+func (a Attribution) Empty() bool {
+	return a.Source == "" && a.Medium == "" && a.Campaign == "" && a.InstallReferrer == "" && len(a.DeepLinkParams) == 0
+}
+
+//Validate sanitizes the fields and returns the problems, field names are prefixed with attribution
+func (a *Attribution) Validate() []FieldError {
+	var result []FieldError
+	for _, each := range Validate(a) {
+		each.Field = AttributionEventField + "." + each.Field
+		result = append(result, each)
+	}
+
+	if len(a.DeepLinkParams) > maxDeepLinkParams {
+		return append(result, FieldError{
+			Field:   AttributionEventField + ".deepLinkParams",
+			Message: fmt.Sprintf("must have at most %d params", maxDeepLinkParams),
+		})
+	}
+
+	params := make(map[string]string, len(a.DeepLinkParams))
+	longKeys := false
+	for key, value := range a.DeepLinkParams {
+		key = Sanitize(key, false)
+		value = Sanitize(value, false)
+		switch {
+		case key == "":
+			continue
+		case len([]rune(key)) > maxDeepLinkParamKeyLength:
+			//the key is not echoed back, it could be anything
+			longKeys = true
+		case len([]rune(value)) > maxDeepLinkParamValueLength:
+			result = append(result, FieldError{
+				Field:   AttributionEventField + ".deepLinkParams." + key,
+				Message: fmt.Sprintf("must be at most %d symbols", maxDeepLinkParamValueLength),
+			})
+		default:
+			params[key] = value
+		}
+	}
+	if longKeys {
+		result = append(result, FieldError{
+			Field:   AttributionEventField + ".deepLinkParams",
+			Message: fmt.Sprintf("keys must be at most %d symbols", maxDeepLinkParamKeyLength),
+		})
+	}
+	a.DeepLinkParams = params
+	if len(a.DeepLinkParams) == 0 {
+		a.DeepLinkParams = nil
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Field < result[j].Field })
+	return result
+}
+
+//AttributeValue returns attribution as dynamodb map, empty fields are skipped
+func (a Attribution) AttributeValue() *dynamodb.AttributeValue {
+	result := make(map[string]*dynamodb.AttributeValue)
+	for name, value := range map[string]string{
+		"source":          a.Source,
+		"medium":          a.Medium,
+		"campaign":        a.Campaign,
+		"installReferrer": a.InstallReferrer,
+	} {
+		if value != "" {
+			result[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+		}
+	}
+	if len(a.DeepLinkParams) != 0 {
+		params := make(map[string]*dynamodb.AttributeValue, len(a.DeepLinkParams))
+		for key, value := range a.DeepLinkParams {
+			params[key] = &dynamodb.AttributeValue{S: aws.String(value)}
+		}
+		result["deepLinkParams"] = &dynamodb.AttributeValue{M: params}
+	}
+	return &dynamodb.AttributeValue{M: result}
+}
+
+//ExtendCreatedEvent adds the attribution into the created event, event is returned as is if there is nothing to add
+//(or the attribution can't be added)
+func ExtendCreatedEvent(event interface{}, attribution Attribution, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) interface{} {
+	if attribution.Empty() {
+		return event
+	}
+	extended, err := ExtendEvent(event, map[string]interface{}{AttributionEventField: attribution})
+	if err != nil {
+		anlogger.Errorf(lc, "attribution.go : error add attribution %v to the created event : %v", attribution, err)
+		return event
+	}
+	return extended
+}
@@ -0,0 +1,127 @@
+package apimodel
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAttributionValidate(t *testing.T) {
+	manyParams := make(map[string]string)
+	for i := 0; i <= maxDeepLinkParams; i++ {
+		manyParams[fmt.Sprintf("key%d", i)] = "value"
+	}
+	longKey := strings.Repeat("k", maxDeepLinkParamKeyLength+1)
+
+	tests := []struct {
+		name       string
+		attr       Attribution
+		want       []FieldError
+		wantParams map[string]string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:       "valid with sanitized params",
+			attr:       Attribution{Source: " facebook ", DeepLinkParams: map[string]string{" utm_content ": "banner\u200b"}},
+			wantParams: map[string]string{"utm_content": "banner"},
+		},
+		{
+			name: "too long fields",
+			attr: Attribution{Source: strings.Repeat("s", 129), InstallReferrer: strings.Repeat("r", 1025)},
+			want: []FieldError{
+				{Field: "attribution.installReferrer", Message: "must be at most 1024 symbols"},
+				{Field: "attribution.source", Message: "must be at most 128 symbols"},
+			},
+		},
+		{
+			name: "too many params",
+			attr: Attribution{DeepLinkParams: manyParams},
+			want: []FieldError{
+				{Field: "attribution.deepLinkParams", Message: "must have at most 20 params"},
+			},
+			wantParams: manyParams,
+		},
+		{
+			name: "long key is not echoed",
+			attr: Attribution{DeepLinkParams: map[string]string{longKey: "value", "ok": "value"}},
+			want: []FieldError{
+				{Field: "attribution.deepLinkParams", Message: "keys must be at most 64 symbols"},
+			},
+			wantParams: map[string]string{"ok": "value"},
+		},
+		{
+			name: "long value",
+			attr: Attribution{DeepLinkParams: map[string]string{"ok": strings.Repeat("v", maxDeepLinkParamValueLength+1)}},
+			want: []FieldError{
+				{Field: "attribution.deepLinkParams.ok", Message: "must be at most 512 symbols"},
+			},
+		},
+		{
+			name: "empty keys are dropped",
+			attr: Attribution{DeepLinkParams: map[string]string{" ": "value", "\u200b": "value"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.attr.Validate()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+			for _, each := range got {
+				if strings.Contains(each.Field+each.Message, longKey) {
+					t.Errorf("Validate() echoes the long key in %v", each)
+				}
+			}
+			if !reflect.DeepEqual(tt.attr.DeepLinkParams, tt.wantParams) {
+				t.Errorf("params = %v, want %v", tt.attr.DeepLinkParams, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestAttributionMasked(t *testing.T) {
+	attr := Attribution{
+		Source:          "google",
+		Campaign:        "summer",
+		InstallReferrer: "utm_source=google&gclid=click-id-value",
+		DeepLinkParams:  map[string]string{"token": "deep-link-token", "ref": "abc"},
+	}
+
+	masked := attr.Masked()
+	want := Attribution{
+		Source:          "google",
+		Campaign:        "summer",
+		InstallReferrer: "utm_***",
+		DeepLinkParams:  map[string]string{"token": "deep***", "ref": "***"},
+	}
+	if !reflect.DeepEqual(masked, want) {
+		t.Errorf("Masked() = %#v, want %#v", masked, want)
+	}
+	if attr.DeepLinkParams["token"] != "deep-link-token" {
+		t.Errorf("Masked() changed the params of the attribution")
+	}
+	if strings.Contains(attr.String(), "click-id-value") {
+		t.Errorf("String() = %s, install referrer is not masked", attr.String())
+	}
+}
+
+func TestAttributionEmpty(t *testing.T) {
+	tests := []struct {
+		attr Attribution
+		want bool
+	}{
+		{Attribution{}, true},
+		{Attribution{DeepLinkParams: map[string]string{}}, true},
+		{Attribution{Medium: "cpc"}, false},
+		{Attribution{DeepLinkParams: map[string]string{"ref": "abc"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.attr.Empty(); got != tt.want {
+			t.Errorf("%#v Empty() = %v, want %v", tt.attr, got, tt.want)
+		}
+	}
+}
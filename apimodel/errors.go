@@ -0,0 +1,135 @@
+package apimodel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/ringoid/commons"
+)
+
+//AuthError is a typed service error. It travels through the handlers as a value
+//and is converted into the commons response format only at the edge (see ServiceResponse).
+type AuthError struct {
+	Code       string
+	Message    string
+	HttpStatus int
+	Retryable  bool
+	Cause      error
+	//details for the client why request params were rejected
+	FieldErrors []FieldError
+}
+
+var knownErrors = make(map[string]*AuthError)
+
+var (
+	ErrInternalServer           = registerCommonsError(commons.InternalServerError, http.StatusInternalServerError, true)
+	ErrWrongRequestParams       = registerCommonsError(commons.WrongRequestParamsClientError, http.StatusBadRequest, false)
+	ErrWrongYearOfBirth         = registerCommonsError(commons.WrongYearOfBirthClientError, http.StatusBadRequest, false)
+	ErrWrongSex                 = registerCommonsError(commons.WrongSexClientError, http.StatusBadRequest, false)
+	ErrWrongPinCode             = registerCommonsError(commons.WrongPinCodeClientError, http.StatusBadRequest, false)
+	ErrEmailInvalidVerification = registerCommonsError(commons.EmailInvalidVerificationClientError, http.StatusBadRequest, false)
+	ErrEmailConcurrentUsage     = registerCommonsError(commons.EmailConcurrentUsageClientError, http.StatusConflict, false)
+	ErrEmailAlreadyInUse        = registerCommonsError(commons.EmailAlreadyInUseClientError, http.StatusConflict, false)
+	ErrInvalidAccessToken       = registerError("InvalidAccessTokenClientError", "Invalid access token", http.StatusUnauthorized, false)
+	ErrTooOldAppVersion         = registerError("TooOldAppVersionClientError", "Too old app version", http.StatusUpgradeRequired, false)
+	ErrVersionConflict          = registerError("VersionConflictClientError", "Data was changed on another device, reload it and try again", http.StatusConflict, false)
+	ErrInvalidReferralCode      = registerError("InvalidReferralCodeClientError", "Referral code doesn't exist or is expired", http.StatusBadRequest, false)
+)
+
+func registerError(code, message string, httpStatus int, retryable bool) *AuthError {
+	err := &AuthError{
+		Code:       code,
+		Message:    message,
+		HttpStatus: httpStatus,
+		Retryable:  retryable,
+	}
+	knownErrors[code] = err
+	return err
+}
+
+//commons keeps errors as ready to use json bodies, so take code and message from there
+func registerCommonsError(errStr string, httpStatus int, retryable bool) *AuthError {
+	var body errorBody
+	if err := json.Unmarshal([]byte(errStr), &body); err != nil || body.ErrorCode == "" {
+		return registerError(errStr, errStr, httpStatus, retryable)
+	}
+	return registerError(body.ErrorCode, body.ErrorMessage, httpStatus, retryable)
+}
+
+type errorBody struct {
+	ErrorCode    string       `json:"errorCode"`
+	ErrorMessage string       `json:"errorMessage"`
+	FieldErrors  []FieldError `json:"fieldErrors,omitempty"`
+}
+
+//FromErrorString converts an error string returned by commons functions into the typed error.
+//Unknown codes are kept as is, but treated like internal errors. Empty string means no error.
+func FromErrorString(errStr string) *AuthError {
+	if errStr == "" {
+		return nil
+	}
+	var body errorBody
+	if err := json.Unmarshal([]byte(errStr), &body); err != nil || body.ErrorCode == "" {
+		return ErrInternalServer.Wrap(fmt.Errorf("unknown error string %s", errStr))
+	}
+	if known, ok := knownErrors[body.ErrorCode]; ok {
+		return known
+	}
+	return &AuthError{
+		Code:       body.ErrorCode,
+		Message:    body.ErrorMessage,
+		HttpStatus: ErrInternalServer.HttpStatus,
+		Retryable:  ErrInternalServer.Retryable,
+	}
+}
+
+//Wrap returns a copy of the error with the cause attached, predefined errors stay untouched
+func (e *AuthError) Wrap(cause error) *AuthError {
+	wrapped := *e
+	wrapped.Cause = cause
+	return &wrapped
+}
+
+//WithFieldErrors returns a copy of the error with the field errors attached
+func (e *AuthError) WithFieldErrors(fieldErrors []FieldError) *AuthError {
+	withFields := *e
+	withFields.FieldErrors = fieldErrors
+	return &withFields
+}
+
+func (e *AuthError) Error() string {
+	if len(e.FieldErrors) != 0 {
+		return fmt.Sprintf("%s (%s) : %v", e.Code, e.Message, e.FieldErrors)
+	}
+	if e.Cause != nil {
+		return fmt.Sprintf("%s (%s) : %v", e.Code, e.Message, e.Cause)
+	}
+	return fmt.Sprintf("%s (%s)", e.Code, e.Message)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Cause
+}
+
+//Is reports errors with the same code as equal, so errors.Is(err, ErrWrongPinCode) works for wrapped copies
+func (e *AuthError) Is(target error) bool {
+	t, ok := target.(*AuthError)
+	if !ok {
+		return false
+	}
+	return e.Code == t.Code
+}
+
+//ResponseBody returns the error in the same json format which commons uses for client errors
+func (e *AuthError) ResponseBody() string {
+	body, err := json.Marshal(errorBody{ErrorCode: e.Code, ErrorMessage: e.Message, FieldErrors: e.FieldErrors})
+	if err != nil {
+		return commons.InternalServerError
+	}
+	return string(body)
+}
+
+func (e *AuthError) ServiceResponse() events.ALBTargetGroupResponse {
+	return commons.NewServiceResponse(e.ResponseBody())
+}
@@ -0,0 +1,64 @@
+package apimodel
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestFromErrorString(t *testing.T) {
+	tests := []struct {
+		name       string
+		errStr     string
+		wantNil    bool
+		wantCode   string
+		wantStatus int
+	}{
+		{name: "empty string is no error", errStr: "", wantNil: true},
+		{name: "known auth error", errStr: ErrInvalidAccessToken.ResponseBody(),
+			wantCode: ErrInvalidAccessToken.Code, wantStatus: http.StatusUnauthorized},
+		{name: "known commons error", errStr: ErrWrongRequestParams.ResponseBody(),
+			wantCode: ErrWrongRequestParams.Code, wantStatus: http.StatusBadRequest},
+		{name: "unknown code is internal", errStr: `{"errorCode":"SomethingNewClientError","errorMessage":"new"}`,
+			wantCode: "SomethingNewClientError", wantStatus: http.StatusInternalServerError},
+		{name: "not json", errStr: "broken", wantCode: ErrInternalServer.Code, wantStatus: http.StatusInternalServerError},
+		{name: "json without code", errStr: `{"errorMessage":"no code"}`,
+			wantCode: ErrInternalServer.Code, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FromErrorString(tt.errStr)
+			if tt.wantNil {
+				if got != nil {
+					t.Fatalf("FromErrorString(%q) = %v, want nil", tt.errStr, got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("FromErrorString(%q) = nil, want %s", tt.errStr, tt.wantCode)
+			}
+			if got.Code != tt.wantCode || got.HttpStatus != tt.wantStatus {
+				t.Errorf("FromErrorString(%q) = %s/%d, want %s/%d", tt.errStr, got.Code, got.HttpStatus, tt.wantCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAuthErrorWrapKeepsIdentity(t *testing.T) {
+	cause := errors.New("db is down")
+	wrapped := ErrInternalServer.Wrap(cause)
+
+	if !errors.Is(wrapped, ErrInternalServer) {
+		t.Errorf("wrapped error is not ErrInternalServer")
+	}
+	if errors.Is(wrapped, ErrWrongRequestParams) {
+		t.Errorf("wrapped error is ErrWrongRequestParams")
+	}
+	if !errors.Is(wrapped, cause) {
+		t.Errorf("cause is lost")
+	}
+	if ErrInternalServer.Cause != nil {
+		t.Errorf("predefined error was changed by Wrap")
+	}
+}
@@ -0,0 +1,119 @@
+package apimodel
+
+import (
+	"time"
+	"fmt"
+	"context"
+	"encoding/json"
+	"../tracing"
+	"github.com/ringoid/commons"
+)
+
+const (
+	UserLogoutEventType = "AUTH_USER_LOGOUT"
+)
+
+type UserLogoutEvent struct {
+	UserId    string `json:"userId"`
+	SourceIp  string `json:"sourceIp"`
+	UnixTime  int64  `json:"unixTime"`
+	EventType string `json:"eventType"`
+}
+
+func (event UserLogoutEvent) String() string {
+	return fmt.Sprintf("%#v", event)
+}
+
+func NewUserLogoutEvent(userId, sourceIp string) UserLogoutEvent {
+	return UserLogoutEvent{
+		UserId:    userId,
+		SourceIp:  sourceIp,
+		UnixTime:  time.Now().Unix(),
+		EventType: UserLogoutEventType,
+	}
+}
+
+//ExtendEvent returns event as a json map with extra fields merged in, the result could be sent
+//instead of the event itself. Extra fields win over the fields of the event.
+func ExtendEvent(event interface{}, extra map[string]interface{}) (map[string]interface{}, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{})
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		result[k] = v
+	}
+	return result, nil
+}
+
+//TracedEvent adds trace context of ctx into the event, so consumers could continue the trace.
+//Event is returned as is if there is nothing to add.
+func TracedEvent(ctx context.Context, event interface{}) interface{} {
+	traceContext := tracing.Inject(ctx)
+	if len(traceContext) == 0 {
+		return event
+	}
+	extended, err := ExtendEvent(event, map[string]interface{}{tracing.EventTraceContextField: traceContext})
+	if err != nil {
+		return event
+	}
+	return extended
+}
+
+//ExtendSettingsEvent adds settings which commons event doesn't have (time zone name with its current offset,
+//quiet hours, digest options) from changes (keys are request param names, see SettingsPatch.Changes),
+//event is returned as is if there is nothing to add
+func ExtendSettingsEvent(event interface{}, changes map[string]interface{}, now time.Time) interface{} {
+	extra := make(map[string]interface{})
+	for _, each := range extendedSettingsFields {
+		if value, ok := changes[each]; ok {
+			extra[each] = value
+		}
+	}
+	if name, ok := extra[TimeZoneNameEventField].(string); ok {
+		location, err := LoadTimeZone(name)
+		if err != nil {
+			delete(extra, TimeZoneNameEventField)
+		} else {
+			extra[TimeZoneOffsetEventField] = TimeZoneOffset(location, now)
+		}
+	}
+	if len(extra) == 0 {
+		return event
+	}
+	extended, err := ExtendEvent(event, extra)
+	if err != nil {
+		return event
+	}
+	return extended
+}
+
+//fields of commons.UserProfileUpdatedEvent which are not the profile ones
+var profileUpdatedEventBaseFields = map[string]bool{
+	"userId":    true,
+	"sourceIp":  true,
+	"unixTime":  true,
+	"eventType": true,
+}
+
+//NewUserProfilePatchedEvent returns commons.UserProfileUpdatedEvent for the partial profile update,
+//the event has only changed fields (keys are json names of the request fields), removed ones have zero values
+func NewUserProfilePatchedEvent(userId, sourceIp string, changed map[string]interface{}) (map[string]interface{}, error) {
+	event := commons.NewUserProfileUpdatedEvent(userId, sourceIp, 0, 0, 0, 0, 0, 0, 0,
+		"", "", "", "", "", "", "", "", "", "")
+	result, err := ExtendEvent(event, changed)
+	if err != nil {
+		return nil, err
+	}
+	for key := range result {
+		if _, ok := changed[key]; !ok && !profileUpdatedEventBaseFields[key] {
+			delete(result, key)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,92 @@
+package apimodel
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	LastOnlineFlagOnline    = "online"
+	LastOnlineFlagToday     = "today"
+	LastOnlineFlagYesterday = "yesterday"
+	LastOnlineFlagThisWeek  = "this_week"
+	LastOnlineFlagThisMonth = "this_month"
+	LastOnlineFlagLongAgo   = "long_ago"
+	//there is no last online time for the user
+	LastOnlineFlagUnknown = "unknown"
+
+	DefaultLocale = "en"
+
+	//user is shown as online if there was an activity during this period
+	onlinePeriod = 15 * time.Minute
+)
+
+var lastOnlineTexts = map[string]map[string]string{
+	"en": {
+		LastOnlineFlagOnline:    "Online",
+		LastOnlineFlagToday:     "Today",
+		LastOnlineFlagYesterday: "Yesterday",
+		LastOnlineFlagThisWeek:  "This week",
+		LastOnlineFlagThisMonth: "This month",
+		LastOnlineFlagLongAgo:   "Long ago",
+		LastOnlineFlagUnknown:   "Unknown",
+	},
+	"ru": {
+		LastOnlineFlagOnline:    "В сети",
+		LastOnlineFlagToday:     "Сегодня",
+		LastOnlineFlagYesterday: "Вчера",
+		LastOnlineFlagThisWeek:  "На этой неделе",
+		LastOnlineFlagThisMonth: "В этом месяце",
+		LastOnlineFlagLongAgo:   "Давно",
+		LastOnlineFlagUnknown:   "Неизвестно",
+	},
+}
+
+//LastOnline returns flag and localized text for the last online time (unix time in millis, 0 if unknown).
+//Days are counted in the user's time zone (see UserLocation), unsupported locales fall back to DefaultLocale.
+func LastOnline(lastOnlineMillis int64, now time.Time, location *time.Location, locale string) (flag, text string) {
+	flag = lastOnlineFlag(lastOnlineMillis, now, location)
+	return flag, lastOnlineTexts[normalizeLocale(locale)][flag]
+}
+
+func lastOnlineFlag(lastOnlineMillis int64, now time.Time, location *time.Location) string {
+	if lastOnlineMillis <= 0 {
+		return LastOnlineFlagUnknown
+	}
+	lastOnline := time.Unix(0, lastOnlineMillis*int64(time.Millisecond))
+	if now.Sub(lastOnline) < onlinePeriod {
+		return LastOnlineFlagOnline
+	}
+
+	days := daysBetween(lastOnline.In(location), now.In(location))
+	switch {
+	case days <= 0:
+		return LastOnlineFlagToday
+	case days == 1:
+		return LastOnlineFlagYesterday
+	case days < 7:
+		return LastOnlineFlagThisWeek
+	case days < 30:
+		return LastOnlineFlagThisMonth
+	}
+	return LastOnlineFlagLongAgo
+}
+
+//number of calendar days between two dates in the same location
+func daysBetween(from, to time.Time) int {
+	fromDay := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	toDay := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(toDay.Sub(fromDay).Hours() / 24)
+}
+
+//en_US, en-US and EN become en
+func normalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(locale, "_-"); i >= 0 {
+		locale = locale[:i]
+	}
+	if _, ok := lastOnlineTexts[locale]; ok {
+		return locale
+	}
+	return DefaultLocale
+}
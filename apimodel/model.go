@@ -1,17 +1,57 @@
 package apimodel
 
 func NewSettings(req *CreateReq) *Settings {
-	defaultLocale := "en"
+	settings := DefaultSettings()
 	if req.AppSettings.Locale != "" {
-		defaultLocale = req.AppSettings.Locale
+		settings.Locale = req.AppSettings.Locale
 	}
+	settings.TimeZone = req.AppSettings.TimeZone
+	settings.TimeZoneName = req.AppSettings.TimeZoneName
+	settings.Push = req.AppSettings.Push
+	settings.PushNewLike = req.AppSettings.PushNewLike
+	settings.PushNewMatch = req.AppSettings.PushNewMatch
+	settings.PushNewMessage = req.AppSettings.PushNewMessage
+	settings.QuietHours = req.AppSettings.QuietHours
+	//keep default bounds if the client doesn't use quiet hours
+	if req.AppSettings.QuietHours {
+		settings.QuietHoursStart = req.AppSettings.QuietHoursStart
+		settings.QuietHoursEnd = req.AppSettings.QuietHoursEnd
+	}
+	settings.DigestNewLike = req.AppSettings.DigestNewLike
+	settings.DigestNewMatch = req.AppSettings.DigestNewMatch
+	settings.DigestNewMessage = req.AppSettings.DigestNewMessage
+	return settings
+}
+
+//DefaultSettings returns settings which are used when the user (or some attribute) has no stored value
+func DefaultSettings() *Settings {
 	return &Settings{
-		Locale:         defaultLocale,
-		TimeZone:       req.AppSettings.TimeZone,
-		Push:           req.AppSettings.Push,
-		PushNewLike:    req.AppSettings.PushNewLike,
-		PushNewMatch:   req.AppSettings.PushNewMatch,
-		PushNewMessage: req.AppSettings.PushNewMessage,
-		PushVibration:  true,
+		Locale:          DefaultLocale,
+		PushVibration:   true,
+		QuietHoursStart: DefaultQuietHoursStart,
+		QuietHoursEnd:   DefaultQuietHoursEnd,
+	}
+}
+
+//Patch returns the patch which sets all the settings, time zone name is set only if there is one
+func (resp Settings) Patch() SettingsPatch {
+	patch := SettingsPatch{
+		Locale:           &resp.Locale,
+		Push:             &resp.Push,
+		PushNewLike:      &resp.PushNewLike,
+		PushNewMessage:   &resp.PushNewMessage,
+		PushNewMatch:     &resp.PushNewMatch,
+		PushVibration:    &resp.PushVibration,
+		TimeZone:         &resp.TimeZone,
+		QuietHours:       &resp.QuietHours,
+		QuietHoursStart:  &resp.QuietHoursStart,
+		QuietHoursEnd:    &resp.QuietHoursEnd,
+		DigestNewLike:    &resp.DigestNewLike,
+		DigestNewMatch:   &resp.DigestNewMatch,
+		DigestNewMessage: &resp.DigestNewMessage,
+	}
+	if resp.TimeZoneName != "" {
+		patch.TimeZoneName = &resp.TimeZoneName
 	}
+	return patch
 }
@@ -0,0 +1,300 @@
+package apimodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/ringoid/commons"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"../tracing"
+	"../metrics"
+)
+
+//Request is what middlewares know about the incoming ALB request,
+//every middleware fills its own part before it calls the next one
+type Request struct {
+	Ctx              context.Context
+	Lc               *lambdacontext.LambdaContext
+	Raw              events.ALBTargetGroupRequest
+	StartTime        time.Time
+	CorrelationId    string
+	Log              *RequestLogger
+	SourceIp         string
+	AppVersion       int
+	IsItAndroid      bool
+	UserId           string
+	UserReportStatus string
+	//result of Body middleware, business function knows the real type
+	Params interface{}
+	//error which was returned to the client, nil if request was successful
+	Err *AuthError
+}
+
+//Latency since the request was received
+func (req *Request) Latency() time.Duration {
+	return time.Since(req.StartTime)
+}
+
+type Handler func(req *Request) events.ALBTargetGroupResponse
+
+type Middleware func(next Handler) Handler
+
+//Chain wraps handler with middlewares, the first one is the outermost
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+//ALBHandler adapts the chain to the signature which lambda runtime expects
+func ALBHandler(handler Handler) func(context.Context, events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
+	return func(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
+		lc, _ := lambdacontext.FromContext(ctx)
+		correlationId := CorrelationId(request.Headers)
+		req := &Request{
+			Ctx:           ctx,
+			Lc:            lc,
+			Raw:           request,
+			StartTime:     time.Now(),
+			CorrelationId: correlationId,
+			Log:           StructuredLog.ForRequest(correlationId),
+			SourceIp:      request.Headers["x-forwarded-for"],
+		}
+		resp := handler(req)
+		//return the id, so client could report it with the problem
+		if resp.Headers == nil {
+			resp.Headers = make(map[string]string)
+		}
+		resp.Headers[CorrelationIdHeader] = correlationId
+		return resp, nil
+	}
+}
+
+//Typed turns business function into the handler. Returned value is marshaled into the response body
+//(nil means empty commons.BaseResponse), returned error is converted into the commons error format.
+func Typed(anlogger *commons.Logger, fn func(req *Request) (interface{}, *AuthError)) Handler {
+	return func(req *Request) events.ALBTargetGroupResponse {
+		resp, authErr := fn(req)
+		if authErr != nil {
+			req.Err = authErr
+			anlogger.Errorf(req.Lc, "pipeline.go : userId [%s], return %v to client", req.UserId, authErr)
+			return authErr.ServiceResponse()
+		}
+
+		if resp == nil {
+			resp = commons.BaseResponse{}
+		}
+
+		body, err := json.Marshal(resp)
+		if err != nil {
+			authErr = ErrInternalServer.Wrap(err)
+			req.Err = authErr
+			anlogger.Errorf(req.Lc, "pipeline.go : error while marshaling resp object for userId [%s] : %v", req.UserId, err)
+			anlogger.Errorf(req.Lc, "pipeline.go : userId [%s], return %v to client", req.UserId, authErr)
+			return authErr.ServiceResponse()
+		}
+
+		anlogger.Debugf(req.Lc, "pipeline.go : return body=%s to client, userId [%s]", Scrub(string(body)), req.UserId)
+		return commons.NewServiceResponse(string(body))
+	}
+}
+
+//Recovery converts panic in any of the next handlers into internal server error
+func Recovery(anlogger *commons.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) (resp events.ALBTargetGroupResponse) {
+			defer func() {
+				if r := recover(); r != nil {
+					stack := string(debug.Stack())
+					anlogger.Errorf(req.Lc, "pipeline.go : panic while handle request for userId [%s] : %v\n%s", req.UserId, r, stack)
+					req.Err = ErrInternalServer.Wrap(fmt.Errorf("panic : %v", r))
+					req.Log.Log(LogLevelError, "request failed with panic", Fields{
+						"latencyMs": req.Latency().Nanoseconds() / int64(time.Millisecond),
+						"outcome":   OutcomePanic,
+						"errorCode": req.Err.Code,
+						"panic":     fmt.Sprintf("%v", r),
+						"stack":     stack,
+					})
+					metrics.Count(metrics.ErrorMetricName, metrics.Dimensions{metrics.ErrorCodeDimension: req.Err.Code})
+					resp = req.Err.ServiceResponse()
+				}
+			}()
+			return next(req)
+		}
+	}
+}
+
+//Tracing starts server span for the request, spans of aws calls and outbound requests become its children
+func Tracing() Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) (resp events.ALBTargetGroupResponse) {
+			ctx, span := tracing.StartInvocation(req.Ctx, trace.SpanKindServer,
+				attribute.String("http.method", req.Raw.HTTPMethod),
+				attribute.String("http.path", req.Raw.Path),
+				attribute.String("correlationId", req.CorrelationId),
+			)
+			req.Ctx = ctx
+			defer func() {
+				if r := recover(); r != nil {
+					tracing.End(span, fmt.Errorf("panic : %v", r))
+					panic(r)
+				}
+				span.SetAttributes(attribute.String("userId", req.UserId), attribute.Int("http.statusCode", resp.StatusCode))
+				if req.Err != nil {
+					tracing.End(span, req.Err)
+					return
+				}
+				tracing.End(span, nil)
+			}()
+			return next(req)
+		}
+	}
+}
+
+//Metrics reports latency of every request and count of returned errors by error code,
+//panics are counted by Recovery
+func Metrics() Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) events.ALBTargetGroupResponse {
+			resp := next(req)
+			metrics.Latency(metrics.LatencyMetricName, req.Latency(), nil)
+			if req.Err != nil {
+				metrics.Count(metrics.ErrorMetricName, metrics.Dimensions{metrics.ErrorCodeDimension: req.Err.Code})
+			}
+			return resp
+		}
+	}
+}
+
+func RequestLogging(anlogger *commons.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) events.ALBTargetGroupResponse {
+			anlogger.Debugf(req.Lc, "pipeline.go : start handle request %s", Scrubf("%v", req.Raw))
+			req.Log.Log(LogLevelInfo, "request started", Fields{
+				"method":   req.Raw.HTTPMethod,
+				"path":     req.Raw.Path,
+				"sourceIp": req.SourceIp,
+			})
+
+			resp := next(req)
+
+			anlogger.Debugf(req.Lc, "pipeline.go : finish handle request for userId [%s] with status code [%d]", req.UserId, resp.StatusCode)
+			level := LogLevelInfo
+			fields := Fields{
+				"latencyMs":  req.Latency().Nanoseconds() / int64(time.Millisecond),
+				"statusCode": resp.StatusCode,
+				"outcome":    OutcomeSuccess,
+			}
+			if req.Err != nil {
+				level = LogLevelError
+				fields["outcome"] = OutcomeError
+				fields["errorCode"] = req.Err.Code
+				fields["retryable"] = req.Err.Retryable
+			}
+			req.Log.Log(level, "request finished", fields)
+			return resp
+		}
+	}
+}
+
+//HealthCheck answers to ELB health checker without going further
+func HealthCheck() Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) events.ALBTargetGroupResponse {
+			if strings.HasPrefix(req.Raw.Headers["user-agent"], "ELB-HealthChecker") {
+				return commons.NewServiceResponse("{}")
+			}
+			return next(req)
+		}
+	}
+}
+
+func Method(httpMethod string) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) events.ALBTargetGroupResponse {
+			if req.Raw.HTTPMethod != httpMethod {
+				return commons.NewWrongHttpMethodServiceResponse()
+			}
+			return next(req)
+		}
+	}
+}
+
+//AppVersion parses app version from the headers and checks that this version is still supported
+func AppVersion(anlogger *commons.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) events.ALBTargetGroupResponse {
+			appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(req.Raw.Headers, anlogger, req.Lc)
+			if !ok {
+				req.Err = FromErrorString(errStr)
+				anlogger.Errorf(req.Lc, "pipeline.go : return %v to client", req.Err)
+				return req.Err.ServiceResponse()
+			}
+
+			ok, errStr = commons.CheckAppVersion(appVersion, isItAndroid, anlogger, req.Lc)
+			if !ok {
+				req.Err = FromErrorString(errStr)
+				anlogger.Errorf(req.Lc, "pipeline.go : return %v to client", req.Err)
+				return req.Err.ServiceResponse()
+			}
+
+			req.AppVersion = appVersion
+			req.IsItAndroid = isItAndroid
+			return next(req)
+		}
+	}
+}
+
+//Body parses request body with lambda specific function and puts the result into Request.Params
+func Body(anlogger *commons.Logger, parse func(body string, lc *lambdacontext.LambdaContext) (interface{}, *AuthError)) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) events.ALBTargetGroupResponse {
+			params, authErr := parse(req.Raw.Body, req.Lc)
+			if authErr != nil {
+				req.Err = authErr
+				anlogger.Errorf(req.Lc, "pipeline.go : return %v to client", authErr)
+				return authErr.ServiceResponse()
+			}
+			req.Params = params
+			return next(req)
+		}
+	}
+}
+
+//Auth logins the user with access token which token function takes from the request (body or query),
+//so it should go after AppVersion and Body middlewares
+func Auth(token func(req *Request) string, secretWord, userProfileTable, commonStreamName string,
+	awsDbClient *dynamodb.DynamoDB, awsKinesisClient *kinesis.Kinesis, anlogger *commons.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) events.ALBTargetGroupResponse {
+			accessToken := token(req)
+			if accessToken == "" {
+				req.Err = ErrWrongRequestParams
+				anlogger.Errorf(req.Lc, "pipeline.go : accessToken is nil or empty, return %v to client", req.Err)
+				return req.Err.ServiceResponse()
+			}
+
+			userId, _, userReportStatus, ok, errStr := commons.Login(req.AppVersion, req.IsItAndroid, accessToken, secretWord,
+				userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger, req.Lc)
+			if !ok {
+				req.Err = FromErrorString(errStr)
+				anlogger.Errorf(req.Lc, "pipeline.go : return %v to client", req.Err)
+				return req.Err.ServiceResponse()
+			}
+
+			req.UserId = userId
+			req.UserReportStatus = userReportStatus
+			req.Log.UserId = userId
+			return next(req)
+		}
+	}
+}
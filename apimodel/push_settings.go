@@ -0,0 +1,25 @@
+package apimodel
+
+const (
+	//UserSettings columns, quiet hours are minutes from the midnight in the user's time zone
+	QuietHoursColumnName       = "quietHours"
+	QuietHoursStartColumnName  = "quietHoursStart"
+	QuietHoursEndColumnName    = "quietHoursEnd"
+	DigestNewLikeColumnName    = "digestNewLike"
+	DigestNewMatchColumnName   = "digestNewMatch"
+	DigestNewMessageColumnName = "digestNewMessage"
+
+	DefaultQuietHoursStart = 22 * 60
+	DefaultQuietHoursEnd   = 8 * 60
+)
+
+//settings which commons.UserSettingsUpdatedEvent doesn't have, they are added to the event by ExtendSettingsEvent
+var extendedSettingsFields = []string{
+	TimeZoneNameEventField,
+	QuietHoursColumnName,
+	QuietHoursStartColumnName,
+	QuietHoursEndColumnName,
+	DigestNewLikeColumnName,
+	DigestNewMatchColumnName,
+	DigestNewMessageColumnName,
+}
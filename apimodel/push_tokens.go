@@ -0,0 +1,199 @@
+package apimodel
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"github.com/ringoid/commons"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+//PushTokens table keeps FCM/APNs token of the device with the current session of the user,
+//user has only one session (login and logout switch the session token), so a new token replaces the old one
+const (
+	PushTokenColumnName          = "pushToken"
+	PushTokenPlatformColumnName  = "platform"
+	PushTokenBuildNumColumnName  = "buildNum"
+	PushTokenUpdatedAtColumnName = "updatedAt"
+
+	PushTokenRegisteredEventType   = "AUTH_PUSH_TOKEN_REGISTERED"
+	PushTokenUnregisteredEventType = "AUTH_PUSH_TOKEN_UNREGISTERED"
+)
+
+type PushTokenRequest struct {
+	AccessToken string `json:"accessToken"`
+	PushToken   string `json:"pushToken" sanitize:"line" validate:"min=1,max=4096"`
+}
+
+func (req PushTokenRequest) String() string {
+	req.AccessToken = MaskToken(req.AccessToken)
+	req.PushToken = MaskToken(req.PushToken)
+	return fmt.Sprintf("%#v", req)
+}
+
+//PushTokenEvent is sent into the common stream, so the push service knows where to deliver pushes
+type PushTokenEvent struct {
+	UserId    string `json:"userId"`
+	SourceIp  string `json:"sourceIp"`
+	PushToken string `json:"pushToken"`
+	Platform  string `json:"platform"`
+	BuildNum  int    `json:"buildNum"`
+	UnixTime  int64  `json:"unixTime"`
+	EventType string `json:"eventType"`
+}
+
+func (event PushTokenEvent) String() string {
+	event.PushToken = MaskToken(event.PushToken)
+	return fmt.Sprintf("%#v", event)
+}
+
+func NewPushTokenRegisteredEvent(userId, sourceIp, pushToken, platform string, buildNum int) PushTokenEvent {
+	return PushTokenEvent{
+		UserId:    userId,
+		SourceIp:  sourceIp,
+		PushToken: pushToken,
+		Platform:  platform,
+		BuildNum:  buildNum,
+		UnixTime:  time.Now().Unix(),
+		EventType: PushTokenRegisteredEventType,
+	}
+}
+
+func NewPushTokenUnregisteredEvent(userId, sourceIp, pushToken string) PushTokenEvent {
+	return PushTokenEvent{
+		UserId:    userId,
+		SourceIp:  sourceIp,
+		PushToken: pushToken,
+		UnixTime:  time.Now().Unix(),
+		EventType: PushTokenUnregisteredEventType,
+	}
+}
+
+//SendPushTokenUnregisteredEvent is sent after the token was deleted with the session (DeleteAllPushTokens),
+//nothing is sent when there was no token. Return error if something went wrong
+func SendPushTokenUnregisteredEvent(ctx context.Context, userId, sourceIp, pushToken, commonStreamName string,
+	awsKinesisClient *kinesis.Kinesis, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) *AuthError {
+	if pushToken == "" {
+		return nil
+	}
+	event := NewPushTokenUnregisteredEvent(userId, sourceIp, pushToken)
+	partitionKey := userId
+	ok, errStr := commons.SendCommonEvent(TracedEvent(ctx, event), userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
+	if !ok {
+		return FromErrorString(errStr)
+	}
+	return nil
+}
+
+//return error if something went wrong
+func SavePushToken(userId, pushToken, platform string, buildNum int, tableName string, awsDbClient *dynamodb.DynamoDB,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) *AuthError {
+
+	anlogger.Debugf(lc, "push_tokens.go : save push token [%s] for userId [%s]", MaskToken(pushToken), userId)
+
+	input := &dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+			PushTokenColumnName: {
+				S: aws.String(pushToken),
+			},
+			PushTokenPlatformColumnName: {
+				S: aws.String(platform),
+			},
+			PushTokenBuildNumColumnName: {
+				N: aws.String(fmt.Sprintf("%d", buildNum)),
+			},
+			PushTokenUpdatedAtColumnName: {
+				S: aws.String(time.Now().UTC().Format("2006-01-02-15-04-05.000")),
+			},
+		},
+		TableName: aws.String(tableName),
+	}
+
+	_, err := awsDbClient.PutItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "push_tokens.go : error save push token for userId [%s] : %v", userId, err)
+		return ErrInternalServer.Wrap(err)
+	}
+
+	anlogger.Infof(lc, "push_tokens.go : successfully save push token [%s] for userId [%s]", MaskToken(pushToken), userId)
+	return nil
+}
+
+//DeletePushToken deletes the token only if it's still the current token of the user,
+//return true if the token was deleted and error if something went wrong
+func DeletePushToken(userId, pushToken, tableName string, awsDbClient *dynamodb.DynamoDB,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (bool, *AuthError) {
+
+	anlogger.Debugf(lc, "push_tokens.go : delete push token [%s] for userId [%s]", MaskToken(pushToken), userId)
+
+	input := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#pushToken": aws.String(PushTokenColumnName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pushTokenV": {
+				S: aws.String(pushToken),
+			},
+		},
+		ConditionExpression: aws.String("#pushToken = :pushTokenV"),
+		TableName:           aws.String(tableName),
+	}
+
+	_, err := awsDbClient.DeleteItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			anlogger.Warnf(lc, "push_tokens.go : push token [%s] is not registered for userId [%s]", MaskToken(pushToken), userId)
+			return false, nil
+		}
+		anlogger.Errorf(lc, "push_tokens.go : error delete push token for userId [%s] : %v", userId, err)
+		return false, ErrInternalServer.Wrap(err)
+	}
+
+	anlogger.Infof(lc, "push_tokens.go : successfully delete push token [%s] for userId [%s]", MaskToken(pushToken), userId)
+	return true, nil
+}
+
+//DeleteAllPushTokens is called when the session of the user is finished (logout, delete),
+//return deleted token (empty string if there was no one) and error if something went wrong
+func DeleteAllPushTokens(userId, tableName string, awsDbClient dynamodbiface.DynamoDBAPI,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (string, *AuthError) {
+
+	anlogger.Debugf(lc, "push_tokens.go : delete push tokens for userId [%s]", userId)
+
+	input := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:    aws.String(tableName),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	}
+
+	output, err := awsDbClient.DeleteItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "push_tokens.go : error delete push tokens for userId [%s] : %v", userId, err)
+		return "", ErrInternalServer.Wrap(err)
+	}
+
+	pushToken := ""
+	if value, ok := output.Attributes[PushTokenColumnName]; ok && value.S != nil {
+		pushToken = *value.S
+	}
+
+	anlogger.Infof(lc, "push_tokens.go : successfully delete push token [%s] for userId [%s]", MaskToken(pushToken), userId)
+	return pushToken, nil
+}
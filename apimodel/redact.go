@@ -0,0 +1,55 @@
+package apimodel
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const redacted = "***"
+
+var (
+	emailRegexp = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	//"accessToken":"value" (json), accessToken:value (map), AccessToken:"value" (%#v of the struct),
+	//key names are matched as whole words, so pinned or spinCount are not masked
+	secretRegexp = regexp.MustCompile(`(?i)("?\b(?:accessToken|sessionToken|authSessionId|privateKey|pushToken|pinCode|pin)\b"?\s*:\s*"?)([^"\s,}\]]+)`)
+)
+
+//MaskEmail keeps the first letter and the domain, so support still could find the user
+//by the logs without having the full address there
+func MaskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return MaskToken(email)
+	}
+	if at == 0 {
+		return redacted + email[at:]
+	}
+	return email[:1] + redacted + email[at:]
+}
+
+//MaskToken keeps only a few first symbols of tokens and keys, short values are masked completely
+func MaskToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	if len(token) <= 8 {
+		return redacted
+	}
+	return token[:4] + redacted
+}
+
+//Scrub masks emails and known secret fields in the free form log message, use it when the message
+//contains request bodies or other data which we don't control
+func Scrub(message string) string {
+	message = secretRegexp.ReplaceAllStringFunc(message, func(match string) string {
+		parts := secretRegexp.FindStringSubmatch(match)
+		return parts[1] + MaskToken(parts[2])
+	})
+	return emailRegexp.ReplaceAllStringFunc(message, MaskEmail)
+}
+
+//Scrubf formats the message and scrubs the result
+func Scrubf(format string, args ...interface{}) string {
+	return Scrub(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,115 @@
+package apimodel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaskToken(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"", ""},
+		{"short", "***"},
+		{"12345678", "***"},
+		{"123456789", "1234***"},
+		{"eyJhbGciOiJIUzI1NiJ9.payload.signature", "eyJh***"},
+	}
+	for _, tt := range tests {
+		if got := MaskToken(tt.token); got != tt.want {
+			t.Errorf("MaskToken(%q) = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"john.smith@example.com", "j***@example.com"},
+		{"a@example.com", "a***@example.com"},
+		{"@example.com", "***@example.com"},
+		{"weird@name@example.com", "w***@example.com"},
+		{"not-an-email-at-all", "not-***"},
+	}
+	for _, tt := range tests {
+		if got := MaskEmail(tt.email); got != tt.want {
+			t.Errorf("MaskEmail(%q) = %q, want %q", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{
+			name:    "json body",
+			message: `{"accessToken":"abcdefghijklmnop","pinCode":"1234","email":"john@example.com"}`,
+			want:    `{"accessToken":"abcd***","pinCode":"***","email":"j***@example.com"}`,
+		},
+		{
+			name:    "struct printed with %#v",
+			message: `apimodel.Req{AuthSessionId:"0123456789abcdef", PrivateKey:"private-key-value"}`,
+			want:    `apimodel.Req{AuthSessionId:"0123***", PrivateKey:"priv***"}`,
+		},
+		{
+			name:    "map",
+			message: `map[pin:4321 sessionToken:session-token-value]`,
+			want:    `map[pin:*** sessionToken:sess***]`,
+		},
+		{
+			name:    "keys which only contain secret names are kept",
+			message: `{"pinned":"true","spinCount":"12345","pushTokens":"3"}`,
+			want:    `{"pinned":"true","spinCount":"12345","pushTokens":"3"}`,
+		},
+		{
+			name:    "keys which end with secret names are kept",
+			message: `map[spin:5 skipPin:4321 userPushToken:abcdefghijk]`,
+			want:    `map[spin:5 skipPin:4321 userPushToken:abcdefghijk]`,
+		},
+		{
+			name:    "nothing to scrub",
+			message: `user [abc] was created`,
+			want:    `user [abc] was created`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Scrub(tt.message); got != tt.want {
+				t.Errorf("Scrub(%q) = %q, want %q", tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateReqStringMasksSecrets(t *testing.T) {
+	req := CreateReq{
+		Email:         "john.smith@example.com",
+		AuthSessionId: "auth-session-id-value",
+		PrivateKey:    "private-key-value",
+		Attribution: Attribution{
+			Source:          "facebook",
+			InstallReferrer: "utm_source=facebook&gclid=secret-click-id",
+			DeepLinkParams:  map[string]string{"token": "deep-link-token-value"},
+		},
+	}
+
+	got := req.String()
+	for _, secret := range []string{"john.smith", "auth-session-id-value", "private-key-value", "secret-click-id", "deep-link-token-value"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("CreateReq.String() = %s, contains %q", got, secret)
+		}
+	}
+	if !strings.Contains(got, "facebook") {
+		t.Errorf("CreateReq.String() = %s, source is masked", got)
+	}
+	if req.Attribution.DeepLinkParams["token"] != "deep-link-token-value" {
+		t.Errorf("CreateReq.String() changed the request")
+	}
+}
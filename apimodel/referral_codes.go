@@ -0,0 +1,193 @@
+package apimodel
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/ringoid/commons"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+//ReferralCodes table keeps issued codes, code could be issued to a user (shareable code of the user)
+//or to a campaign (marketing codes, usually with expiration time)
+const (
+	ReferralCodeColumnName          = "code"
+	ReferralCodeOwnerTypeColumnName = "ownerType"
+	ReferralCodeOwnerIdColumnName   = "ownerId"
+	ReferralCodeCreatedAtColumnName = "createdAt"
+	//unix time in seconds, 0 or no attribute means the code never expires
+	ReferralCodeExpiresAtColumnName = "expiresAt"
+
+	//UserProfile column with the code which was issued to the user
+	OwnReferralCodeColumnName = "ownReferralCode"
+
+	ReferralCodeOwnerUser     = "user"
+	ReferralCodeOwnerCampaign = "campaign"
+
+	//referral id of the user who joined without a code
+	NoReferralCode = "n/a"
+
+	generatedReferralCodeLength   = 8
+	generatedReferralCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+type ReferralCode struct {
+	Code      string
+	OwnerType string
+	OwnerId   string
+	ExpiresAt int64
+}
+
+func (code ReferralCode) String() string {
+	return fmt.Sprintf("%#v", code)
+}
+
+//Expired returns true if the code has expiration time which already passed
+func (code ReferralCode) Expired(now time.Time) bool {
+	return code.ExpiresAt > 0 && now.Unix() >= code.ExpiresAt
+}
+
+//NormalizeReferralCode returns the code in the form it's stored in the table
+func NormalizeReferralCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+//GenerateReferralCode returns random code without similar looking symbols
+func GenerateReferralCode() (string, error) {
+	max := big.NewInt(int64(len(generatedReferralCodeAlphabet)))
+	result := make([]byte, generatedReferralCodeLength)
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = generatedReferralCodeAlphabet[n.Int64()]
+	}
+	return string(result), nil
+}
+
+//CheckReferralCode returns the code if it exists and is not expired, ErrInvalidReferralCode otherwise,
+//userId is the user who uses the code (own codes are caught by CheckReferralFraud)
+func CheckReferralCode(code, userId, tableName string, awsDbClient *dynamodb.DynamoDB,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (*ReferralCode, *AuthError) {
+
+	anlogger.Debugf(lc, "referral_codes.go : check referral code [%s] for userId [%s]", code, userId)
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			ReferralCodeColumnName: {
+				S: aws.String(code),
+			},
+		},
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "referral_codes.go : error get referral code [%s] for userId [%s] : %v", code, userId, err)
+		return nil, ErrInternalServer.Wrap(err)
+	}
+
+	if len(result.Item) == 0 {
+		anlogger.Warnf(lc, "referral_codes.go : unknown referral code [%s] for userId [%s]", code, userId)
+		return nil, ErrInvalidReferralCode
+	}
+
+	referralCode := &ReferralCode{Code: code}
+	if value, ok := result.Item[ReferralCodeOwnerTypeColumnName]; ok && value.S != nil {
+		referralCode.OwnerType = *value.S
+	}
+	if value, ok := result.Item[ReferralCodeOwnerIdColumnName]; ok && value.S != nil {
+		referralCode.OwnerId = *value.S
+	}
+	if value, ok := result.Item[ReferralCodeExpiresAtColumnName]; ok && value.N != nil {
+		referralCode.ExpiresAt, err = strconv.ParseInt(*value.N, 10, 64)
+		if err != nil {
+			anlogger.Errorf(lc, "referral_codes.go : can not convert expiresAt [%s] of referral code [%s] : %v", *value.N, code, err)
+			return nil, ErrInternalServer.Wrap(err)
+		}
+	}
+
+	if referralCode.Expired(time.Now()) {
+		anlogger.Warnf(lc, "referral_codes.go : expired referral code %v for userId [%s]", referralCode, userId)
+		return nil, ErrInvalidReferralCode
+	}
+
+	anlogger.Debugf(lc, "referral_codes.go : successfully check referral code %v for userId [%s]", referralCode, userId)
+	return referralCode, nil
+}
+
+//IssueReferralCode stores new code, return false if such code already exists and error if something went wrong
+func IssueReferralCode(code ReferralCode, tableName string, awsDbClient *dynamodb.DynamoDB,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (bool, *AuthError) {
+
+	anlogger.Debugf(lc, "referral_codes.go : issue referral code %v", code)
+
+	item := map[string]*dynamodb.AttributeValue{
+		ReferralCodeColumnName: {
+			S: aws.String(code.Code),
+		},
+		ReferralCodeOwnerTypeColumnName: {
+			S: aws.String(code.OwnerType),
+		},
+		ReferralCodeOwnerIdColumnName: {
+			S: aws.String(code.OwnerId),
+		},
+		ReferralCodeCreatedAtColumnName: {
+			S: aws.String(time.Now().UTC().Format("2006-01-02-15-04-05.000")),
+		},
+	}
+	if code.ExpiresAt > 0 {
+		item[ReferralCodeExpiresAtColumnName] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(code.ExpiresAt, 10))}
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:                item,
+		ConditionExpression: aws.String(fmt.Sprintf("attribute_not_exists(%s)", ReferralCodeColumnName)),
+		TableName:           aws.String(tableName),
+	}
+
+	_, err := awsDbClient.PutItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			anlogger.Warnf(lc, "referral_codes.go : referral code [%s] already exists", code.Code)
+			return false, nil
+		}
+		anlogger.Errorf(lc, "referral_codes.go : error issue referral code %v : %v", code, err)
+		return false, ErrInternalServer.Wrap(err)
+	}
+
+	anlogger.Infof(lc, "referral_codes.go : successfully issue referral code %v", code)
+	return true, nil
+}
+
+//return error if something went wrong
+func DeleteReferralCode(code, tableName string, awsDbClient dynamodbiface.DynamoDBAPI,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) *AuthError {
+
+	input := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			ReferralCodeColumnName: {
+				S: aws.String(code),
+			},
+		},
+		TableName: aws.String(tableName),
+	}
+
+	_, err := awsDbClient.DeleteItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "referral_codes.go : error delete referral code [%s] : %v", code, err)
+		return ErrInternalServer.Wrap(err)
+	}
+
+	anlogger.Debugf(lc, "referral_codes.go : successfully delete referral code [%s]", code)
+	return nil
+}
@@ -0,0 +1,262 @@
+package apimodel
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+	"github.com/ringoid/commons"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	//UserProfile column with the source ip of the create request
+	SignupSourceIpColumnName = "signupSourceIp"
+
+	ReferralFraudModeFlag   = "flag"
+	ReferralFraudModeReject = "reject"
+
+	FraudReasonSelfReferral = "self_referral"
+	FraudReasonSameSourceIp = "same_source_ip"
+	FraudReasonSameDevice   = "same_device"
+	FraudReasonClaimsBurst  = "claims_burst"
+
+	ReferralStatusFlagged = "flagged"
+	//ReferralLedger column with the reasons why the referral was flagged
+	ReferralLedgerFraudReasonsColumnName = "fraudReasons"
+
+	ReferralFraudDetectedEventType = "AUTH_REFERRAL_FRAUD_DETECTED"
+)
+
+//ReferralFraudConfig is embedded into the config of the lambdas which accept referral codes.
+//In flag mode suspicious referral is accepted but not counted for rewards, in reject mode it fails.
+//Self referral is always rejected. 0 window or max disables the check.
+//Checks which need data of the referrer are skipped when there is no such data : source ip is compared only for
+//referrers who signed up after signupSourceIp column was added, device only for referrers with device columns.
+type ReferralFraudConfig struct {
+	ReferralFraudMode string `env:"REFERRAL_FRAUD_MODE" default:"flag" validate:"oneof=flag reject"`
+	//referee has the same device model and os as the referrer who was online during this window
+	ReferralFraudDeviceWindowMinutes int `env:"REFERRAL_FRAUD_DEVICE_WINDOW_MINUTES" default:"1440" validate:"min=0"`
+	//referrer has more than max referrals during this window
+	ReferralFraudBurstWindowMinutes int `env:"REFERRAL_FRAUD_BURST_WINDOW_MINUTES" default:"60" validate:"min=0"`
+	ReferralFraudBurstMax           int `env:"REFERRAL_FRAUD_BURST_MAX" default:"5" validate:"min=0"`
+}
+
+//Reject returns true if the referral with such reasons should fail
+func (cfg ReferralFraudConfig) Reject(reasons []string) bool {
+	for _, each := range reasons {
+		if each == FraudReasonSelfReferral {
+			return true
+		}
+	}
+	return len(reasons) != 0 && cfg.ReferralFraudMode == ReferralFraudModeReject
+}
+
+//ReferralParticipant is what we know about the referrer or the referee for the fraud checks
+type ReferralParticipant struct {
+	UserId   string
+	SourceIp string
+	//device model with os version, user could have android and iOS ones
+	Devices []string
+	//unix time in millis, 0 if unknown
+	LastOnlineTime int64
+}
+
+func ReferralDevice(deviceModel, osVersion string) string {
+	if deviceModel == "" || osVersion == "" || deviceModel == "n/a" {
+		return ""
+	}
+	return deviceModel + " " + osVersion
+}
+
+//LoadReferralParticipant reads the participant from the profile, source ip is the one of the signup (empty for old users),
+//return nil if there is no such user and error if something went wrong
+func LoadReferralParticipant(userId, userProfileTableName string, awsDbClient *dynamodb.DynamoDB,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (*ReferralParticipant, *AuthError) {
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:            aws.String(userProfileTableName),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#userId, #ip, #androidDevice, #androidOs, #iosDevice, #iosOs, #onlineTime"),
+		ExpressionAttributeNames: map[string]*string{
+			"#userId":        aws.String(commons.UserIdColumnName),
+			"#ip":            aws.String(SignupSourceIpColumnName),
+			"#androidDevice": aws.String(commons.AndroidDeviceModelColumnName),
+			"#androidOs":     aws.String(commons.AndroidOsVersionColumnName),
+			"#iosDevice":     aws.String(commons.IOSDeviceModelColumnName),
+			"#iosOs":         aws.String(commons.IOsVersionColumnName),
+			"#onlineTime":    aws.String(commons.LastOnlineTimeColumnName),
+		},
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "referral_fraud.go : error get referral participant userId [%s] : %v", userId, err)
+		return nil, ErrInternalServer.Wrap(err)
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+
+	value := func(column string) string {
+		if attr, ok := result.Item[column]; ok && attr.S != nil {
+			return *attr.S
+		}
+		return ""
+	}
+
+	participant := &ReferralParticipant{
+		UserId:   userId,
+		SourceIp: value(SignupSourceIpColumnName),
+	}
+	for _, device := range []string{
+		ReferralDevice(value(commons.AndroidDeviceModelColumnName), value(commons.AndroidOsVersionColumnName)),
+		ReferralDevice(value(commons.IOSDeviceModelColumnName), value(commons.IOsVersionColumnName)),
+	} {
+		if device != "" {
+			participant.Devices = append(participant.Devices, device)
+		}
+	}
+	if attr, ok := result.Item[commons.LastOnlineTimeColumnName]; ok && attr.N != nil {
+		participant.LastOnlineTime, _ = strconv.ParseInt(*attr.N, 10, 64)
+	}
+	return participant, nil
+}
+
+//CheckReferralFraud returns the reasons why the referral looks like a fraud (empty if it looks fine)
+//and error if something went wrong. Only codes of the users are checked.
+func CheckReferralFraud(code *ReferralCode, referee ReferralParticipant, cfg ReferralFraudConfig, ledgerTableName, userProfileTableName string,
+	awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) ([]string, *AuthError) {
+
+	reasons := make([]string, 0)
+	if code == nil || code.OwnerType != ReferralCodeOwnerUser {
+		return reasons, nil
+	}
+
+	if code.OwnerId == referee.UserId {
+		return append(reasons, FraudReasonSelfReferral), nil
+	}
+
+	referrer, authErr := LoadReferralParticipant(code.OwnerId, userProfileTableName, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+
+	if referrer != nil {
+		if referrer.SourceIp != "" && referrer.SourceIp == referee.SourceIp {
+			reasons = append(reasons, FraudReasonSameSourceIp)
+		}
+
+		window := time.Duration(cfg.ReferralFraudDeviceWindowMinutes) * time.Minute
+		onlineSince := time.Now().Add(-window).UnixNano() / int64(time.Millisecond)
+		if window > 0 && referrer.LastOnlineTime >= onlineSince && sameDevice(referrer.Devices, referee.Devices) {
+			reasons = append(reasons, FraudReasonSameDevice)
+		}
+	}
+
+	if cfg.ReferralFraudBurstWindowMinutes > 0 && cfg.ReferralFraudBurstMax > 0 {
+		since := time.Now().Add(-time.Duration(cfg.ReferralFraudBurstWindowMinutes) * time.Minute)
+		count, authErr := countReferralsSince(code.OwnerId, since, cfg.ReferralFraudBurstMax, ledgerTableName, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
+		}
+		if count >= cfg.ReferralFraudBurstMax {
+			reasons = append(reasons, FraudReasonClaimsBurst)
+		}
+	}
+
+	if len(reasons) != 0 {
+		anlogger.Warnf(lc, "referral_fraud.go : referral of userId [%s] by userId [%s] with code [%s] looks like a fraud, reasons %v",
+			referee.UserId, code.OwnerId, code.Code, reasons)
+	}
+	return reasons, nil
+}
+
+func sameDevice(first, second []string) bool {
+	for _, each := range first {
+		for _, other := range second {
+			if each == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//return number of the referrals of the referrer since the time (counting stops at max) and error if something went wrong
+func countReferralsSince(referrerId string, since time.Time, max int, ledgerTableName string, awsDbClient *dynamodb.DynamoDB,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (int, *AuthError) {
+
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#referrerId": aws.String(ReferralLedgerReferrerIdColumnName),
+			"#createdAt":  aws.String(ReferralLedgerCreatedAtColumnName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":referrerIdV": {
+				S: aws.String(referrerId),
+			},
+			":sinceV": {
+				N: aws.String(strconv.FormatInt(since.UnixNano()/int64(time.Millisecond), 10)),
+			},
+		},
+		KeyConditionExpression: aws.String("#referrerId = :referrerIdV"),
+		FilterExpression:       aws.String("#createdAt >= :sinceV"),
+		Select:                 aws.String(dynamodb.SelectCount),
+		TableName:              aws.String(ledgerTableName),
+	}
+
+	count := 0
+	for {
+		result, err := awsDbClient.Query(input)
+		if err != nil {
+			anlogger.Errorf(lc, "referral_fraud.go : error count referrals of userId [%s] : %v", referrerId, err)
+			return 0, ErrInternalServer.Wrap(err)
+		}
+		count += int(aws.Int64Value(result.Count))
+		if count >= max || len(result.LastEvaluatedKey) == 0 {
+			return count, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+//ReferralFraudDetectedEvent is sent into analytics when the referral was flagged or rejected
+type ReferralFraudDetectedEvent struct {
+	UserId       string   `json:"userId"`
+	ReferrerId   string   `json:"referrerId"`
+	ReferralCode string   `json:"referralCode"`
+	SourceIp     string   `json:"sourceIp"`
+	Reasons      []string `json:"reasons"`
+	//flagged or rejected
+	Action    string `json:"action"`
+	UnixTime  int64  `json:"unixTime"`
+	EventType string `json:"eventType"`
+}
+
+func (event ReferralFraudDetectedEvent) String() string {
+	return fmt.Sprintf("%#v", event)
+}
+
+func NewReferralFraudDetectedEvent(userId, sourceIp string, code *ReferralCode, reasons []string, rejected bool) ReferralFraudDetectedEvent {
+	action := ReferralStatusFlagged
+	if rejected {
+		action = "rejected"
+	}
+	return ReferralFraudDetectedEvent{
+		UserId:       userId,
+		ReferrerId:   code.OwnerId,
+		ReferralCode: code.Code,
+		SourceIp:     sourceIp,
+		Reasons:      reasons,
+		Action:       action,
+		UnixTime:     time.Now().Unix(),
+		EventType:    ReferralFraudDetectedEventType,
+	}
+}
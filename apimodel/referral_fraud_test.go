@@ -0,0 +1,102 @@
+package apimodel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReferralFraudConfigReject(t *testing.T) {
+	flag := ReferralFraudConfig{ReferralFraudMode: ReferralFraudModeFlag}
+	reject := ReferralFraudConfig{ReferralFraudMode: ReferralFraudModeReject}
+
+	tests := []struct {
+		name    string
+		cfg     ReferralFraudConfig
+		reasons []string
+		want    bool
+	}{
+		{"flag mode without reasons", flag, nil, false},
+		{"reject mode without reasons", reject, []string{}, false},
+		{"flag mode accepts", flag, []string{FraudReasonSameSourceIp, FraudReasonClaimsBurst}, false},
+		{"reject mode rejects", reject, []string{FraudReasonSameDevice}, true},
+		{"self referral in flag mode", flag, []string{FraudReasonSelfReferral}, true},
+		{"self referral with other reasons", flag, []string{FraudReasonSameDevice, FraudReasonSelfReferral}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.Reject(tt.reasons); got != tt.want {
+				t.Errorf("Reject(%v) = %v, want %v", tt.reasons, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReferralDevice(t *testing.T) {
+	tests := []struct {
+		deviceModel string
+		osVersion   string
+		want        string
+	}{
+		{"Pixel 3", "28", "Pixel 3 28"},
+		{"iPhone10,3", "12.1", "iPhone10,3 12.1"},
+		{"", "28", ""},
+		{"Pixel 3", "", ""},
+		{"n/a", "28", ""},
+	}
+	for _, tt := range tests {
+		if got := ReferralDevice(tt.deviceModel, tt.osVersion); got != tt.want {
+			t.Errorf("ReferralDevice(%q, %q) = %q, want %q", tt.deviceModel, tt.osVersion, got, tt.want)
+		}
+	}
+}
+
+func TestSameDevice(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  []string
+		second []string
+		want   bool
+	}{
+		{"no devices", nil, nil, false},
+		{"referrer without devices", nil, []string{"Pixel 3 28"}, false},
+		{"different devices", []string{"Pixel 3 28"}, []string{"Pixel 3 29", "iPhone10,3 12.1"}, false},
+		{"one of the devices", []string{"Pixel 3 28", "iPhone10,3 12.1"}, []string{"iPhone10,3 12.1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameDevice(tt.first, tt.second); got != tt.want {
+				t.Errorf("sameDevice(%v, %v) = %v, want %v", tt.first, tt.second, got, tt.want)
+			}
+		})
+	}
+}
+
+//cases which are decided before the referrer is read
+func TestCheckReferralFraudWithoutReferrer(t *testing.T) {
+	cfg := ReferralFraudConfig{ReferralFraudMode: ReferralFraudModeFlag}
+	referee := ReferralParticipant{UserId: "referee", SourceIp: "10.0.0.1"}
+
+	tests := []struct {
+		name string
+		code *ReferralCode
+		want []string
+	}{
+		{"no code", nil, []string{}},
+		{"campaign code", &ReferralCode{Code: "SUMMER", OwnerType: ReferralCodeOwnerCampaign, OwnerId: "referee"}, []string{}},
+		{"self referral", &ReferralCode{Code: "ABC123", OwnerType: ReferralCodeOwnerUser, OwnerId: "referee"},
+			[]string{FraudReasonSelfReferral}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CheckReferralFraud(tt.code, referee, cfg, "ledger", "profiles", nil, nil, nil)
+			if err != nil {
+				t.Fatalf("CheckReferralFraud() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CheckReferralFraud() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package apimodel
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/ringoid/commons"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"../metrics"
+)
+
+//ReferralLedger table keeps who referred whom : hash key is the referrer (owner of the code),
+//range key is the referee (user who joined or claimed with the code), so one referee is counted only once
+const (
+	ReferralLedgerReferrerIdColumnName = "referrer_id"
+	ReferralLedgerRefereeIdColumnName  = "referee_id"
+	ReferralLedgerCodeColumnName       = "code"
+	//unix time in millis
+	ReferralLedgerCreatedAtColumnName = "createdAt"
+	ReferralLedgerStatusColumnName    = "status"
+	//name of the reward which this referral earned to the referrer
+	ReferralLedgerRewardColumnName = "reward"
+
+	ReferralStatusJoined   = "joined"
+	ReferralStatusRewarded = "rewarded"
+
+	//UserProfile column with the number of users who joined with the code of the user
+	ReferralsCountColumnName = "referralsCount"
+
+	ReferralRewardEarnedEventType = "AUTH_REFERRAL_REWARD_EARNED"
+
+	//how many times the referral is recorded when the counter of the referrer is changed concurrently
+	maxRecordReferralAttempts = 5
+)
+
+//ReferralRewardRule gives the reward to the referrer when the number of the referrals reaches the threshold
+type ReferralRewardRule struct {
+	Threshold int    `json:"threshold"`
+	Reward    string `json:"reward"`
+}
+
+//ParseReferralRewardRules parses rules from the string like "3:premium_week,10:premium_month",
+//empty string means there are no rewards. Result is sorted by threshold.
+func ParseReferralRewardRules(value string) ([]ReferralRewardRule, error) {
+	rules := make([]ReferralRewardRule, 0)
+	thresholds := make(map[int]bool)
+	for _, each := range strings.Split(value, ",") {
+		each = strings.TrimSpace(each)
+		if each == "" {
+			continue
+		}
+		parts := strings.SplitN(each, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("wrong reward rule [%s], expected threshold:reward", each)
+		}
+		threshold, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("wrong threshold in reward rule [%s], expected positive number", each)
+		}
+		if thresholds[threshold] {
+			return nil, fmt.Errorf("duplicate threshold in reward rule [%s]", each)
+		}
+		thresholds[threshold] = true
+		rules = append(rules, ReferralRewardRule{Threshold: threshold, Reward: strings.TrimSpace(parts[1])})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Threshold < rules[j].Threshold })
+	return rules, nil
+}
+
+//ReferralRewardEarnedEvent is sent when the referrer reaches one of the thresholds
+type ReferralRewardEarnedEvent struct {
+	UserId         string `json:"userId"`
+	RefereeId      string `json:"refereeId"`
+	ReferralCode   string `json:"referralCode"`
+	Reward         string `json:"reward"`
+	Threshold      int    `json:"threshold"`
+	ReferralsCount int    `json:"referralsCount"`
+	UnixTime       int64  `json:"unixTime"`
+	EventType      string `json:"eventType"`
+}
+
+func (event ReferralRewardEarnedEvent) String() string {
+	return fmt.Sprintf("%#v", event)
+}
+
+func NewReferralRewardEarnedEvent(userId, refereeId, code string, rule ReferralRewardRule, referralsCount int) ReferralRewardEarnedEvent {
+	return ReferralRewardEarnedEvent{
+		UserId:         userId,
+		RefereeId:      refereeId,
+		ReferralCode:   code,
+		Reward:         rule.Reward,
+		Threshold:      rule.Threshold,
+		ReferralsCount: referralsCount,
+		UnixTime:       time.Now().Unix(),
+		EventType:      ReferralRewardEarnedEventType,
+	}
+}
+
+//RecordReferral writes the referral into the ledger and increments the counter of the referrer in one transaction.
+//Only codes of the users are recorded (campaigns have no referrer), referral with fraud reasons
+//is recorded as flagged and is not counted. Return event if the referrer reached the threshold
+//of one of the rules (nil otherwise) and error if something went wrong.
+func RecordReferral(code *ReferralCode, refereeId string, fraudReasons []string, ledgerTableName, userProfileTableName string, rules []ReferralRewardRule,
+	awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (*ReferralRewardEarnedEvent, *AuthError) {
+
+	if code == nil || code.OwnerType != ReferralCodeOwnerUser {
+		return nil, nil
+	}
+	referrerId := code.OwnerId
+
+	anlogger.Debugf(lc, "referral_ledger.go : record referral of userId [%s] by userId [%s] with code [%s]", refereeId, referrerId, code.Code)
+
+	item := map[string]*dynamodb.AttributeValue{
+		ReferralLedgerReferrerIdColumnName: {
+			S: aws.String(referrerId),
+		},
+		ReferralLedgerRefereeIdColumnName: {
+			S: aws.String(refereeId),
+		},
+		ReferralLedgerCodeColumnName: {
+			S: aws.String(code.Code),
+		},
+		ReferralLedgerCreatedAtColumnName: {
+			N: aws.String(strconv.FormatInt(commons.UnixTimeInMillis(), 10)),
+		},
+		ReferralLedgerStatusColumnName: {
+			S: aws.String(ReferralStatusJoined),
+		},
+	}
+
+	if len(fraudReasons) != 0 {
+		item[ReferralLedgerStatusColumnName] = &dynamodb.AttributeValue{S: aws.String(ReferralStatusFlagged)}
+		item[ReferralLedgerFraudReasonsColumnName] = &dynamodb.AttributeValue{SS: aws.StringSlice(fraudReasons)}
+		return nil, recordFlaggedReferral(item, referrerId, refereeId, fraudReasons, ledgerTableName, awsDbClient, anlogger, lc)
+	}
+
+	//counter is updated only if nobody changed it after we read it, so the new count is exact
+	//and every threshold is reached only once
+	for attempt := 1; ; attempt++ {
+		count, ok, authErr := getReferralsCount(referrerId, userProfileTableName, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
+		}
+		if !ok {
+			anlogger.Warnf(lc, "referral_ledger.go : referrer userId [%s] doesn't exist, skip referral of userId [%s]", referrerId, refereeId)
+			return nil, nil
+		}
+
+		newCount := count + 1
+		item[ReferralLedgerStatusColumnName] = &dynamodb.AttributeValue{S: aws.String(ReferralStatusJoined)}
+		delete(item, ReferralLedgerRewardColumnName)
+		var rewardRule *ReferralRewardRule
+		for i := range rules {
+			if rules[i].Threshold == newCount {
+				rewardRule = &rules[i]
+				item[ReferralLedgerStatusColumnName] = &dynamodb.AttributeValue{S: aws.String(ReferralStatusRewarded)}
+				item[ReferralLedgerRewardColumnName] = &dynamodb.AttributeValue{S: aws.String(rewardRule.Reward)}
+				break
+			}
+		}
+
+		recorded, countChanged, authErr := recordCountedReferral(item, referrerId, refereeId, count, ledgerTableName, userProfileTableName,
+			awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
+		}
+		if countChanged {
+			if attempt >= maxRecordReferralAttempts {
+				anlogger.Errorf(lc, "referral_ledger.go : referrals count of userId [%s] keeps changing, referral of userId [%s] is not recorded after [%d] attempts",
+					referrerId, refereeId, attempt)
+				return nil, ErrInternalServer
+			}
+			anlogger.Debugf(lc, "referral_ledger.go : referrals count of userId [%s] was changed, attempt [%d]", referrerId, attempt)
+			continue
+		}
+		if !recorded {
+			return nil, nil
+		}
+
+		anlogger.Infof(lc, "referral_ledger.go : successfully record referral of userId [%s] by userId [%s], referrals count [%d]",
+			refereeId, referrerId, newCount)
+		if rewardRule == nil {
+			return nil, nil
+		}
+		event := NewReferralRewardEarnedEvent(referrerId, refereeId, code.Code, *rewardRule, newCount)
+		anlogger.Infof(lc, "referral_ledger.go : userId [%s] earned reward %v", referrerId, event)
+		return &event, nil
+	}
+}
+
+//RecordReferralAfterCommit records the referral (see RecordReferral) and sends the reward event after the account
+//or the claim is committed. Failures are logged and counted in error metric only : the request already succeeded,
+//retry of create would make one more account and retry of claim would be rejected as already claimed.
+func RecordReferralAfterCommit(ctx context.Context, code *ReferralCode, refereeId string, fraudReasons []string,
+	ledgerTableName, userProfileTableName string, rules []ReferralRewardRule, deliveryStreamName, commonStreamName string,
+	awsDbClient *dynamodb.DynamoDB, awsDeliveryStreamClient *firehose.Firehose, awsKinesisClient *kinesis.Kinesis,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) {
+
+	rewardEvent, authErr := RecordReferral(code, refereeId, fraudReasons, ledgerTableName, userProfileTableName, rules, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		anlogger.Errorf(lc, "referral_ledger.go : referral of userId [%s] with code [%s] was not recorded : %v", refereeId, code.Code, authErr)
+		metrics.Count(metrics.ErrorMetricName, metrics.Dimensions{metrics.ErrorCodeDimension: authErr.Code})
+		return
+	}
+	if rewardEvent == nil {
+		return
+	}
+
+	commons.SendAnalyticEvent(*rewardEvent, rewardEvent.UserId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
+	ok, errStr := commons.SendCommonEvent(TracedEvent(ctx, *rewardEvent), rewardEvent.UserId, commonStreamName, rewardEvent.UserId, awsKinesisClient, anlogger, lc)
+	if !ok {
+		authErr = FromErrorString(errStr)
+		anlogger.Errorf(lc, "referral_ledger.go : reward event %v was not sent : %v", *rewardEvent, authErr)
+		metrics.Count(metrics.ErrorMetricName, metrics.Dimensions{metrics.ErrorCodeDimension: authErr.Code})
+	}
+}
+
+//return error if something went wrong (already recorded referral is not an error)
+func recordFlaggedReferral(item map[string]*dynamodb.AttributeValue, referrerId, refereeId string, fraudReasons []string, ledgerTableName string,
+	awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) *AuthError {
+
+	input := &dynamodb.PutItemInput{
+		Item:                item,
+		ConditionExpression: aws.String(fmt.Sprintf("attribute_not_exists(%s)", ReferralLedgerRefereeIdColumnName)),
+		TableName:           aws.String(ledgerTableName),
+	}
+
+	_, err := awsDbClient.PutItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			anlogger.Warnf(lc, "referral_ledger.go : referral of userId [%s] by userId [%s] is already recorded", refereeId, referrerId)
+			return nil
+		}
+		anlogger.Errorf(lc, "referral_ledger.go : error record referral of userId [%s] by userId [%s] : %v", refereeId, referrerId, err)
+		return ErrInternalServer.Wrap(err)
+	}
+
+	anlogger.Infof(lc, "referral_ledger.go : successfully record flagged referral of userId [%s] by userId [%s], reasons %v",
+		refereeId, referrerId, fraudReasons)
+	return nil
+}
+
+//writes the ledger row and sets the counter to count+1 in one transaction,
+//return false if the referral is already recorded, true if the counter (or the referrer) was changed after it was read
+//and error if something went wrong
+func recordCountedReferral(item map[string]*dynamodb.AttributeValue, referrerId, refereeId string, count int, ledgerTableName, userProfileTableName string,
+	awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (bool, bool, *AuthError) {
+
+	countCondition := "#referralsCount = :countV"
+	if count == 0 {
+		countCondition = "(attribute_not_exists(#referralsCount) OR #referralsCount = :countV)"
+	}
+
+	input := &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Put: &dynamodb.Put{
+					Item:                item,
+					ConditionExpression: aws.String(fmt.Sprintf("attribute_not_exists(%s)", ReferralLedgerRefereeIdColumnName)),
+					TableName:           aws.String(ledgerTableName),
+				},
+			},
+			{
+				Update: &dynamodb.Update{
+					ExpressionAttributeNames: map[string]*string{
+						"#userId":         aws.String(commons.UserIdColumnName),
+						"#referralsCount": aws.String(ReferralsCountColumnName),
+					},
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":countV": {
+							N: aws.String(strconv.Itoa(count)),
+						},
+						":newCountV": {
+							N: aws.String(strconv.Itoa(count + 1)),
+						},
+					},
+					Key: map[string]*dynamodb.AttributeValue{
+						commons.UserIdColumnName: {
+							S: aws.String(referrerId),
+						},
+					},
+					ConditionExpression: aws.String("attribute_exists(#userId) AND " + countCondition),
+					TableName:           aws.String(userProfileTableName),
+					UpdateExpression:    aws.String("SET #referralsCount = :newCountV"),
+				},
+			},
+		},
+	}
+
+	_, err := awsDbClient.TransactWriteItems(input)
+	if err != nil {
+		if terr, ok := err.(*dynamodb.TransactionCanceledException); ok && len(terr.CancellationReasons) == 2 {
+			if aws.StringValue(terr.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+				anlogger.Warnf(lc, "referral_ledger.go : referral of userId [%s] by userId [%s] is already recorded", refereeId, referrerId)
+				return false, false, nil
+			}
+			switch aws.StringValue(terr.CancellationReasons[1].Code) {
+			case "ConditionalCheckFailed", "TransactionConflict":
+				return false, true, nil
+			}
+		}
+		anlogger.Errorf(lc, "referral_ledger.go : error record referral of userId [%s] by userId [%s] : %v", refereeId, referrerId, err)
+		return false, false, ErrInternalServer.Wrap(err)
+	}
+	return true, false, nil
+}
+
+//return current count, false if the referrer doesn't exist anymore and error if something went wrong
+func getReferralsCount(userId, userProfileTableName string, awsDbClient *dynamodb.DynamoDB,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (int, bool, *AuthError) {
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:            aws.String(userProfileTableName),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#userId, #referralsCount"),
+		ExpressionAttributeNames: map[string]*string{
+			"#userId":         aws.String(commons.UserIdColumnName),
+			"#referralsCount": aws.String(ReferralsCountColumnName),
+		},
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "referral_ledger.go : error get referrals count for userId [%s] : %v", userId, err)
+		return 0, false, ErrInternalServer.Wrap(err)
+	}
+	if len(result.Item) == 0 {
+		return 0, false, nil
+	}
+
+	count := 0
+	if value, ok := result.Item[ReferralsCountColumnName]; ok && value.N != nil {
+		count, err = strconv.Atoi(*value.N)
+		if err != nil {
+			anlogger.Errorf(lc, "referral_ledger.go : can not convert referrals count [%s] for userId [%s] : %v", *value.N, userId, err)
+			return 0, false, ErrInternalServer.Wrap(err)
+		}
+	}
+	return count, true, nil
+}
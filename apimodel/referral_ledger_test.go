@@ -0,0 +1,41 @@
+package apimodel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReferralRewardRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []ReferralRewardRule
+		wantErr bool
+	}{
+		{name: "no rewards", value: "", want: []ReferralRewardRule{}},
+		{name: "only separators", value: " , ,", want: []ReferralRewardRule{}},
+		{
+			name:  "sorted by threshold",
+			value: "10:premium_month, 3 : premium_week ,",
+			want:  []ReferralRewardRule{{Threshold: 3, Reward: "premium_week"}, {Threshold: 10, Reward: "premium_month"}},
+		},
+		{name: "no reward", value: "3:", wantErr: true},
+		{name: "no separator", value: "premium_week", wantErr: true},
+		{name: "not a number", value: "three:premium_week", wantErr: true},
+		{name: "zero threshold", value: "0:premium_week", wantErr: true},
+		{name: "negative threshold", value: "-1:premium_week", wantErr: true},
+		{name: "duplicate threshold", value: "3:premium_week,3:premium_month", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReferralRewardRules(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseReferralRewardRules(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseReferralRewardRules(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
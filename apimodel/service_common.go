@@ -6,31 +6,83 @@ import (
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/satori/go.uuid"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"fmt"
 )
 
-//return ok and error string
-func DeleteUserFromAuthService(userId, userProfileTableName, userSettingsTableName string, awsDbClient *dynamodb.DynamoDB,
-	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (bool, string) {
+//UserProfile column with unix time in millis when the user who takes part in report requested the deletion,
+//such user is only hidden and the deletion is completed when the report is resolved
+const DeletionRequestedColumnName = "deletionRequestedAt"
 
-	anlogger.Debugf(lc, "service_common.go : delete user from the service (%s and %s) tables, userId [%s]",
-		userProfileTableName, userSettingsTableName, userId)
+//return deleted push token (empty string if there was no one, the caller sends the unregistered event)
+//and error if something went wrong
+func DeleteUserFromAuthService(userId, userProfileTableName, userSettingsTableName, pushTokensTableName, referralCodesTableName string,
+	awsDbClient dynamodbiface.DynamoDBAPI, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (string, *AuthError) {
 
-	if ok, errStr := deleteFromTable(userId, userProfileTableName, awsDbClient, anlogger, lc); !ok {
-		return ok, errStr
+	anlogger.Debugf(lc, "service_common.go : delete user from the service (%s, %s, %s and %s) tables, userId [%s]",
+		userProfileTableName, userSettingsTableName, pushTokensTableName, referralCodesTableName, userId)
+
+	//code goes first, it's found by the profile
+	code, authErr := ownReferralCode(userId, userProfileTableName, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return "", authErr
+	}
+	if code != "" {
+		if authErr = DeleteReferralCode(code, referralCodesTableName, awsDbClient, anlogger, lc); authErr != nil {
+			return "", authErr
+		}
+	}
+
+	if authErr := deleteFromTable(userId, userProfileTableName, awsDbClient, anlogger, lc); authErr != nil {
+		return "", authErr
+	}
+
+	if authErr := deleteFromTable(userId, userSettingsTableName, awsDbClient, anlogger, lc); authErr != nil {
+		return "", authErr
 	}
 
-	if ok, errStr := deleteFromTable(userId, userSettingsTableName, awsDbClient, anlogger, lc); !ok {
-		return ok, errStr
+	pushToken, authErr := DeleteAllPushTokens(userId, pushTokensTableName, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return "", authErr
 	}
 
 	anlogger.Infof(lc, "service_common.go : successfully delete user from the service, userId [%s]", userId)
 
-	return true, ""
+	return pushToken, nil
+}
+
+//return own referral code of the user (empty if there is none) and error if something went wrong
+func ownReferralCode(userId, userProfileTableName string, awsDbClient dynamodbiface.DynamoDBAPI,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (string, *AuthError) {
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:            aws.String(userProfileTableName),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#code"),
+		ExpressionAttributeNames: map[string]*string{
+			"#code": aws.String(OwnReferralCodeColumnName),
+		},
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "service_common.go : error get own referral code of userId [%s] : %v", userId, err)
+		return "", ErrInternalServer.Wrap(err)
+	}
+	if value, ok := result.Item[OwnReferralCodeColumnName]; ok && value.S != nil {
+		return *value.S, nil
+	}
+	return "", nil
 }
 
-func deleteFromTable(userId, tableName string, awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (bool, string) {
+func deleteFromTable(userId, tableName string, awsDbClient dynamodbiface.DynamoDBAPI, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) *AuthError {
 	deleteInput := &dynamodb.DeleteItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			commons.UserIdColumnName: {
@@ -41,20 +93,55 @@ func deleteFromTable(userId, tableName string, awsDbClient *dynamodb.DynamoDB, a
 	}
 	_, err := awsDbClient.DeleteItem(deleteInput)
 	if err != nil {
-		anlogger.Errorf(lc, "service_common.go : error delete user from table [%s], userId [%s]", tableName, userId)
-		return false, commons.InternalServerError
+		anlogger.Errorf(lc, "service_common.go : error delete user from table [%s], userId [%s] : %v", tableName, userId, err)
+		return ErrInternalServer.Wrap(err)
 	}
-	return true, ""
+	return nil
+}
+
+//return error if something went wrong
+func MarkDeletionRequested(userId, tableName string, awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) *AuthError {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#deletionRequested": aws.String(DeletionRequestedColumnName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":deletionRequestedV": {
+				N: aws.String(fmt.Sprintf("%v", commons.UnixTimeInMillis())),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		ConditionExpression: aws.String(fmt.Sprintf("attribute_exists(%v)", commons.UserIdColumnName)),
+		TableName:           aws.String(tableName),
+		UpdateExpression:    aws.String("SET #deletionRequested = :deletionRequestedV"),
+	}
+
+	_, err := awsDbClient.UpdateItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			anlogger.Warnf(lc, "service_common.go : user with userId [%s] doesn't exist, nothing to mark", userId)
+			return nil
+		}
+		anlogger.Errorf(lc, "service_common.go : error mark deletion requested for userId [%s] : %v", userId, err)
+		return ErrInternalServer.Wrap(err)
+	}
+
+	anlogger.Infof(lc, "service_common.go : successfully mark deletion requested for userId [%s]", userId)
+	return nil
 }
 
-//return ok, errorString if not ok
-func DisableCurrentAccessToken(userId, tableName string, awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (bool, string) {
+//return error if something went wrong
+func DisableCurrentAccessToken(userId, tableName string, awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) *AuthError {
 	anlogger.Debugf(lc, "service_common.go : disable current access token for userId [%s]", userId)
 
 	newSessionToken, err := uuid.NewV4()
 	if err != nil {
 		anlogger.Errorf(lc, "service_common.go : error while generate new sessionToken for userId [%s] : %v", userId, err)
-		return false, commons.InternalServerError
+		return ErrInternalServer.Wrap(err)
 	}
 
 	input := &dynamodb.UpdateItemInput{
@@ -87,16 +174,20 @@ func DisableCurrentAccessToken(userId, tableName string, awsDbClient *dynamodb.D
 	_, err = awsDbClient.UpdateItem(input)
 
 	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			anlogger.Warnf(lc, "service_common.go : user with userId [%s] doesn't exist, nothing to disable", userId)
+			return nil
+		}
 		anlogger.Errorf(lc, "service_common.go : error disable current access token for userId [%s] : %v", userId, err)
-		return false, commons.InternalServerError
+		return ErrInternalServer.Wrap(err)
 	}
 
 	anlogger.Infof(lc, "service_common.go : successfully disable current access token for userId [%s]", userId)
-	return true, ""
+	return nil
 }
 
-//return ok, errorString if not ok
-func SwithCurrentAccessToken(userId, newSessionToken, tableName string, awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) (bool, string) {
+//return error if something went wrong
+func SwithCurrentAccessToken(userId, newSessionToken, tableName string, awsDbClient *dynamodb.DynamoDB, anlogger *commons.Logger, lc *lambdacontext.LambdaContext) *AuthError {
 	anlogger.Debugf(lc, "service_common.go : switch current access token for userId [%s]", userId)
 
 	input := &dynamodb.UpdateItemInput{
@@ -126,9 +217,9 @@ func SwithCurrentAccessToken(userId, newSessionToken, tableName string, awsDbCli
 
 	if err != nil {
 		anlogger.Errorf(lc, "service_common.go : error switch current access token for userId [%s] : %v", userId, err)
-		return false, commons.InternalServerError
+		return ErrInternalServer.Wrap(err)
 	}
 
 	anlogger.Infof(lc, "service_common.go : successfully switch current access token for userId [%s]", userId)
-	return true, ""
+	return nil
 }
@@ -0,0 +1,155 @@
+package apimodel
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNewSettingsQuietHours(t *testing.T) {
+	tests := []struct {
+		name      string
+		settings  Settings
+		wantStart int
+		wantEnd   int
+	}{
+		{"quiet hours are disabled", Settings{QuietHoursStart: 60, QuietHoursEnd: 120}, DefaultQuietHoursStart, DefaultQuietHoursEnd},
+		{"quiet hours are enabled", Settings{QuietHours: true, QuietHoursStart: 0, QuietHoursEnd: 420}, 0, 420},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewSettings(&CreateReq{AppSettings: tt.settings})
+			if got.QuietHours != tt.settings.QuietHours || got.QuietHoursStart != tt.wantStart || got.QuietHoursEnd != tt.wantEnd {
+				t.Errorf("NewSettings() quiet hours = %v %d-%d, want %v %d-%d",
+					got.QuietHours, got.QuietHoursStart, got.QuietHoursEnd, tt.settings.QuietHours, tt.wantStart, tt.wantEnd)
+			}
+			if got.Locale != DefaultLocale || !got.PushVibration {
+				t.Errorf("NewSettings() = %v, defaults are lost", got)
+			}
+		})
+	}
+}
+
+func TestSettingsPatchValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []FieldError
+	}{
+		{
+			name: "nothing is sent",
+			body: `{"accessToken":"token"}`,
+		},
+		{
+			name: "quiet hours",
+			body: `{"quietHours":true,"quietHoursStart":1320,"quietHoursEnd":0,"digestNewLike":true}`,
+		},
+		{
+			name: "quiet hours out of range",
+			body: `{"quietHoursStart":-1,"quietHoursEnd":1440}`,
+			want: []FieldError{
+				{Field: "quietHoursStart", Message: "must be at least 0"},
+				{Field: "quietHoursEnd", Message: "must be at most 1439"},
+			},
+		},
+		{
+			name: "time zone",
+			body: `{"timeZone":-13,"timeZoneName":"Mars/Olympus"}`,
+			want: []FieldError{
+				{Field: "timeZone", Message: "must be at least -12"},
+				{Field: "timeZoneName", Message: "must be an IANA time zone name like Europe/Moscow"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch SettingsPatch
+			if err := json.Unmarshal([]byte(tt.body), &patch); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if got := Validate(&patch); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []FieldError
+	}{
+		{
+			name: "defaults",
+			body: `{"locale":"en","push":true}`,
+		},
+		{
+			name: "time zone name and quiet hours",
+			body: `{"timeZone":5,"timeZoneName":"Asia/Kolkata","quietHours":true,"quietHoursStart":0,"quietHoursEnd":480}`,
+		},
+		{
+			name: "quiet hours are disabled without bounds",
+			body: `{"quietHours":false}`,
+		},
+		{
+			name: "time zone out of range",
+			body: `{"timeZone":15,"timeZoneName":"Mars/Olympus"}`,
+			want: []FieldError{
+				{Field: "settings.timeZone", Message: "must be at most 14"},
+				{Field: "settings.timeZoneName", Message: "must be an IANA time zone name like Europe/Moscow"},
+			},
+		},
+		{
+			name: "quiet hours out of range",
+			body: `{"quietHours":true,"quietHoursStart":-1,"quietHoursEnd":1440}`,
+			want: []FieldError{
+				{Field: "settings.quietHoursStart", Message: "must be at least 0"},
+				{Field: "settings.quietHoursEnd", Message: "must be at most 1439"},
+			},
+		},
+		{
+			name: "quiet hours without bounds",
+			body: `{"quietHours":true,"quietHoursStart":null}`,
+			want: []FieldError{
+				{Field: "settings.quietHoursStart", Message: "is required when quiet hours are enabled"},
+				{Field: "settings.quietHoursEnd", Message: "is required when quiet hours are enabled"},
+			},
+		},
+		{
+			name: "quiet hours without end",
+			body: `{"quietHours":true,"quietHoursStart":1320}`,
+			want: []FieldError{
+				{Field: "settings.quietHoursEnd", Message: "is required when quiet hours are enabled"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var settings Settings
+			if err := json.Unmarshal([]byte(tt.body), &settings); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if got := settings.Validate(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateReqSettingsPresence(t *testing.T) {
+	var req CreateReq
+	body := `{"settings":{"quietHours":true,"quietHoursStart":1320,"quietHoursEnd":480,"timeZoneName":" Europe/Moscow "}}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if got := req.AppSettings.Validate(); len(got) != 0 {
+		t.Errorf("Validate() = %v, want no errors", got)
+	}
+	if req.AppSettings.TimeZoneName != "Europe/Moscow" {
+		t.Errorf("time zone name = %q, it's not sanitized", req.AppSettings.TimeZoneName)
+	}
+}
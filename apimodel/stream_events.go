@@ -0,0 +1,52 @@
+package apimodel
+
+import (
+	"fmt"
+)
+
+//Events of other services which auth service reacts on, see lambda-handle-stream
+const (
+	//user was banned by moderation : user is hidden and the session is finished
+	UserBannedEventType = "USER_BANNED"
+	//user was deleted by another service (e.g. admin tool) : user is removed from auth service as well
+	UserDeletedEventType = "USER_DELETED"
+	//one report (started by block event) is resolved, see ReportResolvedEvent
+	ReportResolvedEventType = "REPORT_RESOLVED"
+
+	//nothing was found : both users are released
+	ReportResolutionDismissed = "dismissed"
+	//reported (target) user violated the rules : the user stays hidden, moderation bans or deletes such user
+	ReportResolutionViolation = "violation"
+
+	//UserProfile column with the number of not resolved reports where the user takes part,
+	//report status is cleared only when there are no open reports anymore
+	OpenReportsCountColumnName = "openReportsCount"
+	//UserProfile string set with ids of the stream records which already changed the counter,
+	//so the record which is retried or redelivered changes it only once
+	AppliedReportRecordsColumnName = "appliedReportRecords"
+)
+
+//UserModerationEvent is the body of the banned and deleted events
+type UserModerationEvent struct {
+	UserId    string `json:"userId"`
+	Reason    string `json:"reason"`
+	UnixTime  int64  `json:"unixTime"`
+	EventType string `json:"eventType"`
+}
+
+func (event UserModerationEvent) String() string {
+	return fmt.Sprintf("%#v", event)
+}
+
+//ReportResolvedEvent has the same users as commons.UserBlockOtherEvent which started the report
+type ReportResolvedEvent struct {
+	UserId       string `json:"userId"`
+	TargetUserId string `json:"targetUserId"`
+	Resolution   string `json:"resolution"`
+	UnixTime     int64  `json:"unixTime"`
+	EventType    string `json:"eventType"`
+}
+
+func (event ReportResolvedEvent) String() string {
+	return fmt.Sprintf("%#v", event)
+}
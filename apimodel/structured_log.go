@@ -0,0 +1,126 @@
+package apimodel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	//clients and other services can pass their own id to join the logs
+	CorrelationIdHeader = "x-correlation-id"
+	//set by ALB for every request
+	AmznTraceIdHeader = "x-amzn-trace-id"
+
+	LogLevelDebug = "DEBUG"
+	LogLevelInfo  = "INFO"
+	LogLevelWarn  = "WARN"
+	LogLevelError = "ERROR"
+
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+	OutcomePanic   = "panic"
+)
+
+type Fields map[string]interface{}
+
+//StructuredLogger writes one json object per line, lambda stdout goes to CloudWatch,
+//so it's an alternative sink to papertrail where the entries could be queried by fields
+type StructuredLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+var StructuredLog = NewStructuredLogger(os.Stdout)
+
+func NewStructuredLogger(out io.Writer) *StructuredLogger {
+	return &StructuredLogger{out: out}
+}
+
+//RequestLogger adds request scoped fields to every entry
+type RequestLogger struct {
+	logger        *StructuredLogger
+	CorrelationId string
+	UserId        string
+}
+
+func (l *StructuredLogger) ForRequest(correlationId string) *RequestLogger {
+	return &RequestLogger{
+		logger:        l,
+		CorrelationId: correlationId,
+	}
+}
+
+func (l *StructuredLogger) write(level, message string, fields Fields) {
+	if level == LogLevelDebug && !IsDebugLogEnabled {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["lambda"] = lambdacontext.FunctionName
+	//messages are free form, so they could contain emails or tokens
+	entry["message"] = Scrub(message)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"%s","lambda":"%s","message":"error marshaling log entry : %v"}`,
+			LogLevelError, lambdacontext.FunctionName, err))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+func (l *RequestLogger) Log(level, message string, fields Fields) {
+	all := Fields{"correlationId": l.CorrelationId}
+	if l.UserId != "" {
+		all["userId"] = l.UserId
+	}
+	for k, v := range fields {
+		all[k] = v
+	}
+	l.logger.write(level, message, all)
+}
+
+func (l *RequestLogger) Debugf(format string, args ...interface{}) {
+	l.Log(LogLevelDebug, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *RequestLogger) Infof(format string, args ...interface{}) {
+	l.Log(LogLevelInfo, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *RequestLogger) Warnf(format string, args ...interface{}) {
+	l.Log(LogLevelWarn, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *RequestLogger) Errorf(format string, args ...interface{}) {
+	l.Log(LogLevelError, fmt.Sprintf(format, args...), nil)
+}
+
+//CorrelationId takes id from our own header, then from the ALB trace header, and generates new one
+//only if the request has neither of them
+func CorrelationId(headers map[string]string) string {
+	if id := headers[CorrelationIdHeader]; id != "" {
+		return id
+	}
+	if id := headers[AmznTraceIdHeader]; id != "" {
+		return id
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Sprintf("generated-%d", time.Now().UnixNano())
+	}
+	return id.String()
+}
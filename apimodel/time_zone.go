@@ -0,0 +1,44 @@
+package apimodel
+
+import (
+	"fmt"
+	"time"
+	//lambda runtime image could have no zoneinfo
+	_ "time/tzdata"
+)
+
+const (
+	//IANA name of the time zone (e.g. Asia/Kolkata), stored in UserSettings next to the legacy offset
+	TimeZoneNameColumnName = "timeZoneName"
+
+	//extra fields of the settings events, offset is derived from the name at the moment of the event
+	TimeZoneNameEventField   = "timeZoneName"
+	TimeZoneOffsetEventField = "timeZoneOffsetMinutes"
+)
+
+//LoadTimeZone returns location by IANA name, empty name and Local are not accepted
+func LoadTimeZone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("unknown time zone [%s]", name)
+	}
+	return time.LoadLocation(name)
+}
+
+//TimeZoneOffset returns current offset from UTC in minutes, it takes DST into account
+func TimeZoneOffset(location *time.Location, now time.Time) int {
+	_, offset := now.In(location).Zone()
+	return offset / 60
+}
+
+//LegacyTimeZone returns whole hours of the current offset, which is what old clients and consumers expect
+func LegacyTimeZone(location *time.Location, now time.Time) int {
+	return TimeZoneOffset(location, now) / 60
+}
+
+//UserLocation returns location of the user, legacy offset is used if there is no name or the name is unknown
+func UserLocation(timeZoneName string, legacyTimeZone int) *time.Location {
+	if location, err := LoadTimeZone(timeZoneName); err == nil {
+		return location
+	}
+	return time.FixedZone("", legacyTimeZone*60*60)
+}
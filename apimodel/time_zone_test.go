@@ -0,0 +1,85 @@
+package apimodel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeZoneOffset(t *testing.T) {
+	winter := time.Date(2026, time.January, 15, 12, 0, 0, 0, time.UTC)
+	summer := time.Date(2026, time.July, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		now        time.Time
+		wantOffset int
+		wantLegacy int
+	}{
+		{"Asia/Kolkata", winter, 330, 5},
+		{"Europe/Berlin", winter, 60, 1},
+		{"Europe/Berlin", summer, 120, 2},
+		{"America/New_York", summer, -240, -4},
+		{"America/St_Johns", winter, -210, -3},
+		{"UTC", summer, 0, 0},
+	}
+
+	for _, tt := range tests {
+		location, err := LoadTimeZone(tt.name)
+		if err != nil {
+			t.Fatalf("LoadTimeZone(%q) error = %v", tt.name, err)
+		}
+		if got := TimeZoneOffset(location, tt.now); got != tt.wantOffset {
+			t.Errorf("TimeZoneOffset(%s, %s) = %d, want %d", tt.name, tt.now, got, tt.wantOffset)
+		}
+		if got := LegacyTimeZone(location, tt.now); got != tt.wantLegacy {
+			t.Errorf("LegacyTimeZone(%s, %s) = %d, want %d", tt.name, tt.now, got, tt.wantLegacy)
+		}
+	}
+}
+
+func TestLoadTimeZoneRejects(t *testing.T) {
+	for _, name := range []string{"", "Local", "Mars/Olympus", "+05:30"} {
+		if _, err := LoadTimeZone(name); err == nil {
+			t.Errorf("LoadTimeZone(%q) returns no error", name)
+		}
+	}
+}
+
+func TestUserLocation(t *testing.T) {
+	now := time.Date(2026, time.January, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		timeZoneName   string
+		legacyTimeZone int
+		wantOffset     int
+	}{
+		{"Asia/Kolkata", 3, 330},
+		{"", 3, 180},
+		{"Mars/Olympus", -5, -300},
+	}
+	for _, tt := range tests {
+		if got := TimeZoneOffset(UserLocation(tt.timeZoneName, tt.legacyTimeZone), now); got != tt.wantOffset {
+			t.Errorf("UserLocation(%q, %d) offset = %d, want %d", tt.timeZoneName, tt.legacyTimeZone, got, tt.wantOffset)
+		}
+	}
+}
+
+func TestValidateTimeZoneRule(t *testing.T) {
+	type settings struct {
+		TimeZoneName string `json:"timeZoneName" validate:"optional,timezone"`
+	}
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 0},
+		{"Europe/Moscow", 0},
+		{"Local", 1},
+		{"Mars/Olympus", 1},
+	}
+	for _, tt := range tests {
+		req := settings{TimeZoneName: tt.value}
+		if got := Validate(&req); len(got) != tt.want {
+			t.Errorf("Validate(%q) = %v, want %d errors", tt.value, got, tt.want)
+		}
+	}
+}
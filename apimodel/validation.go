@@ -0,0 +1,154 @@
+package apimodel
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	//single line text, all control symbols are removed
+	SanitizeLine = "line"
+	//multi line text, new lines are kept
+	SanitizeText = "text"
+
+	zeroWidthJoiner = '\u200d'
+)
+
+//en, ru, en_US, pt-BR, zh_Hans
+var localeRegexp = regexp.MustCompile(`^[a-z]{2,3}([_-][A-Za-z]{2,4})?$`)
+
+//FieldError describes why the value of the request field was rejected,
+//it's returned to the client as a part of the error response
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	return fmt.Sprintf("%s : %s", e.Field, e.Message)
+}
+
+//Validate sanitizes string fields and checks the values of the struct (req must be a pointer) using field tags:
+//	sanitize - line or text, see SanitizeLine and SanitizeText
+//	validate - comma separated rules : min=N, max=N (max length in symbols for strings),
+//	           optional (zero value is always valid, e.g. height which was not set),
+//	           locale (language code with optional region, e.g. en or ru_RU),
+//	           timezone (IANA time zone name, e.g. Asia/Kolkata)
+//Field name in the errors is taken from json tag, nil pointer fields are not validated (value was not sent).
+func Validate(req interface{}) []FieldError {
+	v := reflect.ValueOf(req)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return []FieldError{{Field: "", Message: fmt.Sprintf("can not validate %T", req)}}
+	}
+	v = v.Elem()
+	t := v.Type()
+
+	var result []FieldError
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldValue := v.Field(i)
+		if fieldValue.Kind() == reflect.Ptr {
+			if fieldValue.IsNil() {
+				continue
+			}
+			fieldValue = fieldValue.Elem()
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+
+		if mode, ok := field.Tag.Lookup("sanitize"); ok && fieldValue.Kind() == reflect.String {
+			fieldValue.SetString(Sanitize(fieldValue.String(), mode == SanitizeText))
+		}
+
+		tag, ok := field.Tag.Lookup("validate")
+		if !ok {
+			continue
+		}
+		if message := validateField(fieldValue, tag); message != "" {
+			result = append(result, FieldError{Field: name, Message: message})
+		}
+	}
+	return result
+}
+
+//return empty string if the value is valid
+func validateField(fieldValue reflect.Value, tag string) string {
+	var size float64
+	unit := ""
+	switch fieldValue.Kind() {
+	case reflect.String:
+		size = float64(len([]rune(fieldValue.String())))
+		unit = " symbols"
+	case reflect.Int, reflect.Int64:
+		size = float64(fieldValue.Int())
+	case reflect.Float64:
+		size = fieldValue.Float()
+	default:
+		return fmt.Sprintf("unsupported field type %s", fieldValue.Type())
+	}
+
+	rules := strings.Split(tag, ",")
+	for _, each := range rules {
+		if strings.TrimSpace(each) == "optional" && size == 0 {
+			return ""
+		}
+	}
+
+	for _, each := range rules {
+		if strings.TrimSpace(each) == "locale" && !localeRegexp.MatchString(fieldValue.String()) {
+			return "must be a language code like en or en_US"
+		}
+		if strings.TrimSpace(each) == "timezone" {
+			if _, err := LoadTimeZone(fieldValue.String()); err != nil {
+				return "must be an IANA time zone name like Europe/Moscow"
+			}
+		}
+		parts := strings.SplitN(strings.TrimSpace(each), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		limit, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return fmt.Sprintf("wrong %s rule [%s]", parts[0], parts[1])
+		}
+		switch parts[0] {
+		case "min":
+			if size < limit {
+				return fmt.Sprintf("must be at least %s%s", parts[1], unit)
+			}
+		case "max":
+			if size > limit {
+				return fmt.Sprintf("must be at most %s%s", parts[1], unit)
+			}
+		}
+	}
+	return ""
+}
+
+//Sanitize replaces broken utf-8, removes control and invisible formatting symbols
+//(zero width spaces, bidi overrides, etc.) and trims the spaces
+func Sanitize(value string, keepNewLines bool) string {
+	value = strings.ToValidUTF8(value, "")
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' && keepNewLines:
+			return r
+		case r == '\t' || r == '\n' || r == '\r':
+			return ' '
+		case r == zeroWidthJoiner:
+			//part of emoji sequences
+			return r
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			return -1
+		}
+		return r
+	}, value)
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,138 @@
+package apimodel
+
+import (
+	"reflect"
+	"testing"
+)
+
+type validationTestReq struct {
+	Name     string  `json:"name" sanitize:"line" validate:"min=1,max=5"`
+	About    string  `json:"about" sanitize:"text" validate:"max=10"`
+	Height   int     `json:"height" validate:"optional,min=140,max=220"`
+	Weight   float64 `json:"weight" validate:"optional,min=30"`
+	Untagged string
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		req  validationTestReq
+		want []FieldError
+	}{
+		{
+			name: "valid values",
+			req:  validationTestReq{Name: "Anna", About: "hi", Height: 170, Weight: 55.5},
+		},
+		{
+			name: "optional zero values",
+			req:  validationTestReq{Name: "Anna"},
+		},
+		{
+			name: "min and max",
+			req:  validationTestReq{Name: "", About: "more than ten", Height: 300, Weight: 10},
+			want: []FieldError{
+				{Field: "name", Message: "must be at least 1 symbols"},
+				{Field: "about", Message: "must be at most 10 symbols"},
+				{Field: "height", Message: "must be at most 220"},
+				{Field: "weight", Message: "must be at least 30"},
+			},
+		},
+		{
+			name: "length is counted in symbols",
+			req:  validationTestReq{Name: "Ёлкин"},
+		},
+		{
+			name: "value is sanitized before the check",
+			req:  validationTestReq{Name: "\u200b\u200b  Anna \u202e"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Validate(&tt.req); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePointersAndLocale(t *testing.T) {
+	type patch struct {
+		Locale *string `json:"locale" validate:"locale"`
+		Height *int    `json:"height" validate:"min=140"`
+	}
+	locale := func(s string) *string { return &s }
+	height := func(n int) *int { return &n }
+
+	tests := []struct {
+		name string
+		req  patch
+		want []FieldError
+	}{
+		{name: "nil pointers are not validated"},
+		{name: "language", req: patch{Locale: locale("en")}},
+		{name: "language with region", req: patch{Locale: locale("pt-BR"), Height: height(170)}},
+		{name: "script", req: patch{Locale: locale("zh_Hans")}},
+		{
+			name: "wrong values",
+			req:  patch{Locale: locale("english"), Height: height(100)},
+			want: []FieldError{
+				{Field: "locale", Message: "must be a language code like en or en_US"},
+				{Field: "height", Message: "must be at least 140"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Validate(&tt.req); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSanitizesFields(t *testing.T) {
+	req := validationTestReq{Name: " Anna\u200b\tMaria ", About: "line one\nline\u0000 two\r\n"}
+	Validate(&req)
+
+	if req.Name != "Anna Maria" {
+		t.Errorf("name = %q, want %q", req.Name, "Anna Maria")
+	}
+	if req.About != "line one\nline two" {
+		t.Errorf("about = %q, want %q", req.About, "line one\nline two")
+	}
+}
+
+func TestValidateNotStructPointer(t *testing.T) {
+	for _, req := range []interface{}{validationTestReq{}, "text", nil} {
+		if got := Validate(req); len(got) != 1 {
+			t.Errorf("Validate(%T) = %v, want one error", req, got)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		keepNewLines bool
+		want         string
+	}{
+		{"spaces are trimmed", "  text  ", false, "text"},
+		{"control symbols", "a\u0000b\u0007c", false, "abc"},
+		{"tabs and new lines become spaces", "a\tb\nc\rd", false, "a b c d"},
+		{"new lines are kept in text", "a\nb\tc", true, "a\nb c"},
+		{"zero width and bidi symbols", "a\u200bb\u200ec\u202ed\ufeff", false, "abcd"},
+		{"zero width joiner is kept", "\U0001F468\u200d\U0001F469", false, "\U0001F468\u200d\U0001F469"},
+		{"broken utf-8", "a\xffb", false, "ab"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sanitize(tt.value, tt.keepNewLines); got != tt.want {
+				t.Errorf("Sanitize(%q, %v) = %q, want %q", tt.value, tt.keepNewLines, got, tt.want)
+			}
+		})
+	}
+}
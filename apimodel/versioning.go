@@ -0,0 +1,73 @@
+package apimodel
+
+import (
+	"strconv"
+	"strings"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	//the same attribute is used in UserProfile and UserSettings tables
+	VersionColumnName = "version"
+	//name of the request param with the version which client has seen
+	VersionParamName = "version"
+)
+
+//AddVersionCheck makes the update versioned : version is always incremented and if expectedVersion
+//is not nil the update fails with ConditionalCheckFailedException when the row has another version.
+//Version 0 means the row which was never versioned. New version could be read with VersionFromAttributes.
+func AddVersionCheck(input *dynamodb.UpdateItemInput, expectedVersion *int64) {
+	if input.ExpressionAttributeNames == nil {
+		input.ExpressionAttributeNames = make(map[string]*string)
+	}
+	if input.ExpressionAttributeValues == nil {
+		input.ExpressionAttributeValues = make(map[string]*dynamodb.AttributeValue)
+	}
+	input.ExpressionAttributeNames["#version"] = aws.String(VersionColumnName)
+	input.ExpressionAttributeValues[":versionZeroV"] = &dynamodb.AttributeValue{N: aws.String("0")}
+	input.ExpressionAttributeValues[":versionOneV"] = &dynamodb.AttributeValue{N: aws.String("1")}
+
+	increment := "#version = if_not_exists(#version, :versionZeroV) + :versionOneV"
+	updateExp := strings.TrimSpace(aws.StringValue(input.UpdateExpression))
+	switch {
+	case updateExp == "":
+		updateExp = "SET " + increment
+	case strings.HasPrefix(updateExp, "SET "):
+		updateExp = "SET " + increment + ", " + strings.TrimPrefix(updateExp, "SET ")
+	default:
+		updateExp = "SET " + increment + " " + updateExp
+	}
+	input.UpdateExpression = aws.String(updateExp)
+
+	if expectedVersion != nil {
+		input.ExpressionAttributeValues[":expectedVersionV"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(*expectedVersion, 10)),
+		}
+		condition := "#version = :expectedVersionV"
+		if *expectedVersion == 0 {
+			condition = "(attribute_not_exists(#version) OR #version = :expectedVersionV)"
+		}
+		if input.ConditionExpression != nil {
+			condition = "(" + *input.ConditionExpression + ") AND " + condition
+		}
+		input.ConditionExpression = aws.String(condition)
+	}
+
+	if input.ReturnValues == nil {
+		input.ReturnValues = aws.String(dynamodb.ReturnValueUpdatedNew)
+	}
+}
+
+//VersionFromAttributes returns version from the item attributes, 0 if the item is not versioned yet
+func VersionFromAttributes(attributes map[string]*dynamodb.AttributeValue) int64 {
+	value, ok := attributes[VersionColumnName]
+	if !ok || value.N == nil {
+		return 0
+	}
+	version, err := strconv.ParseInt(*value.N, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return version
+}
@@ -0,0 +1,131 @@
+package apimodel
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestAddVersionCheck(t *testing.T) {
+	version := func(v int64) *int64 { return &v }
+
+	tests := []struct {
+		name            string
+		updateExp       string
+		condition       string
+		expectedVersion *int64
+		wantUpdate      string
+		wantCondition   string
+		wantExpectedV   string
+	}{
+		{
+			name:       "no expected version",
+			updateExp:  "SET #name = :nameV",
+			wantUpdate: "SET #version = if_not_exists(#version, :versionZeroV) + :versionOneV, #name = :nameV",
+		},
+		{
+			name:       "empty update",
+			wantUpdate: "SET #version = if_not_exists(#version, :versionZeroV) + :versionOneV",
+		},
+		{
+			name:       "update without set",
+			updateExp:  "REMOVE #name",
+			wantUpdate: "SET #version = if_not_exists(#version, :versionZeroV) + :versionOneV REMOVE #name",
+		},
+		{
+			name:            "not versioned row",
+			updateExp:       "SET #name = :nameV",
+			expectedVersion: version(0),
+			wantUpdate:      "SET #version = if_not_exists(#version, :versionZeroV) + :versionOneV, #name = :nameV",
+			wantCondition:   "(attribute_not_exists(#version) OR #version = :expectedVersionV)",
+			wantExpectedV:   "0",
+		},
+		{
+			name:            "expected version with existing condition",
+			updateExp:       "SET #name = :nameV",
+			condition:       "attribute_exists(#userId)",
+			expectedVersion: version(7),
+			wantUpdate:      "SET #version = if_not_exists(#version, :versionZeroV) + :versionOneV, #name = :nameV",
+			wantCondition:   "(attribute_exists(#userId)) AND #version = :expectedVersionV",
+			wantExpectedV:   "7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := &dynamodb.UpdateItemInput{}
+			if tt.updateExp != "" {
+				input.UpdateExpression = aws.String(tt.updateExp)
+			}
+			if tt.condition != "" {
+				input.ConditionExpression = aws.String(tt.condition)
+			}
+			AddVersionCheck(input, tt.expectedVersion)
+
+			if got := aws.StringValue(input.UpdateExpression); got != tt.wantUpdate {
+				t.Errorf("update expression = %q, want %q", got, tt.wantUpdate)
+			}
+			if got := aws.StringValue(input.ConditionExpression); got != tt.wantCondition {
+				t.Errorf("condition expression = %q, want %q", got, tt.wantCondition)
+			}
+			expectedV, ok := input.ExpressionAttributeValues[":expectedVersionV"]
+			if tt.wantExpectedV == "" && ok {
+				t.Errorf("expected version value is set without expected version")
+			}
+			if tt.wantExpectedV != "" && (!ok || aws.StringValue(expectedV.N) != tt.wantExpectedV) {
+				t.Errorf("expected version value = %v, want %s", expectedV, tt.wantExpectedV)
+			}
+			if aws.StringValue(input.ExpressionAttributeNames["#version"]) != VersionColumnName {
+				t.Errorf("version column name is not set")
+			}
+			if aws.StringValue(input.ReturnValues) != dynamodb.ReturnValueUpdatedNew {
+				t.Errorf("return values = %v, want %s", aws.StringValue(input.ReturnValues), dynamodb.ReturnValueUpdatedNew)
+			}
+		})
+	}
+}
+
+func TestAddVersionCheckKeepsReturnValues(t *testing.T) {
+	input := &dynamodb.UpdateItemInput{ReturnValues: aws.String(dynamodb.ReturnValueAllNew)}
+	AddVersionCheck(input, nil)
+	if aws.StringValue(input.ReturnValues) != dynamodb.ReturnValueAllNew {
+		t.Errorf("return values = %v, want %s", aws.StringValue(input.ReturnValues), dynamodb.ReturnValueAllNew)
+	}
+}
+
+func TestVersionFromAttributes(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]*dynamodb.AttributeValue
+		want       int64
+	}{
+		{"no attributes", nil, 0},
+		{"not versioned", map[string]*dynamodb.AttributeValue{"name": {S: aws.String("Anna")}}, 0},
+		{"versioned", map[string]*dynamodb.AttributeValue{VersionColumnName: {N: aws.String("12")}}, 12},
+		{"not a number", map[string]*dynamodb.AttributeValue{VersionColumnName: {S: aws.String("12")}}, 0},
+		{"broken number", map[string]*dynamodb.AttributeValue{VersionColumnName: {N: aws.String("1.5")}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VersionFromAttributes(tt.attributes); got != tt.want {
+				t.Errorf("VersionFromAttributes() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionConflictError(t *testing.T) {
+	err := ErrVersionConflict.Wrap(errors.New(dynamodb.ErrCodeConditionalCheckFailedException))
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("wrapped conflict is not ErrVersionConflict")
+	}
+	if err.HttpStatus != http.StatusConflict {
+		t.Errorf("conflict status = %d, want %d", err.HttpStatus, http.StatusConflict)
+	}
+	if got := FromErrorString(err.ResponseBody()); got == nil || got.Code != ErrVersionConflict.Code || got.HttpStatus != http.StatusConflict {
+		t.Errorf("FromErrorString() of the conflict = %v", got)
+	}
+}
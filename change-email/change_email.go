@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	basicLambda "github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/aws"
@@ -10,11 +9,12 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"encoding/json"
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/ringoid/commons"
-	"strings"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 )
@@ -31,59 +31,41 @@ var commonStreamName string
 var emailAuthTable string
 var authConfirmTable string
 
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable   string `env:"USER_PROFILE_TABLE" validate:"required"`
+	CommonStreamName   string `env:"COMMON_STREAM" validate:"required"`
+	EmailAuthTable     string `env:"EMAIL_AUTH_TABLE" validate:"required"`
+	AuthConfirmTable   string `env:"AUTH_CONFIRM_TABLE" validate:"required"`
+	DeliveryStreamName string `env:"DELIVERY_STREAM" validate:"required"`
+}
+
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : change_email.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : change_email.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : change_email.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : change_email.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : change_email.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : change_email.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "change-email-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "change-email-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : change_email.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : change_email.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : change_email.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : change_email.go : env can not be empty USER_PROFILE_TABLE")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : change_email.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
-
-	commonStreamName, ok = os.LookupEnv("COMMON_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : change_email.go : env can not be empty COMMON_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : change_email.go : start with DELIVERY_STREAM = [%s]", commonStreamName)
-
-	emailAuthTable, ok = os.LookupEnv("EMAIL_AUTH_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : change_email.go : env can not be empty EMAIL_AUTH_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : change_email.go : start with EMAIL_AUTH_TABLE = [%s]", emailAuthTable)
-
-	authConfirmTable, ok = os.LookupEnv("AUTH_CONFIRM_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : change_email.go : env can not be empty AUTH_CONFIRM_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : change_email.go : start with AUTH_CONFIRM_TABLE = [%s]", authConfirmTable)
+	userProfileTable = cfg.UserProfileTable
+	commonStreamName = cfg.CommonStreamName
+	emailAuthTable = cfg.EmailAuthTable
+	authConfirmTable = cfg.AuthConfirmTable
+	deliveryStreamName = cfg.DeliveryStreamName
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -93,6 +75,15 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : change_email.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "change-email-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : change_email.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : change_email.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
@@ -101,88 +92,41 @@ func init() {
 	awsKinesisClient = kinesis.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : change_email.go : kinesis client was successfully initialized")
 
-	deliveryStreamName, ok = os.LookupEnv("DELIVERY_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : change_email.go : env can not be empty DELIVERY_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : change_email.go : start with DELIVERY_STREAM = [%s]", deliveryStreamName)
-
 	awsDeliveryStreamClient = firehose.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : change_email.go : firehose client was successfully initialized")
 }
 
-func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
-	lc, _ := lambdacontext.FromContext(ctx)
-
-	userAgent := request.Headers["user-agent"]
-	if strings.HasPrefix(userAgent, "ELB-HealthChecker") {
-		return commons.NewServiceResponse("{}"), nil
-	}
-
-	if request.HTTPMethod != "POST" {
-		return commons.NewWrongHttpMethodServiceResponse(), nil
-	}
-	sourceIp := request.Headers["x-forwarded-for"]
-
-	anlogger.Debugf(lc, "change_email.go : start handle request %v", request)
-
-	appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(request.Headers, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "change_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	reqParam, ok, errStr := parseParams(request.Body, lc)
-	if !ok {
-		anlogger.Errorf(lc, "change_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	userId, _, _, ok, errStr := commons.Login(appVersion, isItAndroid, reqParam.AccessToken, secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "update_settings.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	reqParam := req.Params.(*apimodel.ChangeEmailRequest)
+	userId := req.UserId
 
-	currentEmail, ok, errStr := currentEmail(userId, lc)
-	if !ok {
-		anlogger.Errorf(lc, "change_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	currentEmail, authErr := currentEmail(userId, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
-	ok, errStr = tryUpdateAuthStatusForNewEmail(userId, reqParam.NewEmail, lc)
-	if !ok {
-		anlogger.Errorf(lc, "change_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	authErr = tryUpdateAuthStatusForNewEmail(userId, reqParam.NewEmail, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
-	ok, errStr = cleanEmailState(userId, currentEmail, reqParam.NewEmail, lc)
-	if !ok {
-		anlogger.Errorf(lc, "change_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	authErr = cleanEmailState(userId, currentEmail, reqParam.NewEmail, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
-	changeEmailEvent := commons.NewUserChangeEmailEvent(userId, currentEmail, reqParam.NewEmail, sourceIp)
+	changeEmailEvent := commons.NewUserChangeEmailEvent(userId, currentEmail, reqParam.NewEmail, req.SourceIp)
 	commons.SendAnalyticEvent(changeEmailEvent, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
-	resp := commons.BaseResponse{}
-
-	body, err := json.Marshal(resp)
-	if err != nil {
-		anlogger.Errorf(lc, "change_email.go : error while marshaling resp object : %v", err)
-		return commons.NewServiceResponse(commons.InternalServerError), nil
-	}
-	anlogger.Debugf(lc, "change_email.go : return body=%s", string(body))
-
 	anlogger.Infof(lc, "change_email.go : successfully change old email [%s] to new one [%s] for userId [%s]",
-		currentEmail, reqParam.NewEmail, userId)
+		apimodel.MaskEmail(currentEmail), apimodel.MaskEmail(reqParam.NewEmail), userId)
 
-	return commons.NewServiceResponse(string(body)), nil
+	return commons.BaseResponse{}, nil
 }
 
-//return current email, ok and error string
-func currentEmail(userId string, lc *lambdacontext.LambdaContext) (string, bool, string) {
+//return current email and error if something went wrong
+func currentEmail(userId string, lc *lambdacontext.LambdaContext) (string, *apimodel.AuthError) {
 	anlogger.Debugf(lc, "change_email.go : fetch current email for userId [%s]", userId)
 
 	input := &dynamodb.GetItemInput{
@@ -198,30 +142,30 @@ func currentEmail(userId string, lc *lambdacontext.LambdaContext) (string, bool,
 	result, err := awsDbClient.GetItem(input)
 	if err != nil {
 		anlogger.Errorf(lc, "change_email.go : error fetch current email for userId [%s] : %v", userId, err)
-		return "", false, commons.InternalServerError
+		return "", apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	if len(result.Item) == 0 {
 		anlogger.Errorf(lc, "change_email.go : there is no such user in DB, userId [%s]", userId)
-		return "", false, commons.InternalServerError
+		return "", apimodel.ErrInternalServer
 	}
 
 	var email string
 	attrValue := result.Item[commons.UserEmailColumnName]
 	if attrValue != nil {
 		email = *attrValue.S
-		anlogger.Debugf(lc, "change_email.go : found current email [%s] for userId [%s]", email, userId)
+		anlogger.Debugf(lc, "change_email.go : found current email [%s] for userId [%s]", apimodel.MaskEmail(email), userId)
 	} else {
 		anlogger.Debugf(lc, "change_email.go : there is no current email for userId [%s]", userId)
 	}
 
-	return email, true, ""
+	return email, nil
 }
 
-//return ok and error string
-func tryUpdateAuthStatusForNewEmail(userId, email string, lc *lambdacontext.LambdaContext) (bool, string) {
+//return error if something went wrong
+func tryUpdateAuthStatusForNewEmail(userId, email string, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
 	anlogger.Debugf(lc, "change_email.go : update auth status to account created state, for userId [%s] and email [%s]",
-		userId, email)
+		userId, apimodel.MaskEmail(email))
 
 	input := &dynamodb.UpdateItemInput{
 		ExpressionAttributeNames: map[string]*string{
@@ -260,23 +204,24 @@ func tryUpdateAuthStatusForNewEmail(userId, email string, lc *lambdacontext.Lamb
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case dynamodb.ErrCodeConditionalCheckFailedException:
-				anlogger.Errorf(lc, "change_email.go : error, try to change for already exist email [%s] for userId [%s]", email, userId)
-				return false, commons.EmailAlreadyInUseClientError
+				anlogger.Errorf(lc, "change_email.go : error, try to change for already exist email [%s] for userId [%s]", apimodel.MaskEmail(email), userId)
+				return apimodel.ErrEmailAlreadyInUse.Wrap(aerr)
 			default:
-				anlogger.Errorf(lc, "change_email.go : error to change for already exist email [%s] for userId [%s] : %v", email, userId, aerr)
-				return false, commons.InternalServerError
+				anlogger.Errorf(lc, "change_email.go : error to change for already exist email [%s] for userId [%s] : %v", apimodel.MaskEmail(email), userId, aerr)
+				return apimodel.ErrInternalServer.Wrap(aerr)
 			}
 		}
-		anlogger.Errorf(lc, "change_email.go : error to change for already exist email [%s] for userId [%s] : %v", email, userId, err)
-		return false, commons.InternalServerError
+		anlogger.Errorf(lc, "change_email.go : error to change for already exist email [%s] for userId [%s] : %v", apimodel.MaskEmail(email), userId, err)
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
-	anlogger.Debugf(lc, "change_email.go : successfully change email [%s] for userId [%s] in EmailAuth table", email, userId)
-	return true, ""
+	anlogger.Debugf(lc, "change_email.go : successfully change email [%s] for userId [%s] in EmailAuth table", apimodel.MaskEmail(email), userId)
+	return nil
 }
 
-func cleanEmailState(userId, oldEmail, newEmail string, lc *lambdacontext.LambdaContext) (bool, string) {
-	anlogger.Debugf(lc, "change_email.go : clean email state from old [%s] for new one [%s] for userId [%s]", oldEmail, newEmail, userId)
+//return error if something went wrong
+func cleanEmailState(userId, oldEmail, newEmail string, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
+	anlogger.Debugf(lc, "change_email.go : clean email state from old [%s] for new one [%s] for userId [%s]", apimodel.MaskEmail(oldEmail), apimodel.MaskEmail(newEmail), userId)
 
 	input := &dynamodb.BatchWriteItemInput{
 		RequestItems: map[string][]*dynamodb.WriteRequest{
@@ -307,8 +252,8 @@ func cleanEmailState(userId, oldEmail, newEmail string, lc *lambdacontext.Lambda
 
 	_, err := awsDbClient.BatchWriteItem(input)
 	if err != nil {
-		anlogger.Errorf(lc, "change_email.go : error clean email state for old email [%s] for userId [%s] : %v", oldEmail, userId, err)
-		return false, commons.InternalServerError
+		anlogger.Errorf(lc, "change_email.go : error clean email state for old email [%s] for userId [%s] : %v", apimodel.MaskEmail(oldEmail), userId, err)
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	inputU := &dynamodb.UpdateItemInput{
@@ -331,33 +276,44 @@ func cleanEmailState(userId, oldEmail, newEmail string, lc *lambdacontext.Lambda
 
 	_, err = awsDbClient.UpdateItem(inputU)
 	if err != nil {
-		anlogger.Errorf(lc, "change_email.go : error update email [%s] for userId [%s] : %v", newEmail, userId, err)
-		return false, commons.InternalServerError
+		anlogger.Errorf(lc, "change_email.go : error update email [%s] for userId [%s] : %v", apimodel.MaskEmail(newEmail), userId, err)
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
-	anlogger.Debugf(lc, "change_email.go : successfully clean email state from old [%s] for new one [%s] for userId [%s]", oldEmail, newEmail, userId)
-	return true, ""
+	anlogger.Debugf(lc, "change_email.go : successfully clean email state from old [%s] for new one [%s] for userId [%s]", apimodel.MaskEmail(oldEmail), apimodel.MaskEmail(newEmail), userId)
+	return nil
 }
 
-func parseParams(params string, lc *lambdacontext.LambdaContext) (*apimodel.ChangeEmailRequest, bool, string) {
-	anlogger.Debugf(lc, "change_email.go : parse request body [%s]", params)
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
 	var req apimodel.ChangeEmailRequest
 	err := json.Unmarshal([]byte(params), &req)
 	if err != nil {
-		anlogger.Errorf(lc, "change_email.go : error marshaling required params from the string [%s] : %v", params, err)
-		return nil, false, commons.InternalServerError
+		anlogger.Errorf(lc, "change_email.go : error marshaling required params from the string [%s] : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	if req.NewEmail == "" {
 		anlogger.Errorf(lc, "change_email.go : empty or nil newEmail request param, req %v", req)
-		return nil, false, commons.WrongRequestParamsClientError
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
 	//todo:implement email validation
-	anlogger.Debugf(lc, "change_email.go : successfully parse request string [%s] to %v", params, req)
-	return &req, true, ""
+	anlogger.Debugf(lc, "change_email.go : successfully parse request %v", req)
+	return &req, nil
 }
 
 func main() {
-	basicLambda.Start(handler)
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Params.(*apimodel.ChangeEmailRequest).AccessToken },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
 }
@@ -1,9 +1,11 @@
 package main
 
 import (
-	"context"
 	basicLambda "github.com/aws/aws-lambda-go/lambda"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/firehose"
@@ -11,11 +13,9 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"encoding/json"
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/ringoid/commons"
-	"strings"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 )
 
@@ -23,44 +23,59 @@ var anlogger *commons.Logger
 var secretWord string
 var awsDbClient *dynamodb.DynamoDB
 var userProfileTable string
+var referralCodesTable string
+var referralLedgerTable string
+var referralRewardRules []apimodel.ReferralRewardRule
+var referralFraudConfig apimodel.ReferralFraudConfig
 var awsDeliveryStreamClient *firehose.Firehose
 var deliveryStreamName string
 var commonStreamName string
 var awsKinesisClient *kinesis.Kinesis
 
+type lambdaConfig struct {
+	config.Base
+	apimodel.ReferralFraudConfig
+	UserProfileTable    string `env:"USER_PROFILE_TABLE" validate:"required"`
+	ReferralCodesTable  string `env:"REFERRAL_CODES_TABLE" validate:"required"`
+	ReferralLedgerTable string `env:"REFERRAL_LEDGER_TABLE" validate:"required"`
+	DeliveryStreamName  string `env:"DELIVERY_STREAM" validate:"required"`
+	CommonStreamName    string `env:"COMMON_STREAM" validate:"required"`
+	//see apimodel.ParseReferralRewardRules
+	ReferralRewardRules string `env:"REFERRAL_REWARD_RULES"`
+}
+
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : claim.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : claim.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : claim.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : claim.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : claim.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : claim.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "claim-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "claim-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : claim.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : claim.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : claim.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : claim.go : env can not be empty USER_PROFILE_TABLE")
+	userProfileTable = cfg.UserProfileTable
+	referralCodesTable = cfg.ReferralCodesTable
+	referralLedgerTable = cfg.ReferralLedgerTable
+	referralFraudConfig = cfg.ReferralFraudConfig
+	deliveryStreamName = cfg.DeliveryStreamName
+	commonStreamName = cfg.CommonStreamName
+
+	referralRewardRules, err = apimodel.ParseReferralRewardRules(cfg.ReferralRewardRules)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : claim.go : error parse referral reward rules : %v", err)
 	}
-	anlogger.Debugf(nil, "lambda-initialization : claim.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -70,98 +85,122 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : claim.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "claim-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : claim.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : claim.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : claim.go : dynamodb client was successfully initialized")
 
-	deliveryStreamName, ok = os.LookupEnv("DELIVERY_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : claim.go : env can not be empty DELIVERY_STREAM")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : claim.go : start with DELIVERY_STREAM = [%s]", deliveryStreamName)
-
 	awsDeliveryStreamClient = firehose.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : claim.go : firehose client was successfully initialized")
 
-	commonStreamName, ok = os.LookupEnv("COMMON_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : claim.go : env can not be empty COMMON_STREAM")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : claim.go : start with COMMON_STREAM = [%s]", commonStreamName)
-
 	awsKinesisClient = kinesis.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : claim.go : kinesis client was successfully initialized")
 }
 
-func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
-	lc, _ := lambdacontext.FromContext(ctx)
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	reqParam := req.Params.(*apimodel.ClaimRequest)
+	userId := req.UserId
 
-	userAgent := request.Headers["user-agent"]
-	if strings.HasPrefix(userAgent, "ELB-HealthChecker") {
-		return commons.NewServiceResponse("{}"), nil
+	referralCode, authErr := apimodel.CheckReferralCode(reqParam.ReferralId, userId, referralCodesTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
-	if request.HTTPMethod != "POST" {
-		return commons.NewWrongHttpMethodServiceResponse(), nil
+	//only the claim which would be stored is checked for the fraud
+	claimedBefore, authErr := alreadyClaimed(userId, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
-	sourceIp := request.Headers["x-forwarded-for"]
-
-	anlogger.Debugf(lc, "claim.go : handle request %v", request)
-
-	appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(request.Headers, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "claim.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	if claimedBefore {
+		anlogger.Warnf(lc, "claim.go : warning, try to claim with existing referral for userId [%s]", userId)
+		return commons.BaseResponse{}, nil
 	}
 
-	reqParam, ok := parseParams(request.Body, lc)
-	if !ok {
-		errStr := commons.WrongRequestParamsClientError
-		anlogger.Errorf(lc, "claim.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	referee, authErr := apimodel.LoadReferralParticipant(userId, userProfileTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
+	if referee == nil {
+		referee = &apimodel.ReferralParticipant{UserId: userId}
+	}
+	//for the claim compare with the current ip, not with the signup one
+	referee.SourceIp = req.SourceIp
 
-	userId, _, _, ok, errStr := commons.Login(appVersion, isItAndroid, reqParam.AccessToken, secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "claim.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	fraudReasons, authErr := apimodel.CheckReferralFraud(referralCode, *referee, referralFraudConfig, referralLedgerTable, userProfileTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	if len(fraudReasons) != 0 {
+		rejected := referralFraudConfig.Reject(fraudReasons)
+		fraudEvent := apimodel.NewReferralFraudDetectedEvent(userId, req.SourceIp, referralCode, fraudReasons, rejected)
+		commons.SendAnalyticEvent(fraudEvent, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
+		if rejected {
+			return nil, apimodel.ErrInvalidReferralCode
+		}
 	}
 
-	ok, errStr = claim(userId, reqParam.ReferralId, lc)
-	if !ok && len(errStr) != 0 {
-		anlogger.Errorf(lc, "claim.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	claimed, authErr := claim(userId, reqParam.ReferralId, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
-	if ok {
-		event := commons.NewUserClaimReferralCodeEvent(userId, sourceIp, reqParam.ReferralId)
+	if claimed {
+		event := commons.NewUserClaimReferralCodeEvent(userId, req.SourceIp, reqParam.ReferralId)
 		commons.SendAnalyticEvent(event, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
 		//send common events for neo4j
 		partitionKey := userId
-		ok, errStr = commons.SendCommonEvent(event, userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
+		ok, errStr := commons.SendCommonEvent(apimodel.TracedEvent(req.Ctx, event), userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
 		if !ok {
-			anlogger.Errorf(lc, "claim.go : userId [%s], return %s to client", userId, errStr)
-			return commons.NewServiceResponse(errStr), nil
+			return nil, apimodel.FromErrorString(errStr)
 		}
 		anlogger.Infof(lc, "claim.go : successfully claim code [%s] for userId [%s]", reqParam.ReferralId, userId)
+
+		apimodel.RecordReferralAfterCommit(req.Ctx, referralCode, userId, fraudReasons, referralLedgerTable, userProfileTable, referralRewardRules,
+			deliveryStreamName, commonStreamName, awsDbClient, awsDeliveryStreamClient, awsKinesisClient, anlogger, lc)
 	}
 
-	resp := commons.BaseResponse{}
-	body, err := json.Marshal(resp)
-	if err != nil {
-		anlogger.Errorf(lc, "claim.go : error while marshaling resp object %v for userId [%s] : %v", resp, userId, err)
-		anlogger.Errorf(lc, "claim.go : userId [%s], return %s to client", userId, errStr)
-		return commons.NewServiceResponse(commons.InternalServerError), nil
+	return commons.BaseResponse{}, nil
+}
+
+//return true if the user has already claimed a code and error if something went wrong
+func alreadyClaimed(userId string, lc *lambdacontext.LambdaContext) (bool, *apimodel.AuthError) {
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:            aws.String(userProfileTable),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#referralId"),
+		ExpressionAttributeNames: map[string]*string{
+			"#referralId": aws.String(commons.ReferralIdColumnName),
+		},
 	}
-	anlogger.Debugf(lc, "claim.go : return body=%s to client, userId [%s]", string(body), userId)
 
-	return commons.NewServiceResponse(string(body)), nil
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "claim.go : error get referral id of userId [%s] : %v", userId, err)
+		return false, apimodel.ErrInternalServer.Wrap(err)
+	}
+	//the same condition as in claim
+	value, ok := result.Item[commons.ReferralIdColumnName]
+	return ok && value.S != nil && *value.S != apimodel.NoReferralCode, nil
 }
 
-//return ok and error string
-func claim(userId, code string, lc *lambdacontext.LambdaContext) (bool, string) {
+//return was code claimed and error if something went wrong (already claimed code is not an error)
+func claim(userId, code string, lc *lambdacontext.LambdaContext) (bool, *apimodel.AuthError) {
 	anlogger.Debugf(lc, "claim.go : claim code [%s] for userId [%s]", code, userId)
 	input := &dynamodb.UpdateItemInput{
 		ExpressionAttributeNames: map[string]*string{
@@ -172,7 +211,7 @@ func claim(userId, code string, lc *lambdacontext.LambdaContext) (bool, string)
 				S: aws.String(code),
 			},
 			":referralEmptyIdV": {
-				S: aws.String("n/a"),
+				S: aws.String(apimodel.NoReferralCode),
 			},
 		},
 		Key: map[string]*dynamodb.AttributeValue{
@@ -191,50 +230,60 @@ func claim(userId, code string, lc *lambdacontext.LambdaContext) (bool, string)
 			switch aerr.Code() {
 			case dynamodb.ErrCodeConditionalCheckFailedException:
 				anlogger.Warnf(lc, "claim.go : warning, try to claim with existing referral for userId [%s]", userId)
-				return false, ""
+				return false, nil
 			default:
 				anlogger.Errorf(lc, "claim.go : error claim code [%s] for userId [%s] : %v", code, userId, aerr)
-				return false, commons.InternalServerError
+				return false, apimodel.ErrInternalServer.Wrap(aerr)
 			}
 		}
 		anlogger.Errorf(lc, "claim.go : error claim code [%s] for userId [%s] : %v", code, userId, err)
-		return false, commons.InternalServerError
+		return false, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	anlogger.Debugf(lc, "claim.go : successfully claim code [%s] for userId [%s]", code, userId)
-	return true, ""
+	return true, nil
 }
 
-func parseParams(params string, lc *lambdacontext.LambdaContext) (*apimodel.ClaimRequest, bool) {
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
 	var req apimodel.ClaimRequest
 	err := json.Unmarshal([]byte(params), &req)
 
 	if err != nil {
-		anlogger.Errorf(lc, "claim.go : error unmarshal required params from the string %s : %v", params, err)
-		return nil, false
+		anlogger.Errorf(lc, "claim.go : error unmarshal required params from the string %s : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrWrongRequestParams.Wrap(err)
 	}
 
 	if req.AccessToken == "" {
 		anlogger.Errorf(lc, "claim.go : one of the required param is nil or empty, req %v", req)
-		return nil, false
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
-	referealCode := req.ReferralId
-	referealCode = strings.TrimSpace(referealCode)
-	referealCode = strings.ToLower(referealCode)
+	referealCode := apimodel.NormalizeReferralCode(req.ReferralId)
 
 	if referealCode == "" {
 		anlogger.Errorf(lc, "claim.go : referral code is empty or non exist, code [%s]", referealCode)
-		return nil, false
+		return nil, apimodel.ErrWrongRequestParams
 	} else if len([]rune(referealCode)) > apimodel.MaxReferralCodeLength {
 		anlogger.Errorf(lc, "claim.go : too big referral code [%s], len [%d]", referealCode, len([]rune(referealCode)))
-		//return nil, false
+		return nil, apimodel.ErrInvalidReferralCode
 	}
 
 	req.ReferralId = referealCode
-	return &req, true
+	return &req, nil
 }
 
 func main() {
-	basicLambda.Start(handler)
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Params.(*apimodel.ClaimRequest).AccessToken },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
 }
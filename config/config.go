@@ -0,0 +1,232 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//File with json object {"ENV_NAME":"value"}, values from there win over the real env.
+//It's useful for the dev server where we don't have lambda env.
+const FileOverrideEnvName = "AUTH_CONFIG_FILE"
+
+//Base settings which every lambda needs
+type Base struct {
+	Env               string `env:"ENV" validate:"required,oneof=test stage prod"`
+	PapertrailAddress string `env:"PAPERTRAIL_LOG_ADDRESS" validate:"required"`
+	//see metrics.Init
+	BaseCloudWatchNamespace string `env:"BASE_CLOUD_WATCH_NAMESPACE" validate:"required"`
+	//see tracing.Init, stdout and file write stdouttrace json (not OTLP)
+	TracesExporter string `env:"TRACES_EXPORTER" default:"none" validate:"oneof=none stdout file"`
+	TracesFile     string `env:"TRACES_FILE" default:"/tmp/auth-traces.json"`
+}
+
+//Error keeps all the problems which were found during the load, so misconfigured deploy
+//could be fixed at once
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("wrong configuration (%d problems) : %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+func (e *Error) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+//Load fills the struct (cfg must be a pointer) using field tags:
+//	env      - name of env variable
+//	default  - value which is used when variable is not set
+//	validate - comma separated rules : required, min=N, max=N (length for strings), oneof=a b c
+//Supported field types are string, bool, int, int64 and float64, embedded structs are loaded as well.
+func Load(cfg interface{}) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to struct, but it is %T", cfg)
+	}
+
+	overrides, err := readOverrides()
+	if err != nil {
+		return err
+	}
+
+	errs := &Error{}
+	load(v.Elem(), overrides, errs)
+	if len(errs.Problems) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func readOverrides() (map[string]string, error) {
+	fileName, ok := os.LookupEnv(FileOverrideEnvName)
+	if !ok || fileName == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s : %v", fileName, err)
+	}
+	overrides := make(map[string]string)
+	err = json.Unmarshal(data, &overrides)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s : %v", fileName, err)
+	}
+	return overrides, nil
+}
+
+func lookup(name string, overrides map[string]string) (string, bool) {
+	if value, ok := overrides[name]; ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+func load(v reflect.Value, overrides map[string]string, errs *Error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldValue := v.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			load(fieldValue, overrides, errs)
+			continue
+		}
+
+		name, ok := field.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+
+		rawValue, ok := lookup(name, overrides)
+		if !ok || rawValue == "" {
+			rawValue, ok = field.Tag.Lookup("default")
+		}
+
+		rules := parseRules(field.Tag.Get("validate"))
+		if !ok || rawValue == "" {
+			if rules.has("required") {
+				errs.add("env can not be empty %s", name)
+			}
+			continue
+		}
+
+		if err := set(fieldValue, rawValue); err != nil {
+			errs.add("wrong value [%s] for %s : %v", rawValue, name, err)
+			continue
+		}
+
+		validate(name, rawValue, fieldValue, rules, errs)
+	}
+}
+
+type rule struct {
+	name string
+	arg  string
+}
+
+type rules []rule
+
+func (r rules) has(name string) bool {
+	for _, each := range r {
+		if each.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRules(tag string) rules {
+	var result rules
+	for _, each := range strings.Split(tag, ",") {
+		each = strings.TrimSpace(each)
+		if each == "" {
+			continue
+		}
+		parts := strings.SplitN(each, "=", 2)
+		if len(parts) == 2 {
+			result = append(result, rule{name: parts[0], arg: parts[1]})
+		} else {
+			result = append(result, rule{name: parts[0]})
+		}
+	}
+	return result
+}
+
+func set(fieldValue reflect.Value, rawValue string) error {
+	switch fieldValue.Kind() {
+	case reflect.String:
+		fieldValue.SetString(rawValue)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(rawValue)
+		if err != nil {
+			return err
+		}
+		fieldValue.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(rawValue, 10, 64)
+		if err != nil {
+			return err
+		}
+		fieldValue.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(rawValue, 64)
+		if err != nil {
+			return err
+		}
+		fieldValue.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", fieldValue.Type())
+	}
+	return nil
+}
+
+func validate(name, rawValue string, fieldValue reflect.Value, fieldRules rules, errs *Error) {
+	//for strings min and max are about the length
+	var size float64
+	switch fieldValue.Kind() {
+	case reflect.String:
+		size = float64(len([]rune(fieldValue.String())))
+	case reflect.Int, reflect.Int64:
+		size = float64(fieldValue.Int())
+	case reflect.Float64:
+		size = fieldValue.Float()
+	}
+
+	for _, each := range fieldRules {
+		switch each.name {
+		case "required":
+		case "min", "max":
+			limit, err := strconv.ParseFloat(each.arg, 64)
+			if err != nil {
+				errs.add("wrong %s rule [%s] for %s", each.name, each.arg, name)
+				continue
+			}
+			if each.name == "min" && size < limit {
+				errs.add("value [%s] of %s is less than %s", rawValue, name, each.arg)
+			}
+			if each.name == "max" && size > limit {
+				errs.add("value [%s] of %s is greater than %s", rawValue, name, each.arg)
+			}
+		case "oneof":
+			allowed := strings.Fields(each.arg)
+			found := false
+			for _, value := range allowed {
+				if value == rawValue {
+					found = true
+					break
+				}
+			}
+			if !found {
+				errs.add("value [%s] of %s is not one of %v", rawValue, name, allowed)
+			}
+		default:
+			errs.add("unknown validation rule [%s] for %s", each.name, name)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	Base
+	Table    string  `env:"TEST_TABLE" validate:"required"`
+	Attempts int     `env:"TEST_ATTEMPTS" default:"3" validate:"min=1,max=10"`
+	Enabled  bool    `env:"TEST_ENABLED" default:"true"`
+	Ratio    float64 `env:"TEST_RATIO" default:"0.5"`
+	Mode     string  `env:"TEST_MODE" default:"flag" validate:"oneof=flag reject"`
+}
+
+func setBaseEnv(t *testing.T) {
+	t.Setenv("ENV", "test")
+	t.Setenv("PAPERTRAIL_LOG_ADDRESS", "logs.example.com:1234")
+	t.Setenv("BASE_CLOUD_WATCH_NAMESPACE", "test-auth-service")
+	t.Setenv(FileOverrideEnvName, "")
+}
+
+func TestLoadDefaults(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("TEST_TABLE", "test-table")
+
+	var cfg testConfig
+	if err := Load(&cfg); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Env != "test" || cfg.Table != "test-table" {
+		t.Errorf("env values are not loaded, got %+v", cfg)
+	}
+	if cfg.Attempts != 3 || !cfg.Enabled || cfg.Ratio != 0.5 || cfg.Mode != "flag" {
+		t.Errorf("defaults are not applied, got %+v", cfg)
+	}
+	if cfg.TracesExporter != "none" {
+		t.Errorf("default of the embedded struct is not applied, got %q", cfg.TracesExporter)
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{
+			name: "missing required",
+			env:  map[string]string{"TEST_TABLE": ""},
+			want: []string{"TEST_TABLE"},
+		},
+		{
+			name: "out of range and not one of",
+			env:  map[string]string{"TEST_TABLE": "t", "TEST_ATTEMPTS": "11", "TEST_MODE": "block"},
+			want: []string{"TEST_ATTEMPTS", "TEST_MODE"},
+		},
+		{
+			name: "wrong type",
+			env:  map[string]string{"TEST_TABLE": "t", "TEST_ENABLED": "maybe"},
+			want: []string{"TEST_ENABLED"},
+		},
+		{
+			name: "wrong base env",
+			env:  map[string]string{"TEST_TABLE": "t", "ENV": "dev"},
+			want: []string{"ENV"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setBaseEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			var cfg testConfig
+			err := Load(&cfg)
+			configErr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("Load() error = %v, want *Error", err)
+			}
+			if len(configErr.Problems) != len(tt.want) {
+				t.Errorf("Load() problems = %v, want problems about %v", configErr.Problems, tt.want)
+			}
+			for _, name := range tt.want {
+				if !strings.Contains(configErr.Error(), name) {
+					t.Errorf("Load() error = %v, want problem about %s", configErr, name)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFileOverride(t *testing.T) {
+	setBaseEnv(t)
+	t.Setenv("TEST_TABLE", "env-table")
+	t.Setenv("TEST_ATTEMPTS", "5")
+
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(fileName, []byte(`{"TEST_TABLE":"file-table","TEST_MODE":"reject"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(FileOverrideEnvName, fileName)
+
+	var cfg testConfig
+	if err := Load(&cfg); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Table != "file-table" || cfg.Mode != "reject" {
+		t.Errorf("file values don't win over env, got %+v", cfg)
+	}
+	if cfg.Attempts != 5 {
+		t.Errorf("env value which is not in the file is lost, got %d", cfg.Attempts)
+	}
+}
+
+func TestLoadBrokenFile(t *testing.T) {
+	setBaseEnv(t)
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(fileName, []byte(`not json`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(FileOverrideEnvName, fileName)
+
+	var cfg testConfig
+	if err := Load(&cfg); err == nil {
+		t.Errorf("Load() with broken file returns no error")
+	}
+}
+
+func TestLoadNotPointer(t *testing.T) {
+	if err := Load(testConfig{}); err == nil {
+		t.Errorf("Load() of the value returns no error")
+	}
+}
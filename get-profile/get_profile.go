@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	basicLambda "github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/aws"
@@ -9,14 +8,15 @@ import (
 	"os"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"encoding/json"
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/ringoid/commons"
-	"strings"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"strconv"
+	"time"
 )
 
 var anlogger *commons.Logger
@@ -26,50 +26,43 @@ var awsKinesisClient *kinesis.Kinesis
 
 var deliveryStreamName string
 var userProfileTable string
+var userSettingsTable string
 var secretWord string
 var commonStreamName string
 
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable   string `env:"USER_PROFILE_TABLE" validate:"required"`
+	UserSettingsTable  string `env:"USER_SETTINGS_TABLE" validate:"required"`
+	CommonStreamName   string `env:"COMMON_STREAM" validate:"required"`
+	DeliveryStreamName string `env:"DELIVERY_STREAM" validate:"required"`
+}
+
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : get_profile.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : get_profile.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : get_profile.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : get_profile.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : get_profile.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : get_profile.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "get-profile-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "get-profile-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : get_profile.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : get_profile.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : get_profile.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : get_profile.go : env can not be empty USER_PROFILE_TABLE")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : get_profile.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
-
-	commonStreamName, ok = os.LookupEnv("COMMON_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : get_profile.go : env can not be empty COMMON_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : get_profile.go : start with DELIVERY_STREAM = [%s]", commonStreamName)
+	userProfileTable = cfg.UserProfileTable
+	userSettingsTable = cfg.UserSettingsTable
+	commonStreamName = cfg.CommonStreamName
+	deliveryStreamName = cfg.DeliveryStreamName
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -79,6 +72,15 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : get_profile.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "get-profile-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : get_profile.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_profile.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
@@ -87,72 +89,22 @@ func init() {
 	awsKinesisClient = kinesis.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : get_profile.go : kinesis client was successfully initialized")
 
-	deliveryStreamName, ok = os.LookupEnv("DELIVERY_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : get_profile.go : env can not be empty DELIVERY_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : get_profile.go : start with DELIVERY_STREAM = [%s]", deliveryStreamName)
-
 	awsDeliveryStreamClient = firehose.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : get_profile.go : firehose client was successfully initialized")
 }
 
-func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
-	lc, _ := lambdacontext.FromContext(ctx)
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	anlogger.Debugf(req.Lc, "get_profile.go : debug print %v %v %v %v", req.SourceIp, req.AppVersion, req.IsItAndroid, req.UserId)
 
-	userAgent := request.Headers["user-agent"]
-	if strings.HasPrefix(userAgent, "ELB-HealthChecker") {
-		return commons.NewServiceResponse("{}"), nil
+	resp, authErr := getUserProfile(req.UserId, userProfileTable, req.Lc)
+	if authErr != nil {
+		return nil, authErr
 	}
-
-	if request.HTTPMethod != "GET" {
-		return commons.NewWrongHttpMethodServiceResponse(), nil
-	}
-	sourceIp := request.Headers["x-forwarded-for"]
-
-	anlogger.Debugf(lc, "get_profile.go : start handle request %v", request)
-
-	appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(request.Headers, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "get_profile.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	accessToken, ok := request.QueryStringParameters["accessToken"]
-	if !ok {
-		errStr = commons.WrongRequestParamsClientError
-		anlogger.Errorf(lc, "get_profile.go : accessToken is nil or empty")
-		anlogger.Errorf(lc, "get_profile.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	userId, _, _, ok, errStr := commons.Login(appVersion, isItAndroid, accessToken, secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "get_profile.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	anlogger.Debugf(lc, "get_profile.go : debug print %v %v %v %v", sourceIp, appVersion, isItAndroid, userId)
-
-	resp, ok, errStr := getUserProfile(userId, userProfileTable, lc)
-	if !ok {
-		anlogger.Errorf(lc, "get_profile.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	body, err := json.Marshal(resp)
-	if err != nil {
-		anlogger.Errorf(lc, "get_profile.go : error while marshaling resp object : %v", err)
-		return commons.NewServiceResponse(commons.InternalServerError), nil
-	}
-	anlogger.Debugf(lc, "get_profile.go : return body=%s", string(body))
-
-	return commons.NewServiceResponse(string(body)), nil
+	return resp, nil
 }
 
-//return profile, ok and error string
-func getUserProfile(userId, userProfileTableName string, lc *lambdacontext.LambdaContext) (*apimodel.GetProfileResponse, bool, string) {
+//return profile and error if something went wrong
+func getUserProfile(userId, userProfileTableName string, lc *lambdacontext.LambdaContext) (*apimodel.GetProfileResponse, *apimodel.AuthError) {
 	anlogger.Debugf(lc, "get_profile.go : start fetch user profile for userId [%s]", userId)
 
 	input := &dynamodb.GetItemInput{
@@ -168,148 +120,157 @@ func getUserProfile(userId, userProfileTableName string, lc *lambdacontext.Lambd
 	result, err := awsDbClient.GetItem(input)
 	if err != nil {
 		anlogger.Errorf(lc, "get_profile.go : error get user profile for userId [%s] : %v", userId, err)
-		return nil, false, commons.InternalServerError
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	if len(result.Item) == 0 {
 		anlogger.Errorf(lc, "get_profile.go : there is no user profile for userId [%s]", userId)
-		return nil, false, commons.InternalServerError
+		return nil, apimodel.ErrInternalServer
 	}
 
 	profile := apimodel.GetProfileResponse{}
 
-	customerId, ok, errStr := getStringValueProfileProperty(userId, commons.CustomerIdColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	customerId, authErr := getStringValueProfileProperty(userId, commons.CustomerIdColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.CustomerId = customerId
 
-	yearOfBirth, ok, errStr := getIntValueProfileProperty(userId, commons.YearOfBirthColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	yearOfBirth, authErr := getIntValueProfileProperty(userId, commons.YearOfBirthColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.YearOfBirth = yearOfBirth
 
-	sex, ok, errStr := getStringValueProfileProperty(userId, commons.SexColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	sex, authErr := getStringValueProfileProperty(userId, commons.SexColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.Sex = sex
 
-	profile.LastOnlineText = "Online"
-	profile.LastOnlineFlag = "online"
+	lastOnlineTime, authErr := getInt64ValueProfileProperty(userId, commons.LastOnlineTimeColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	locale, location, authErr := getUserLocale(userId, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	profile.LastOnlineFlag, profile.LastOnlineText = apimodel.LastOnline(lastOnlineTime, time.Now(), location, locale)
 	profile.DistanceText = "unknown"
 
-	property, ok, errStr := getIntValueProfileProperty(userId, commons.UserProfilePropertyColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	property, authErr := getIntValueProfileProperty(userId, commons.UserProfilePropertyColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.Property = property
 
-	transport, ok, errStr := getIntValueProfileProperty(userId, commons.UserProfileTransportColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	transport, authErr := getIntValueProfileProperty(userId, commons.UserProfileTransportColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.Transport = transport
 
-	income, ok, errStr := getIntValueProfileProperty(userId, commons.UserProfileIncomeColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	income, authErr := getIntValueProfileProperty(userId, commons.UserProfileIncomeColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.Income = income
 
-	height, ok, errStr := getIntValueProfileProperty(userId, commons.UserProfileHeightColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	height, authErr := getIntValueProfileProperty(userId, commons.UserProfileHeightColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.Height = height
 
-	educationLevel, ok, errStr := getIntValueProfileProperty(userId, commons.UserProfileEducationLevelColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	educationLevel, authErr := getIntValueProfileProperty(userId, commons.UserProfileEducationLevelColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.EducationLevel = educationLevel
 
-	hairColor, ok, errStr := getIntValueProfileProperty(userId, commons.UserProfileHairColorColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	hairColor, authErr := getIntValueProfileProperty(userId, commons.UserProfileHairColorColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.HairColor = hairColor
 
-	children, ok, errStr := getIntValueProfileProperty(userId, commons.UserProfileChildrenColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	children, authErr := getIntValueProfileProperty(userId, commons.UserProfileChildrenColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.Children = children
 
-	name, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileNameColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	name, authErr := getStringValueProfileProperty(userId, commons.UserProfileNameColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.Name = name
 
-	jobTitle, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileJobTitleColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	jobTitle, authErr := getStringValueProfileProperty(userId, commons.UserProfileJobTitleColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.JobTitle = jobTitle
 
-	company, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileCompanyColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	company, authErr := getStringValueProfileProperty(userId, commons.UserProfileCompanyColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.Company = company
 
-	eduText, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileEducationTextColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	eduText, authErr := getStringValueProfileProperty(userId, commons.UserProfileEducationTextColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.EducationText = eduText
 
-	about, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileAboutColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	about, authErr := getStringValueProfileProperty(userId, commons.UserProfileAboutColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.About = about
 
-	instagram, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileInstagramColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	instagram, authErr := getStringValueProfileProperty(userId, commons.UserProfileInstagramColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.Instagram = instagram
 
-	tiktok, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileTikTokColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	tiktok, authErr := getStringValueProfileProperty(userId, commons.UserProfileTikTokColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.TikTok = tiktok
 
-	wIlive, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileWhereILiveColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	wIlive, authErr := getStringValueProfileProperty(userId, commons.UserProfileWhereILiveColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.WhereLive = wIlive
 
-	wIFrom, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileWhereIFromColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	wIFrom, authErr := getStringValueProfileProperty(userId, commons.UserProfileWhereIFromColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.WhereFrom = wIFrom
 
-	sText, ok, errStr := getStringValueProfileProperty(userId, commons.UserProfileStatusTextColumnName, result, lc)
-	if !ok {
-		return nil, false, errStr
+	sText, authErr := getStringValueProfileProperty(userId, commons.UserProfileStatusTextColumnName, result, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 	profile.StatusText = sText
 
+	profile.Version = apimodel.VersionFromAttributes(result.Item)
+
 	anlogger.Debugf(lc, "get_profile.go : successfully get user profile [%v] for userId [%s]", profile, userId)
 
 	anlogger.Infof(lc, "get_profile.go : successfully get user profile for userId [%s]", userId)
-	return &profile, true, ""
+	return &profile, nil
 }
 
-//return int value, ok and error string
-func getIntValueProfileProperty(userId, propertyName string, result *dynamodb.GetItemOutput, lc *lambdacontext.LambdaContext) (int, bool, string) {
+//return int value and error if something went wrong
+func getIntValueProfileProperty(userId, propertyName string, result *dynamodb.GetItemOutput, lc *lambdacontext.LambdaContext) (int, *apimodel.AuthError) {
 	profilePropertyP, ok := result.Item[propertyName]
 	if ok {
 		if profilePropertyP.N != nil {
@@ -317,25 +278,101 @@ func getIntValueProfileProperty(userId, propertyName string, result *dynamodb.Ge
 			if err != nil {
 				anlogger.Errorf(lc, "get_profile.go : can not convert [%s] to int property (name is [%s]) for userId [%s]",
 					*profilePropertyP.N, propertyName, userId)
-				return -1, false, commons.InternalServerError
+				return -1, apimodel.ErrInternalServer.Wrap(err)
+			}
+			return intV, nil
+		}
+	}
+	return 0, nil
+}
+
+//return int64 value (e.g. unix time in millis) and error if something went wrong
+func getInt64ValueProfileProperty(userId, propertyName string, result *dynamodb.GetItemOutput, lc *lambdacontext.LambdaContext) (int64, *apimodel.AuthError) {
+	profilePropertyP, ok := result.Item[propertyName]
+	if ok {
+		if profilePropertyP.N != nil {
+			intV, err := strconv.ParseInt(*profilePropertyP.N, 10, 64)
+			if err != nil {
+				anlogger.Errorf(lc, "get_profile.go : can not convert [%s] to int64 property (name is [%s]) for userId [%s]",
+					*profilePropertyP.N, propertyName, userId)
+				return -1, apimodel.ErrInternalServer.Wrap(err)
 			}
-			return intV, true, ""
+			return intV, nil
 		}
 	}
-	return 0, true, ""
+	return 0, nil
+}
+
+//return locale and time zone location from user settings (defaults if there are no settings) and error if something went wrong
+func getUserLocale(userId string, lc *lambdacontext.LambdaContext) (string, *time.Location, *apimodel.AuthError) {
+	anlogger.Debugf(lc, "get_profile.go : start fetch locale for userId [%s]", userId)
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:            aws.String(userSettingsTable),
+		ProjectionExpression: aws.String("#locale, #timeZone, #timeZoneName"),
+		ExpressionAttributeNames: map[string]*string{
+			"#locale":       aws.String(commons.LocaleColumnName),
+			"#timeZone":     aws.String(commons.TimeZoneColumnName),
+			"#timeZoneName": aws.String(apimodel.TimeZoneNameColumnName),
+		},
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "get_profile.go : error get user settings for userId [%s] : %v", userId, err)
+		return "", nil, apimodel.ErrInternalServer.Wrap(err)
+	}
+
+	locale := apimodel.DefaultLocale
+	if value, ok := result.Item[commons.LocaleColumnName]; ok && value.S != nil && *value.S != "" {
+		locale = *value.S
+	}
+
+	timeZone := 0
+	if value, ok := result.Item[commons.TimeZoneColumnName]; ok && value.N != nil {
+		timeZone, err = strconv.Atoi(*value.N)
+		if err != nil {
+			anlogger.Errorf(lc, "get_profile.go : can not convert time zone [%s] to int for userId [%s] : %v", *value.N, userId, err)
+			timeZone = 0
+		}
+	}
+
+	timeZoneName := ""
+	if value, ok := result.Item[apimodel.TimeZoneNameColumnName]; ok && value.S != nil {
+		timeZoneName = *value.S
+	}
+
+	anlogger.Debugf(lc, "get_profile.go : successfully fetch locale [%s] and time zone [%s] [%d] for userId [%s]", locale, timeZoneName, timeZone, userId)
+	return locale, apimodel.UserLocation(timeZoneName, timeZone), nil
 }
 
-//return string value, ok and error string
-func getStringValueProfileProperty(userId, propertyName string, result *dynamodb.GetItemOutput, lc *lambdacontext.LambdaContext) (string, bool, string) {
+//return string value and error if something went wrong
+func getStringValueProfileProperty(userId, propertyName string, result *dynamodb.GetItemOutput, lc *lambdacontext.LambdaContext) (string, *apimodel.AuthError) {
 	profilePropertyP, ok := result.Item[propertyName]
 	if ok {
 		if profilePropertyP.S != nil {
-			return *profilePropertyP.S, true, ""
+			return *profilePropertyP.S, nil
 		}
 	}
-	return "unknown", true, ""
+	return "unknown", nil
 }
 
 func main() {
-	basicLambda.Start(handler)
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("GET"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Raw.QueryStringParameters["accessToken"] },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
 }
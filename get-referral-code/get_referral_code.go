@@ -0,0 +1,227 @@
+package main
+
+import (
+	basicLambda "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+	"os"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/ringoid/commons"
+	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+var anlogger *commons.Logger
+var awsDbClient *dynamodb.DynamoDB
+var awsKinesisClient *kinesis.Kinesis
+
+var userProfileTable string
+var referralCodesTable string
+var secretWord string
+var commonStreamName string
+
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable   string `env:"USER_PROFILE_TABLE" validate:"required"`
+	ReferralCodesTable string `env:"REFERRAL_CODES_TABLE" validate:"required"`
+	CommonStreamName   string `env:"COMMON_STREAM" validate:"required"`
+}
+
+func init() {
+	var env string
+	var err error
+	var awsSession *session.Session
+
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : get_referral_code.go : %v\n", err)
+		os.Exit(1)
+	}
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : get_referral_code.go : start with config %+v\n", cfg)
+
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "get-referral-code-auth"), apimodel.IsDebugLogEnabled)
+	if err != nil {
+		fmt.Printf("lambda-initialization : get_referral_code.go : error during startup : %v\n", err)
+		os.Exit(1)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_code.go : logger was successfully initialized")
+
+	userProfileTable = cfg.UserProfileTable
+	referralCodesTable = cfg.ReferralCodesTable
+	commonStreamName = cfg.CommonStreamName
+
+	awsSession, err = session.NewSession(aws.NewConfig().
+		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
+		WithLogger(aws.LoggerFunc(func(args ...interface{}) { anlogger.AwsLog(args) })).WithLogLevel(aws.LogOff))
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : get_referral_code.go : error during initialization : %v", err)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_code.go : aws session was successfully initialized")
+
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "get-referral-code-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : get_referral_code.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_code.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
+	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
+
+	awsDbClient = dynamodb.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_code.go : dynamodb client was successfully initialized")
+
+	awsKinesisClient = kinesis.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_code.go : kinesis client was successfully initialized")
+}
+
+//how many times we try to generate unique code
+const maxGenerateAttempts = 5
+
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	userId := req.UserId
+
+	code, authErr := getOwnReferralCode(userId, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	if code != "" {
+		return apimodel.GetReferralCodeResponse{ReferralCode: code}, nil
+	}
+
+	code, authErr = issueOwnReferralCode(userId, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	return apimodel.GetReferralCodeResponse{ReferralCode: code}, nil
+}
+
+//return code of the user (empty string if the code was not issued yet) and error if something went wrong
+func getOwnReferralCode(userId string, lc *lambdacontext.LambdaContext) (string, *apimodel.AuthError) {
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:            aws.String(userProfileTable),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#ownCode"),
+		ExpressionAttributeNames: map[string]*string{
+			"#ownCode": aws.String(apimodel.OwnReferralCodeColumnName),
+		},
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "get_referral_code.go : error get own referral code for userId [%s] : %v", userId, err)
+		return "", apimodel.ErrInternalServer.Wrap(err)
+	}
+
+	if value, ok := result.Item[apimodel.OwnReferralCodeColumnName]; ok && value.S != nil {
+		return *value.S, nil
+	}
+	return "", nil
+}
+
+//return issued code and error if something went wrong
+func issueOwnReferralCode(userId string, lc *lambdacontext.LambdaContext) (string, *apimodel.AuthError) {
+	anlogger.Debugf(lc, "get_referral_code.go : issue own referral code for userId [%s]", userId)
+
+	for i := 0; i < maxGenerateAttempts; i++ {
+		code, err := apimodel.GenerateReferralCode()
+		if err != nil {
+			anlogger.Errorf(lc, "get_referral_code.go : error generate referral code for userId [%s] : %v", userId, err)
+			return "", apimodel.ErrInternalServer.Wrap(err)
+		}
+
+		issued, authErr := apimodel.IssueReferralCode(apimodel.ReferralCode{
+			Code:      code,
+			OwnerType: apimodel.ReferralCodeOwnerUser,
+			OwnerId:   userId,
+		}, referralCodesTable, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return "", authErr
+		}
+		if !issued {
+			continue
+		}
+
+		saved, authErr := saveOwnReferralCode(userId, code, lc)
+		if authErr != nil {
+			return "", authErr
+		}
+		if saved {
+			anlogger.Infof(lc, "get_referral_code.go : successfully issue own referral code [%s] for userId [%s]", code, userId)
+			return code, nil
+		}
+
+		//parallel request was faster, so keep its code
+		authErr = apimodel.DeleteReferralCode(code, referralCodesTable, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return "", authErr
+		}
+		return getOwnReferralCode(userId, lc)
+	}
+
+	anlogger.Errorf(lc, "get_referral_code.go : can not generate unique referral code for userId [%s] in [%d] attempts", userId, maxGenerateAttempts)
+	return "", apimodel.ErrInternalServer
+}
+
+//return false if the user already has a code and error if something went wrong
+func saveOwnReferralCode(userId, code string, lc *lambdacontext.LambdaContext) (bool, *apimodel.AuthError) {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#ownCode": aws.String(apimodel.OwnReferralCodeColumnName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":ownCodeV": {
+				S: aws.String(code),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		ConditionExpression: aws.String(fmt.Sprintf("attribute_exists(%s) AND attribute_not_exists(#ownCode)", commons.UserIdColumnName)),
+		TableName:           aws.String(userProfileTable),
+		UpdateExpression:    aws.String("SET #ownCode = :ownCodeV"),
+	}
+
+	_, err := awsDbClient.UpdateItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			anlogger.Warnf(lc, "get_referral_code.go : userId [%s] already has own referral code", userId)
+			return false, nil
+		}
+		anlogger.Errorf(lc, "get_referral_code.go : error save own referral code [%s] for userId [%s] : %v", code, userId, err)
+		return false, apimodel.ErrInternalServer.Wrap(err)
+	}
+	return true, nil
+}
+
+func main() {
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("GET"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Raw.QueryStringParameters["accessToken"] },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
+}
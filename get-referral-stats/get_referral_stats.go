@@ -0,0 +1,152 @@
+package main
+
+import (
+	basicLambda "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+	"os"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/ringoid/commons"
+	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"strconv"
+)
+
+var anlogger *commons.Logger
+var awsDbClient *dynamodb.DynamoDB
+var awsKinesisClient *kinesis.Kinesis
+
+var userProfileTable string
+var referralRewardRules []apimodel.ReferralRewardRule
+var secretWord string
+var commonStreamName string
+
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable string `env:"USER_PROFILE_TABLE" validate:"required"`
+	CommonStreamName string `env:"COMMON_STREAM" validate:"required"`
+	//see apimodel.ParseReferralRewardRules
+	ReferralRewardRules string `env:"REFERRAL_REWARD_RULES"`
+}
+
+func init() {
+	var env string
+	var err error
+	var awsSession *session.Session
+
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : get_referral_stats.go : %v\n", err)
+		os.Exit(1)
+	}
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : get_referral_stats.go : start with config %+v\n", cfg)
+
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "get-referral-stats-auth"), apimodel.IsDebugLogEnabled)
+	if err != nil {
+		fmt.Printf("lambda-initialization : get_referral_stats.go : error during startup : %v\n", err)
+		os.Exit(1)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_stats.go : logger was successfully initialized")
+
+	userProfileTable = cfg.UserProfileTable
+	commonStreamName = cfg.CommonStreamName
+
+	referralRewardRules, err = apimodel.ParseReferralRewardRules(cfg.ReferralRewardRules)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : get_referral_stats.go : error parse referral reward rules : %v", err)
+	}
+
+	awsSession, err = session.NewSession(aws.NewConfig().
+		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
+		WithLogger(aws.LoggerFunc(func(args ...interface{}) { anlogger.AwsLog(args) })).WithLogLevel(aws.LogOff))
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : get_referral_stats.go : error during initialization : %v", err)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_stats.go : aws session was successfully initialized")
+
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "get-referral-stats-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : get_referral_stats.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_stats.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
+	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
+
+	awsDbClient = dynamodb.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_stats.go : dynamodb client was successfully initialized")
+
+	awsKinesisClient = kinesis.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_referral_stats.go : kinesis client was successfully initialized")
+}
+
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	userId := req.UserId
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:            aws.String(userProfileTable),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#ownCode, #referralsCount"),
+		ExpressionAttributeNames: map[string]*string{
+			"#ownCode":        aws.String(apimodel.OwnReferralCodeColumnName),
+			"#referralsCount": aws.String(apimodel.ReferralsCountColumnName),
+		},
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "get_referral_stats.go : error get referral stats for userId [%s] : %v", userId, err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
+	}
+
+	resp := apimodel.GetReferralStatsResponse{Rewards: make([]apimodel.ReferralRewardStatus, 0, len(referralRewardRules))}
+	if value, ok := result.Item[apimodel.OwnReferralCodeColumnName]; ok && value.S != nil {
+		resp.ReferralCode = *value.S
+	}
+	if value, ok := result.Item[apimodel.ReferralsCountColumnName]; ok && value.N != nil {
+		resp.JoinedCount, err = strconv.Atoi(*value.N)
+		if err != nil {
+			anlogger.Errorf(lc, "get_referral_stats.go : can not convert referrals count [%s] for userId [%s] : %v", *value.N, userId, err)
+			return nil, apimodel.ErrInternalServer.Wrap(err)
+		}
+	}
+
+	for _, rule := range referralRewardRules {
+		resp.Rewards = append(resp.Rewards, apimodel.ReferralRewardStatus{
+			ReferralRewardRule: rule,
+			Earned:             resp.JoinedCount >= rule.Threshold,
+		})
+	}
+
+	anlogger.Debugf(lc, "get_referral_stats.go : successfully get referral stats %v for userId [%s]", resp, userId)
+	return resp, nil
+}
+
+func main() {
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("GET"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Raw.QueryStringParameters["accessToken"] },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
+}
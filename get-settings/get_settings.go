@@ -0,0 +1,205 @@
+package main
+
+import (
+	basicLambda "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+	"os"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/ringoid/commons"
+	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"strconv"
+	"time"
+)
+
+var anlogger *commons.Logger
+var awsDbClient *dynamodb.DynamoDB
+var awsKinesisClient *kinesis.Kinesis
+
+var userProfileTable string
+var userSettingsTable string
+var secretWord string
+var commonStreamName string
+
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable  string `env:"USER_PROFILE_TABLE" validate:"required"`
+	UserSettingsTable string `env:"USER_SETTINGS_TABLE" validate:"required"`
+	CommonStreamName  string `env:"COMMON_STREAM" validate:"required"`
+}
+
+func init() {
+	var env string
+	var err error
+	var awsSession *session.Session
+
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : get_settings.go : %v\n", err)
+		os.Exit(1)
+	}
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : get_settings.go : start with config %+v\n", cfg)
+
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "get-settings-auth"), apimodel.IsDebugLogEnabled)
+	if err != nil {
+		fmt.Printf("lambda-initialization : get_settings.go : error during startup : %v\n", err)
+		os.Exit(1)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : get_settings.go : logger was successfully initialized")
+
+	userProfileTable = cfg.UserProfileTable
+	userSettingsTable = cfg.UserSettingsTable
+	commonStreamName = cfg.CommonStreamName
+
+	awsSession, err = session.NewSession(aws.NewConfig().
+		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
+		WithLogger(aws.LoggerFunc(func(args ...interface{}) { anlogger.AwsLog(args) })).WithLogLevel(aws.LogOff))
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : get_settings.go : error during initialization : %v", err)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : get_settings.go : aws session was successfully initialized")
+
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "get-settings-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : get_settings.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_settings.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
+	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
+
+	awsDbClient = dynamodb.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_settings.go : dynamodb client was successfully initialized")
+
+	awsKinesisClient = kinesis.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : get_settings.go : kinesis client was successfully initialized")
+}
+
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	resp, authErr := getUserSettings(req.UserId, req.Lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	return resp, nil
+}
+
+//return settings (defaults for missing attributes) and error if something went wrong
+func getUserSettings(userId string, lc *lambdacontext.LambdaContext) (*apimodel.GetSettingsResponse, *apimodel.AuthError) {
+	anlogger.Debugf(lc, "get_settings.go : start fetch user settings for userId [%s]", userId)
+
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:      aws.String(userSettingsTable),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "get_settings.go : error get user settings for userId [%s] : %v", userId, err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
+	}
+
+	if len(result.Item) == 0 {
+		anlogger.Warnf(lc, "get_settings.go : there are no user settings for userId [%s], return defaults", userId)
+	}
+
+	settings := apimodel.DefaultSettings()
+
+	if value, ok := result.Item[commons.LocaleColumnName]; ok && value.S != nil && *value.S != "" {
+		settings.Locale = *value.S
+	}
+
+	timeZone, authErr := getIntValue(userId, commons.TimeZoneColumnName, settings.TimeZone, result, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	settings.TimeZone = timeZone
+
+	if value, ok := result.Item[apimodel.TimeZoneNameColumnName]; ok && value.S != nil {
+		settings.TimeZoneName = *value.S
+	}
+
+	quietHoursStart, authErr := getIntValue(userId, apimodel.QuietHoursStartColumnName, settings.QuietHoursStart, result, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	settings.QuietHoursStart = quietHoursStart
+
+	quietHoursEnd, authErr := getIntValue(userId, apimodel.QuietHoursEndColumnName, settings.QuietHoursEnd, result, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	settings.QuietHoursEnd = quietHoursEnd
+
+	setBoolValue(&settings.Push, commons.PushColumnName, result)
+	setBoolValue(&settings.PushNewLike, commons.PushNewLikeColumnName, result)
+	setBoolValue(&settings.PushNewMatch, commons.PushNewMatchColumnName, result)
+	setBoolValue(&settings.PushNewMessage, commons.PushNewMessageColumnName, result)
+	setBoolValue(&settings.PushVibration, commons.PushVibrationColumnName, result)
+	setBoolValue(&settings.QuietHours, apimodel.QuietHoursColumnName, result)
+	setBoolValue(&settings.DigestNewLike, apimodel.DigestNewLikeColumnName, result)
+	setBoolValue(&settings.DigestNewMatch, apimodel.DigestNewMatchColumnName, result)
+	setBoolValue(&settings.DigestNewMessage, apimodel.DigestNewMessageColumnName, result)
+
+	resp := apimodel.GetSettingsResponse{
+		Settings:       *settings,
+		TimeZoneOffset: apimodel.TimeZoneOffset(apimodel.UserLocation(settings.TimeZoneName, settings.TimeZone), time.Now()),
+		Version:        apimodel.VersionFromAttributes(result.Item),
+	}
+
+	anlogger.Debugf(lc, "get_settings.go : successfully get user settings [%v] for userId [%s]", resp, userId)
+
+	anlogger.Infof(lc, "get_settings.go : successfully get user settings for userId [%s]", userId)
+	return &resp, nil
+}
+
+//return int value (defaultValue if there is no such attribute) and error if something went wrong
+func getIntValue(userId, columnName string, defaultValue int, result *dynamodb.GetItemOutput, lc *lambdacontext.LambdaContext) (int, *apimodel.AuthError) {
+	value, ok := result.Item[columnName]
+	if !ok || value.N == nil {
+		return defaultValue, nil
+	}
+	intV, err := strconv.Atoi(*value.N)
+	if err != nil {
+		anlogger.Errorf(lc, "get_settings.go : can not convert [%s] to int property (name is [%s]) for userId [%s]", *value.N, columnName, userId)
+		return 0, apimodel.ErrInternalServer.Wrap(err)
+	}
+	return intV, nil
+}
+
+//keep the default if there is no such attribute
+func setBoolValue(target *bool, columnName string, result *dynamodb.GetItemOutput) {
+	value, ok := result.Item[columnName]
+	if ok && value.BOOL != nil {
+		*target = *value.BOOL
+	}
+}
+
+func main() {
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("GET"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Raw.QueryStringParameters["accessToken"] },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
+}
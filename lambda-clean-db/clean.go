@@ -12,26 +12,47 @@ import (
 	"errors"
 	"github.com/ringoid/commons"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var anlogger *commons.Logger
 var awsDbClient *dynamodb.DynamoDB
 var userProfileTable string
 var userSettingsTable string
+var pushTokensTable string
+var referralCodesTable string
+var referralLedgerTable string
+var processedRecordsTable string
+
+//key of ProcessedRecords table, see lambda-handle-stream/dedup.go
+const processedRecordIdColumnName = "record_id"
+
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable      string `env:"USER_PROFILE_TABLE" validate:"required"`
+	UserSettingsTable     string `env:"USER_SETTINGS_TABLE" validate:"required"`
+	PushTokensTable       string `env:"PUSH_TOKENS_TABLE" validate:"required"`
+	ReferralCodesTable    string `env:"REFERRAL_CODES_TABLE" validate:"required"`
+	ReferralLedgerTable   string `env:"REFERRAL_LEDGER_TABLE" validate:"required"`
+	ProcessedRecordsTable string `env:"PROCESSED_RECORDS_TABLE" validate:"required"`
+}
 
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : clean.go : env can not be empty ENV\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : clean.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : clean.go : start with ENV = [%s]\n", env)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : clean.go : start with config %+v\n", cfg)
 
 	//!!!START : VERY IMPORTANT CODE. NEVER DELETE OR MODIFY!!!
 	if env != "test" {
@@ -39,33 +60,19 @@ func init() {
 	}
 	//!!!END : VERY IMPORTANT CODE. NEVER DELETE OR MODIFY!!!
 
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : clean.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : clean.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
-
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "internal-clean-db-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "internal-clean-db-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : clean.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : clean.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : clean.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		fmt.Printf("lambda-initialization : clean.go : env can not be empty USER_PROFILE_TABLE")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : clean.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
-
-	userSettingsTable, ok = os.LookupEnv("USER_SETTINGS_TABLE")
-	if !ok {
-		fmt.Printf("lambda-initialization : clean.go : env can not be empty USER_SETTINGS_TABLE")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : clean.go : start with USER_SETTINGS_TABLE = [%s]", userSettingsTable)
+	userProfileTable = cfg.UserProfileTable
+	userSettingsTable = cfg.UserSettingsTable
+	pushTokensTable = cfg.PushTokensTable
+	referralCodesTable = cfg.ReferralCodesTable
+	referralLedgerTable = cfg.ReferralLedgerTable
+	processedRecordsTable = cfg.ProcessedRecordsTable
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -75,24 +82,52 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : clean.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "internal-clean-db-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : clean.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : clean.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : clean.go : dynamodb client was successfully initialized")
 }
 
 func handler(ctx context.Context) error {
 	lc, _ := lambdacontext.FromContext(ctx)
-	err := eraseTable(userProfileTable, commons.UserIdColumnName, lc)
+	ctx, span := tracing.StartInvocation(ctx, trace.SpanKindInternal)
+	defer span.End()
+	err := eraseTable(userProfileTable, []string{commons.UserIdColumnName}, lc)
+	if err != nil {
+		return err
+	}
+	err = eraseTable(userSettingsTable, []string{commons.PhoneColumnName}, lc)
+	if err != nil {
+		return err
+	}
+	err = eraseTable(pushTokensTable, []string{commons.UserIdColumnName}, lc)
 	if err != nil {
 		return err
 	}
-	err = eraseTable(userSettingsTable, commons.PhoneColumnName, lc)
+	err = eraseTable(referralCodesTable, []string{apimodel.ReferralCodeColumnName}, lc)
+	if err != nil {
+		return err
+	}
+	err = eraseTable(referralLedgerTable, []string{apimodel.ReferralLedgerReferrerIdColumnName, apimodel.ReferralLedgerRefereeIdColumnName}, lc)
+	if err != nil {
+		return err
+	}
+	err = eraseTable(processedRecordsTable, []string{processedRecordIdColumnName}, lc)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func eraseTable(tableName, idColumnName string, lc *lambdacontext.LambdaContext) error {
+//keyColumnNames are hash key and range key (if the table has it)
+func eraseTable(tableName string, keyColumnNames []string, lc *lambdacontext.LambdaContext) error {
 	anlogger.Debugf(lc, "clean.go : start clean [%s] table", tableName)
 	var lastEvaluatedKey map[string]*dynamodb.AttributeValue
 	for {
@@ -107,13 +142,12 @@ func eraseTable(tableName, idColumnName string, lc *lambdacontext.LambdaContext)
 		}
 		items := scanResult.Items
 		for _, item := range items {
-			id := item[idColumnName].S
+			key := make(map[string]*dynamodb.AttributeValue, len(keyColumnNames))
+			for _, keyColumnName := range keyColumnNames {
+				key[keyColumnName] = item[keyColumnName]
+			}
 			deleteInput := &dynamodb.DeleteItemInput{
-				Key: map[string]*dynamodb.AttributeValue{
-					idColumnName: {
-						S: id,
-					},
-				},
+				Key:       key,
 				TableName: aws.String(tableName),
 			}
 			_, err = awsDbClient.DeleteItem(deleteInput)
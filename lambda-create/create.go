@@ -2,9 +2,11 @@ package main
 
 import (
 	"github.com/ringoid/commons"
-	"context"
 	basicLambda "github.com/aws/aws-lambda-go/lambda"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/firehose"
@@ -12,7 +14,6 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"encoding/json"
-	"github.com/aws/aws-lambda-go/events"
 	"time"
 	"strconv"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -21,8 +22,6 @@ import (
 	"crypto/sha1"
 	"github.com/satori/go.uuid"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/aws/aws-sdk-go/service/cloudwatch"
-	"strings"
 )
 
 var anlogger *commons.Logger
@@ -35,70 +34,64 @@ var secretWord string
 var commonStreamName string
 var awsKinesisClient *kinesis.Kinesis
 
-var baseCloudWatchNamespace string
 var newUserWasCreatedMetricName string
-var awsCWClient *cloudwatch.CloudWatch
 
 var emailAuthTable string
+var referralCodesTable string
+var referralLedgerTable string
+var referralRewardRules []apimodel.ReferralRewardRule
+var referralFraudConfig apimodel.ReferralFraudConfig
+
+type lambdaConfig struct {
+	config.Base
+	apimodel.ReferralFraudConfig
+	UserProfileTable            string `env:"USER_PROFILE_TABLE" validate:"required"`
+	UserSettingsTable           string `env:"USER_SETTINGS_TABLE" validate:"required"`
+	NewUserWasCreatedMetricName string `env:"CLOUD_WATCH_NEW_USER_WAS_CREATED" validate:"required"`
+	EmailAuthTable              string `env:"EMAIL_AUTH_TABLE" validate:"required"`
+	ReferralCodesTable          string `env:"REFERRAL_CODES_TABLE" validate:"required"`
+	ReferralLedgerTable         string `env:"REFERRAL_LEDGER_TABLE" validate:"required"`
+	DeliveryStreamName          string `env:"DELIVERY_STREAM" validate:"required"`
+	CommonStreamName            string `env:"COMMON_STREAM" validate:"required"`
+	//see apimodel.ParseReferralRewardRules
+	ReferralRewardRules string `env:"REFERRAL_REWARD_RULES"`
+}
 
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : create.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : create.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : create.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : create.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : create.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : create.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "create-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "create-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : create.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : create.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : create.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : create.go : env can not be empty USER_PROFILE_TABLE")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : create.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
-
-	userSettingsTable, ok = os.LookupEnv("USER_SETTINGS_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : create.go : env can not be empty USER_SETTINGS_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : create.go : start with USER_SETTINGS_TABLE = [%s]", userSettingsTable)
-
-	baseCloudWatchNamespace, ok = os.LookupEnv("BASE_CLOUD_WATCH_NAMESPACE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : create.go : env can not be empty BASE_CLOUD_WATCH_NAMESPACE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : create.go : start with BASE_CLOUD_WATCH_NAMESPACE = [%s]", baseCloudWatchNamespace)
-
-	newUserWasCreatedMetricName, ok = os.LookupEnv("CLOUD_WATCH_NEW_USER_WAS_CREATED")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : create.go : env can not be empty CLOUD_WATCH_NEW_USER_WAS_CREATED")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : create.go : start with CLOUD_WATCH_NEW_USER_WAS_CREATED = [%s]", newUserWasCreatedMetricName)
-
-	emailAuthTable, ok = os.LookupEnv("EMAIL_AUTH_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : create.go : env can not be empty EMAIL_AUTH_TABLE")
+	userProfileTable = cfg.UserProfileTable
+	userSettingsTable = cfg.UserSettingsTable
+	newUserWasCreatedMetricName = cfg.NewUserWasCreatedMetricName
+	emailAuthTable = cfg.EmailAuthTable
+	referralCodesTable = cfg.ReferralCodesTable
+	referralLedgerTable = cfg.ReferralLedgerTable
+	referralFraudConfig = cfg.ReferralFraudConfig
+	deliveryStreamName = cfg.DeliveryStreamName
+	commonStreamName = cfg.CommonStreamName
+
+	referralRewardRules, err = apimodel.ParseReferralRewardRules(cfg.ReferralRewardRules)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : create.go : error parse referral reward rules : %v", err)
 	}
-	anlogger.Debugf(nil, "lambda-initialization : create.go : start with EMAIL_AUTH_TABLE = [%s]", emailAuthTable)
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -108,118 +101,111 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : create.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "create-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : create.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : create.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : create.go : dynamodb client was successfully initialized")
 
-	deliveryStreamName, ok = os.LookupEnv("DELIVERY_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : create.go : env can not be empty DELIVERY_STREAM")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : create.go : start with DELIVERY_STREAM = [%s]", deliveryStreamName)
-
-	commonStreamName, ok = os.LookupEnv("COMMON_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : create.go : env can not be empty COMMON_STREAM")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : create.go : start with COMMON_STREAM = [%s]", commonStreamName)
-
 	awsDeliveryStreamClient = firehose.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : create.go : firehose client was successfully initialized")
 
 	awsKinesisClient = kinesis.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : create.go : kinesis client was successfully initialized")
-
-	awsCWClient = cloudwatch.New(awsSession)
-	anlogger.Debugf(nil, "lambda-initialization : create.go : cloudwatch client was successfully initialized")
 }
 
-func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
-	lc, _ := lambdacontext.FromContext(ctx)
-
-	userAgent := request.Headers["user-agent"]
-	if strings.HasPrefix(userAgent, "ELB-HealthChecker") {
-		return commons.NewServiceResponse("{}"), nil
-	}
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	reqParam := req.Params.(*apimodel.CreateReq)
+	sourceIp := req.SourceIp
+	appVersion := req.AppVersion
+	isItAndroid := req.IsItAndroid
 
-	if request.HTTPMethod != "POST" {
-		return commons.NewWrongHttpMethodServiceResponse(), nil
+	userId, authErr := generateUserId(sourceIp, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
-	sourceIp := request.Headers["x-forwarded-for"]
-
-	anlogger.Debugf(lc, "create.go : start handle request %v", request)
 
-	appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(request.Headers, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "create.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	var referralCode *apimodel.ReferralCode
+	if reqParam.ReferralId != apimodel.NoReferralCode {
+		referralCode, authErr = apimodel.CheckReferralCode(reqParam.ReferralId, userId, referralCodesTable, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
+		}
 	}
 
-	ok, errStr = commons.CheckAppVersion(appVersion, isItAndroid, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "create.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	//legacy clients send the campaign only as a code
+	if referralCode != nil && referralCode.OwnerType == apimodel.ReferralCodeOwnerCampaign && reqParam.Attribution.Campaign == "" {
+		reqParam.Attribution.Campaign = referralCode.OwnerId
 	}
 
-	reqParam, ok, errStr := parseParams(request.Body, lc)
-	if !ok {
-		anlogger.Errorf(lc, "create.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	fraudReasons, authErr := apimodel.CheckReferralFraud(referralCode, apimodel.ReferralParticipant{
+		UserId:   userId,
+		SourceIp: sourceIp,
+		Devices:  []string{apimodel.ReferralDevice(reqParam.DeviceModel, reqParam.OsVersion)},
+	}, referralFraudConfig, referralLedgerTable, userProfileTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
-
-	userId, ok, errStr := generateUserId(sourceIp, lc)
-	if !ok {
-		anlogger.Errorf(lc, "create.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	if len(fraudReasons) != 0 {
+		rejected := referralFraudConfig.Reject(fraudReasons)
+		fraudEvent := apimodel.NewReferralFraudDetectedEvent(userId, sourceIp, referralCode, fraudReasons, rejected)
+		commons.SendAnalyticEvent(fraudEvent, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
+		if rejected {
+			return nil, apimodel.ErrInvalidReferralCode
+		}
 	}
 
 	sessionId, err := uuid.NewV4()
 	if err != nil {
-		errStr := commons.InternalServerError
 		anlogger.Errorf(lc, "create.go : error while generate sessionId for userId [%s] : %v", userId, err)
-		anlogger.Errorf(lc, "create.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	customerId, err := uuid.NewV4()
 	if err != nil {
-		errStr := commons.InternalServerError
 		anlogger.Errorf(lc, "create.go : error while generate customerId : %v", err)
-		anlogger.Errorf(lc, "create.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	//todo:delete if later
 	//check email and start email login
 	if len(reqParam.Email) != 0 && reqParam.Email != "n/a" {
-		ok, errStr = tryUpdateAuthStatusToCreated(userId, reqParam.Email, reqParam.AuthSessionId, lc)
-		if !ok {
-			anlogger.Errorf(lc, "commons.go : return %s to client", errStr)
-			return commons.NewServiceResponse(errStr), nil
+		authErr = tryUpdateAuthStatusToCreated(userId, reqParam.Email, reqParam.AuthSessionId, lc)
+		if authErr != nil {
+			return nil, authErr
 		}
 	}
 
-	ok, errStr = createUserProfile(userId, sessionId.String(), customerId.String(), appVersion, isItAndroid, reqParam, lc)
-	if !ok {
-		anlogger.Errorf(lc, "commons.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	authErr = createUserProfile(userId, sessionId.String(), customerId.String(), sourceIp, appVersion, isItAndroid, reqParam, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
 	userSettings := apimodel.NewSettings(reqParam)
-	if userSettings.TimeZone < -12 || userSettings.TimeZone > 14 {
-		anlogger.Errorf(lc, "create.go : wrong timezone [%d], return %s to client", userSettings.TimeZone, commons.WrongRequestParamsClientError)
-		return commons.NewServiceResponse(commons.WrongRequestParamsClientError), nil
+	if userSettings.TimeZoneName != "" {
+		//name was validated in parseParams, legacy offset is kept for old consumers
+		location, err := apimodel.LoadTimeZone(userSettings.TimeZoneName)
+		if err == nil {
+			userSettings.TimeZone = apimodel.LegacyTimeZone(location, time.Now())
+		}
 	}
 
 	if isItAndroid {
 		userSettings.PushVibration = false
 	}
 
-	ok, errStr = createUserSettingsIntoDynamo(userId, userSettings, lc)
-	if !ok {
-		anlogger.Errorf(lc, "create.go : userId [%s], customerId [%s], return %s to client", userId, customerId, errStr)
-		return commons.NewServiceResponse(errStr), nil
+	authErr = createUserSettingsIntoDynamo(userId, userSettings, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
 	//send analytics events
@@ -230,31 +216,33 @@ func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.
 	commons.SendAnalyticEvent(eventAcceptTerms, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
 	eventNewUser := commons.NewUserProfileCreatedEvent(userId, reqParam.Email, reqParam.Sex, sourceIp, reqParam.ReferralId, reqParam.PrivateKey, reqParam.YearOfBirth)
-	commons.SendAnalyticEvent(eventNewUser, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
+	extendedEventNewUser := apimodel.ExtendCreatedEvent(eventNewUser, reqParam.Attribution, anlogger, lc)
+	commons.SendAnalyticEvent(extendedEventNewUser, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
 	settingsEvent := commons.NewUserSettingsUpdatedEvent(userId, sourceIp, userSettings.Locale, true,
 		userSettings.Push, userSettings.PushNewLike, userSettings.PushNewMatch, userSettings.PushNewMessage,
 		true, true, true, true,
 		userSettings.PushVibration, true,
 		userSettings.TimeZone, true)
-	commons.SendAnalyticEvent(settingsEvent, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
+	extendedSettingsEvent := apimodel.ExtendSettingsEvent(settingsEvent, userSettings.Patch().Changes(), time.Now())
+	commons.SendAnalyticEvent(extendedSettingsEvent, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
 	//send common events
 	partitionKey := userId
-	ok, errStr = commons.SendCommonEvent(eventNewUser, userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
+	ok, errStr := commons.SendCommonEvent(apimodel.TracedEvent(req.Ctx, extendedEventNewUser), userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
 	if !ok {
-		anlogger.Errorf(lc, "create.go : userId [%s], customerId [%s], return %s to client", userId, customerId, errStr)
-		return commons.NewServiceResponse(errStr), nil
+		return nil, apimodel.FromErrorString(errStr)
 	}
 
-	ok, errStr = commons.SendCommonEvent(settingsEvent, userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
+	ok, errStr = commons.SendCommonEvent(apimodel.TracedEvent(req.Ctx, extendedSettingsEvent), userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
 	if !ok {
-		anlogger.Errorf(lc, "create.go : userId [%s], customerId [%s], return %s to client", userId, customerId, errStr)
-		return commons.NewServiceResponse(errStr), nil
+		return nil, apimodel.FromErrorString(errStr)
 	}
 
-	//send cloudwatch metric
-	commons.SendCloudWatchMetric(baseCloudWatchNamespace, newUserWasCreatedMetricName, 1, awsCWClient, anlogger, lc)
+	apimodel.RecordReferralAfterCommit(req.Ctx, referralCode, userId, fraudReasons, referralLedgerTable, userProfileTable, referralRewardRules,
+		deliveryStreamName, commonStreamName, awsDbClient, awsDeliveryStreamClient, awsKinesisClient, anlogger, lc)
+
+	metrics.Count(newUserWasCreatedMetricName, nil)
 
 	//create access token
 	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
@@ -264,9 +252,8 @@ func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.
 
 	tokenToString, err := accessToken.SignedString([]byte(secretWord))
 	if err != nil {
-		errStr = commons.InternalServerError
-		anlogger.Errorf(lc, "create.go : error sign the token for userId [%s], customerId [%s], return %s to the client : %v", userId, customerId, errStr, err)
-		return commons.NewServiceResponse(errStr), nil
+		anlogger.Errorf(lc, "create.go : error sign the token for userId [%s], customerId [%s] : %v", userId, customerId, err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	resp := apimodel.CreateResp{
@@ -274,86 +261,88 @@ func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.
 		CustomerId:  customerId.String(),
 	}
 
-	body, err := json.Marshal(resp)
-	if err != nil {
-		anlogger.Errorf(lc, "create.go : error while marshaling resp object for userId [%s], customerId [%s] : %v", userId, customerId, err)
-		anlogger.Errorf(lc, "create.go : userId [%s], customerId [%s], return %s to client", userId, customerId, commons.InternalServerError)
-		return commons.NewServiceResponse(commons.InternalServerError), nil
-	}
 	anlogger.Infof(lc, "create.go : successfully create user and return access token for userId [%s], customerId [%s], sex [%s]",
 		userId, customerId, reqParam.Sex)
-	return commons.NewServiceResponse(string(body)), nil
+	return resp, nil
 }
 
-func parseParams(params string, lc *lambdacontext.LambdaContext) (*apimodel.CreateReq, bool, string) {
-	anlogger.Debugf(lc, "create.go : parse request body %s", params)
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
 	var req apimodel.CreateReq
 	err := json.Unmarshal([]byte(params), &req)
 	if err != nil {
-		anlogger.Errorf(lc, "create.go : error marshaling required params from the string [%s] : %v", params, err)
-		return nil, false, commons.InternalServerError
+		anlogger.Errorf(lc, "create.go : error marshaling required params from the string [%s] : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	if req.YearOfBirth < time.Now().UTC().Year()-150 {
 		anlogger.Errorf(lc, "create.go : wrong year of birth [%d] request param, req %v", req.YearOfBirth, req)
-		return nil, false, commons.WrongYearOfBirthClientError
+		return nil, apimodel.ErrWrongYearOfBirth
 	}
 
 	if req.Sex == "" || (req.Sex != "male" && req.Sex != "female") {
 		anlogger.Errorf(lc, "create.go : wrong sex [%s] request param, req %v", req.Sex, req)
-		return nil, false, commons.WrongSexClientError
+		return nil, apimodel.ErrWrongSex
 	}
 
 	if req.DateTimeTermsAndConditions <= 0 ||
 		req.DateTimePrivacyNotes <= 0 || req.DateTimeLegalAge <= 0 ||
 		req.DeviceModel == "" || req.OsVersion == "" {
 		anlogger.Errorf(lc, "create.go : one of the required param is nil, req %v", req)
-		return nil, false, commons.WrongRequestParamsClientError
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
-	req.ReferralId = strings.TrimSpace(req.ReferralId)
-	req.ReferralId = strings.ToLower(req.ReferralId)
+	req.ReferralId = apimodel.NormalizeReferralCode(req.ReferralId)
 
 	if req.ReferralId == "" {
-		req.ReferralId = "n/a"
+		req.ReferralId = apimodel.NoReferralCode
 	} else if len([]rune(req.ReferralId)) > apimodel.MaxReferralCodeLength {
 		anlogger.Errorf(lc, "create.go : too big referral id [%s], len [%d]", req.ReferralId, len([]rune(req.ReferralId)))
-		//return nil, false, commons.WrongRequestParamsClientError
+		return nil, apimodel.ErrInvalidReferralCode
+	}
+
+	if fieldErrors := req.Attribution.Validate(); len(fieldErrors) != 0 {
+		anlogger.Errorf(lc, "create.go : wrong attribution %v : %v", req.Attribution, fieldErrors)
+		return nil, apimodel.ErrWrongRequestParams.WithFieldErrors(fieldErrors)
+	}
+
+	if fieldErrors := req.AppSettings.Validate(); len(fieldErrors) != 0 {
+		anlogger.Errorf(lc, "create.go : wrong settings %v : %v", req.AppSettings, fieldErrors)
+		return nil, apimodel.ErrWrongRequestParams.WithFieldErrors(fieldErrors)
 	}
 
-	if req.PrivateKey == "" && req.ReferralId == "n/a" {
+	if req.PrivateKey == "" && req.ReferralId == apimodel.NoReferralCode {
 		req.PrivateKey = "n/a"
 	}
 
-	if req.ReferralId != "n/a" && req.PrivateKey == "" {
+	if req.ReferralId != apimodel.NoReferralCode && req.PrivateKey == "" {
 		anlogger.Errorf(lc, "create.go : empty private key while referral id is [%s]", req.ReferralId)
-		return nil, false, commons.WrongRequestParamsClientError
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
 	//todo:uncomment
 	//if req.Email == "" || req.AuthSessionId == "" {
 	//	anlogger.Errorf(lc, "create.go : required param email [%s] or authSessionId [%s] is empty", req.Email, req.AuthSessionId)
-	//	return nil, false, commons.WrongRequestParamsClientError
+	//	return nil, apimodel.ErrWrongRequestParams
 	//}
 	//todo:mb validate email
 
 	if (req.Email == "" && req.AuthSessionId != "") || (req.Email != "" && req.AuthSessionId == "") {
-		anlogger.Errorf(lc, "create.go : required param email [%s] or authSessionId [%s] is empty", req.Email, req.AuthSessionId)
-		return nil, false, commons.WrongRequestParamsClientError
+		anlogger.Errorf(lc, "create.go : required param email [%s] or authSessionId [%s] is empty", apimodel.MaskEmail(req.Email), apimodel.MaskToken(req.AuthSessionId))
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
 	if req.Email == "" {
 		req.Email = "n/a"
 	}
 
-	anlogger.Debugf(lc, "create.go : successfully parse request string [%s] to %v", params, req)
-	return &req, true, ""
+	anlogger.Debugf(lc, "create.go : successfully parse request %v", req)
+	return &req, nil
 }
 
-//ok (only if such userId doesn't exist), errorString if not ok
-func createUserProfile(userId, sessionToken, customerId string, buildNum int, isItAndroid bool, req *apimodel.CreateReq, lc *lambdacontext.LambdaContext) (bool, string) {
+//return error if something went wrong (also if such userId already exists)
+func createUserProfile(userId, sessionToken, customerId, sourceIp string, buildNum int, isItAndroid bool, req *apimodel.CreateReq, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
 	anlogger.Debugf(lc, "create.go : create user userId [%s], sessionToken [%s], customerId [%s], buildNum [%d], isItAndroid [%v] for request [%s]",
-		userId, sessionToken, customerId, buildNum, isItAndroid, req)
+		userId, apimodel.MaskToken(sessionToken), customerId, buildNum, isItAndroid, req)
 
 	deviceColumnName := commons.AndroidDeviceModelColumnName
 	osColumnName := commons.AndroidOsVersionColumnName
@@ -382,6 +371,7 @@ func createUserProfile(userId, sessionToken, customerId string, buildNum int, is
 			"#referralId":       aws.String(commons.ReferralIdColumnName),
 			"#privateKey":       aws.String(commons.PrivateKeyColumnName),
 			"#email":            aws.String(commons.UserEmailColumnName),
+			"#signupIp":         aws.String(apimodel.SignupSourceIpColumnName),
 		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":tV": {
@@ -432,6 +422,9 @@ func createUserProfile(userId, sessionToken, customerId string, buildNum int, is
 			":emailV": {
 				S: aws.String(req.Email),
 			},
+			":signupIpV": {
+				S: aws.String(sourceIp),
+			},
 		},
 		Key: map[string]*dynamodb.AttributeValue{
 			commons.UserIdColumnName: {
@@ -440,59 +433,71 @@ func createUserProfile(userId, sessionToken, customerId string, buildNum int, is
 		},
 		ConditionExpression: aws.String(fmt.Sprintf("attribute_not_exists(%v)", commons.UserIdColumnName)),
 		TableName:           aws.String(userProfileTable),
-		UpdateExpression:    aws.String("SET #token = :tV, #updatedAt = :uV, #sex = :sV, #year = :yV, #created = :cV, #onlineTime = :onlineTimeV, #buildNum = :buildNumV, #customerId = :cIdV, #currentIsAndroid = :currentIsAndroidV, #device = :deviceV, #os = :osV, #status = :statusV, #reportStatus = :reportStatusV, #referralId = :referralIdV, #privateKey = :privateKeyV, #email = :emailV"),
+		UpdateExpression:    aws.String("SET #token = :tV, #updatedAt = :uV, #sex = :sV, #year = :yV, #created = :cV, #onlineTime = :onlineTimeV, #buildNum = :buildNumV, #customerId = :cIdV, #currentIsAndroid = :currentIsAndroidV, #device = :deviceV, #os = :osV, #status = :statusV, #reportStatus = :reportStatusV, #referralId = :referralIdV, #privateKey = :privateKeyV, #email = :emailV, #signupIp = :signupIpV"),
+	}
+
+	if !req.Attribution.Empty() {
+		input.ExpressionAttributeNames["#attribution"] = aws.String(apimodel.AttributionColumnName)
+		input.ExpressionAttributeValues[":attributionV"] = req.Attribution.AttributeValue()
+		input.UpdateExpression = aws.String(*input.UpdateExpression + ", #attribution = :attributionV")
 	}
 
 	_, err := awsDbClient.UpdateItem(input)
 
 	if err != nil {
 		anlogger.Errorf(lc, "create.go : error create user for userId [%s] : %v", userId, err)
-		return false, commons.InternalServerError
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	anlogger.Debugf(lc, "create.go : successfully create user userId [%s], customerId [%s], buildNum [%d], isItAndroid [%v] for request [%s]",
 		userId, customerId, buildNum, isItAndroid, req)
 
-	return true, ""
+	return nil
 }
 
-//return generated userId, was everything ok and error string
-func generateUserId(base string, lc *lambdacontext.LambdaContext) (string, bool, string) {
+//return generated userId and error if something went wrong
+func generateUserId(base string, lc *lambdacontext.LambdaContext) (string, *apimodel.AuthError) {
 	anlogger.Debugf(lc, "create.go : generate userId for base string [%s]", base)
 	saltForUserId, err := uuid.NewV4()
 	if err != nil {
 		anlogger.Errorf(lc, "create.go : error while generate salt for userId, base string [%s] : %v", base, err)
-		return "", false, commons.InternalServerError
+		return "", apimodel.ErrInternalServer.Wrap(err)
 	}
 	sha := sha1.New()
 	_, err = sha.Write([]byte(base))
 	if err != nil {
 		anlogger.Errorf(lc, "create.go : error while write base string to sha algo, base string [%s] : %v", base, err)
-		return "", false, commons.InternalServerError
+		return "", apimodel.ErrInternalServer.Wrap(err)
 	}
 	_, err = sha.Write([]byte(saltForUserId.String()))
 	if err != nil {
 		anlogger.Errorf(lc, "create.go : error while write salt to sha algo, base string [%s] : %v", base, err)
-		return "", false, commons.InternalServerError
+		return "", apimodel.ErrInternalServer.Wrap(err)
 	}
 	resultUserId := fmt.Sprintf("%x", sha.Sum(nil))
 	anlogger.Debugf(lc, "create.go : successfully generate userId [%s] for base string [%s]", resultUserId, base)
-	return resultUserId, true, ""
+	return resultUserId, nil
 }
 
-//return ok and error string
-func createUserSettingsIntoDynamo(userId string, settings *apimodel.Settings, lc *lambdacontext.LambdaContext) (bool, string) {
+//return error if something went wrong
+func createUserSettingsIntoDynamo(userId string, settings *apimodel.Settings, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
 	anlogger.Debugf(lc, "create.go : create default user settings for userId [%s], settings=%v", userId, settings)
 	input :=
 		&dynamodb.UpdateItemInput{
 			ExpressionAttributeNames: map[string]*string{
-				"#locale":         aws.String(commons.LocaleColumnName),
-				"#push":           aws.String(commons.PushColumnName),
-				"#pushNewLike":    aws.String(commons.PushNewLikeColumnName),
-				"#pushNewMatch":   aws.String(commons.PushNewMatchColumnName),
-				"#pushNewMessage": aws.String(commons.PushNewMessageColumnName),
-				"#pushVibration":  aws.String(commons.PushVibrationColumnName),
-				"#timeZone":       aws.String(commons.TimeZoneColumnName),
+				"#locale":           aws.String(commons.LocaleColumnName),
+				"#push":             aws.String(commons.PushColumnName),
+				"#pushNewLike":      aws.String(commons.PushNewLikeColumnName),
+				"#pushNewMatch":     aws.String(commons.PushNewMatchColumnName),
+				"#pushNewMessage":   aws.String(commons.PushNewMessageColumnName),
+				"#pushVibration":    aws.String(commons.PushVibrationColumnName),
+				"#timeZone":         aws.String(commons.TimeZoneColumnName),
+				"#quietHours":       aws.String(apimodel.QuietHoursColumnName),
+				"#quietHoursStart":  aws.String(apimodel.QuietHoursStartColumnName),
+				"#quietHoursEnd":    aws.String(apimodel.QuietHoursEndColumnName),
+				"#digestNewLike":    aws.String(apimodel.DigestNewLikeColumnName),
+				"#digestNewMatch":   aws.String(apimodel.DigestNewMatchColumnName),
+				"#digestNewMessage": aws.String(apimodel.DigestNewMessageColumnName),
 			},
 			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 				":localeV": {
@@ -516,6 +521,24 @@ func createUserSettingsIntoDynamo(userId string, settings *apimodel.Settings, lc
 				":timeZoneV": {
 					N: aws.String(strconv.Itoa(settings.TimeZone)),
 				},
+				":quietHoursV": {
+					BOOL: aws.Bool(settings.QuietHours),
+				},
+				":quietHoursStartV": {
+					N: aws.String(strconv.Itoa(settings.QuietHoursStart)),
+				},
+				":quietHoursEndV": {
+					N: aws.String(strconv.Itoa(settings.QuietHoursEnd)),
+				},
+				":digestNewLikeV": {
+					BOOL: aws.Bool(settings.DigestNewLike),
+				},
+				":digestNewMatchV": {
+					BOOL: aws.Bool(settings.DigestNewMatch),
+				},
+				":digestNewMessageV": {
+					BOOL: aws.Bool(settings.DigestNewMessage),
+				},
 			},
 			Key: map[string]*dynamodb.AttributeValue{
 				commons.UserIdColumnName: {
@@ -524,29 +547,37 @@ func createUserSettingsIntoDynamo(userId string, settings *apimodel.Settings, lc
 			},
 			ConditionExpression: aws.String(fmt.Sprintf("attribute_not_exists(%v)", commons.UserIdColumnName)),
 			TableName:           aws.String(userSettingsTable),
-			UpdateExpression:    aws.String("SET #locale = :localeV, #push = :pushV, #timeZone = :timeZoneV, #pushNewLike = :pushNewLikeV, #pushNewMatch = :pushNewMatchV, #pushNewMessage = :pushNewMessageV, #pushVibration = :pushVibrationV"),
+			UpdateExpression:    aws.String("SET #locale = :localeV, #push = :pushV, #timeZone = :timeZoneV, #pushNewLike = :pushNewLikeV, #pushNewMatch = :pushNewMatchV, #pushNewMessage = :pushNewMessageV, #pushVibration = :pushVibrationV, #quietHours = :quietHoursV, #quietHoursStart = :quietHoursStartV, #quietHoursEnd = :quietHoursEndV, #digestNewLike = :digestNewLikeV, #digestNewMatch = :digestNewMatchV, #digestNewMessage = :digestNewMessageV"),
 		}
 
+	//old clients don't send the zone name
+	if settings.TimeZoneName != "" {
+		input.ExpressionAttributeNames["#timeZoneName"] = aws.String(apimodel.TimeZoneNameColumnName)
+		input.ExpressionAttributeValues[":timeZoneNameV"] = &dynamodb.AttributeValue{S: aws.String(settings.TimeZoneName)}
+		input.UpdateExpression = aws.String(*input.UpdateExpression + ", #timeZoneName = :timeZoneNameV")
+	}
+
 	_, err := awsDbClient.UpdateItem(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case dynamodb.ErrCodeConditionalCheckFailedException:
 				anlogger.Warnf(lc, "create.go : warning, default settings for userId [%s] already exist", userId)
-				return true, ""
+				return nil
 			}
 		}
 		anlogger.Errorf(lc, "create.go : error while creating default settings for userId [%s], settings=%v : %v", userId, settings, err)
-		return false, commons.InternalServerError
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	anlogger.Infof(lc, "create.go : successfully create default user's settings for userId [%s]", userId)
-	return true, ""
+	return nil
 }
 
-func tryUpdateAuthStatusToCreated(userId, email, authSessionId string, lc *lambdacontext.LambdaContext) (bool, string) {
+//return error if something went wrong
+func tryUpdateAuthStatusToCreated(userId, email, authSessionId string, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
 	anlogger.Debugf(lc, "create.go : update auth status to created state for userId [%s], email [%s], auth session id [%s]",
-		userId, email, authSessionId)
+		userId, apimodel.MaskEmail(email), apimodel.MaskToken(authSessionId))
 
 	input := &dynamodb.UpdateItemInput{
 		ExpressionAttributeNames: map[string]*string{
@@ -583,22 +614,32 @@ func tryUpdateAuthStatusToCreated(userId, email, authSessionId string, lc *lambd
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case dynamodb.ErrCodeConditionalCheckFailedException:
-				anlogger.Errorf(lc, "create.go : error concurrent usage email [%s] for userId [%s]", email, userId)
-				return false, commons.EmailConcurrentUsageClientError
+				anlogger.Errorf(lc, "create.go : error concurrent usage email [%s] for userId [%s]", apimodel.MaskEmail(email), userId)
+				return apimodel.ErrEmailConcurrentUsage.Wrap(aerr)
 			default:
-				anlogger.Errorf(lc, "create.go : error update email auth status for email [%s] and userId [%s] : %v", email, userId, aerr)
-				return false, commons.InternalServerError
+				anlogger.Errorf(lc, "create.go : error update email auth status for email [%s] and userId [%s] : %v", apimodel.MaskEmail(email), userId, aerr)
+				return apimodel.ErrInternalServer.Wrap(aerr)
 			}
 		}
-		anlogger.Errorf(lc, "create.go : error update email auth status for email [%s] and userId [%s] : %v", email, userId, err)
-		return false, commons.InternalServerError
+		anlogger.Errorf(lc, "create.go : error update email auth status for email [%s] and userId [%s] : %v", apimodel.MaskEmail(email), userId, err)
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	anlogger.Infof(lc, "create.go : successfully update auth status to account created state, email [%s], userId [%s]",
-		email, userId)
-	return true, ""
+		apimodel.MaskEmail(email), userId)
+	return nil
 }
 
 func main() {
-	basicLambda.Start(handler)
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
 }
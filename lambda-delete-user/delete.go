@@ -1,9 +1,11 @@
 package main
 
 import (
-	"context"
 	basicLambda "github.com/aws/aws-lambda-go/lambda"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/firehose"
@@ -11,12 +13,9 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"encoding/json"
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/ringoid/commons"
-	"github.com/aws/aws-sdk-go/service/cloudwatch"
-	"strings"
 )
 
 var anlogger *commons.Logger
@@ -24,54 +23,54 @@ var secretWord string
 var awsDbClient *dynamodb.DynamoDB
 var userProfileTable string
 var userSettingsTable string
+var pushTokensTable string
+var referralCodesTable string
 var awsDeliveryStreamClient *firehose.Firehose
 var deliveryStreamName string
 var commonStreamName string
 var awsKinesisClient *kinesis.Kinesis
 
-var baseCloudWatchNamespace string
 var userDeleteHimselfMetricName string
-var awsCWClient *cloudwatch.CloudWatch
+
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable            string `env:"USER_PROFILE_TABLE" validate:"required"`
+	UserSettingsTable           string `env:"USER_SETTINGS_TABLE" validate:"required"`
+	PushTokensTable             string `env:"PUSH_TOKENS_TABLE" validate:"required"`
+	ReferralCodesTable          string `env:"REFERRAL_CODES_TABLE" validate:"required"`
+	DeliveryStreamName          string `env:"DELIVERY_STREAM" validate:"required"`
+	CommonStreamName            string `env:"COMMON_STREAM" validate:"required"`
+	UserDeleteHimselfMetricName string `env:"CLOUD_WATCH_USER_DELETE_HIMSELF" validate:"required"`
+}
 
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : delete.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : delete.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : delete.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : delete.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : delete.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : delete.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "delete-user-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "delete-user-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : delete.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : delete.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : delete.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : delete.go : env can not be empty USER_PROFILE_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : delete.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
-
-	userSettingsTable, ok = os.LookupEnv("USER_SETTINGS_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : delete.go : env can not be empty USER_SETTINGS_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : delete.go : start with USER_SETTINGS_TABLE = [%s]", userSettingsTable)
+	userProfileTable = cfg.UserProfileTable
+	userSettingsTable = cfg.UserSettingsTable
+	pushTokensTable = cfg.PushTokensTable
+	referralCodesTable = cfg.ReferralCodesTable
+	deliveryStreamName = cfg.DeliveryStreamName
+	commonStreamName = cfg.CommonStreamName
+	userDeleteHimselfMetricName = cfg.UserDeleteHimselfMetricName
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -81,134 +80,108 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : delete.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "delete-user-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : delete.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : delete.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : delete.go : dynamodb client was successfully initialized")
 
-	deliveryStreamName, ok = os.LookupEnv("DELIVERY_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : delete.go : env can not be empty DELIVERY_STREAM")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : delete.go : start with DELIVERY_STREAM = [%s]", deliveryStreamName)
-
 	awsDeliveryStreamClient = firehose.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : delete.go : firehose client was successfully initialized")
 
-	commonStreamName, ok = os.LookupEnv("COMMON_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : delete.go : env can not be empty COMMON_STREAM")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : delete.go : start with COMMON_STREAM = [%s]", commonStreamName)
-
 	awsKinesisClient = kinesis.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : delete.go : kinesis client was successfully initialized")
-
-	baseCloudWatchNamespace, ok = os.LookupEnv("BASE_CLOUD_WATCH_NAMESPACE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : delete.go : env can not be empty BASE_CLOUD_WATCH_NAMESPACE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : delete.go : start with BASE_CLOUD_WATCH_NAMESPACE = [%s]", baseCloudWatchNamespace)
-
-	userDeleteHimselfMetricName, ok = os.LookupEnv("CLOUD_WATCH_USER_DELETE_HIMSELF")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : create.go : env can not be empty CLOUD_WATCH_USER_DELETE_HIMSELF")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : create.go : start with CLOUD_WATCH_USER_DELETE_HIMSELF = [%s]", userDeleteHimselfMetricName)
-
-	awsCWClient = cloudwatch.New(awsSession)
-	anlogger.Debugf(nil, "lambda-initialization : delete.go : cloudwatch client was successfully initialized")
 }
 
-func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
-	lc, _ := lambdacontext.FromContext(ctx)
-
-	userAgent := request.Headers["user-agent"]
-	if strings.HasPrefix(userAgent, "ELB-HealthChecker") {
-		return commons.NewServiceResponse("{}"), nil
-	}
-
-	if request.HTTPMethod != "POST" {
-		return commons.NewWrongHttpMethodServiceResponse(), nil
-	}
-	sourceIp := request.Headers["x-forwarded-for"]
-
-	anlogger.Debugf(lc, "delete.go : handle request %v", request)
-
-	appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(request.Headers, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "delete.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	userId := req.UserId
+	userReportStatus := req.UserReportStatus
 
-	reqParam, ok := parseParams(request.Body, lc)
-	if !ok {
-		errStr := commons.WrongRequestParamsClientError
-		anlogger.Errorf(lc, "delete.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	userId, _, userReportStatus, ok, errStr := commons.Login(appVersion, isItAndroid, reqParam.AccessToken, secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "delete.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	event := commons.NewUserCallDeleteHimselfEvent(userId, sourceIp, userReportStatus)
+	event := commons.NewUserCallDeleteHimselfEvent(userId, req.SourceIp, userReportStatus)
 	commons.SendAnalyticEvent(event, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
 	//send common events for neo4j
 	partitionKey := userId
-	ok, errStr = commons.SendCommonEvent(event, userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
+	ok, errStr := commons.SendCommonEvent(apimodel.TracedEvent(req.Ctx, event), userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
 	if !ok {
-		anlogger.Errorf(lc, "create.go : userId [%s], return %s to client", userId, errStr)
-		return commons.NewServiceResponse(errStr), nil
+		return nil, apimodel.FromErrorString(errStr)
 	}
 
-	//send cloudwatch metric
-	commons.SendCloudWatchMetric(baseCloudWatchNamespace, userDeleteHimselfMetricName, 1, awsCWClient, anlogger, lc)
+	metrics.Count(userDeleteHimselfMetricName, nil)
 
 	if userReportStatus == commons.UserTakePartInReport {
-		anlogger.Infof(lc, "delete.go : user with userId [%s] takes part in report, so don't delete him but mark as hidden", userId)
-		ok, errStr = apimodel.DisableCurrentAccessToken(userId, userProfileTable, awsDbClient, anlogger, lc)
-		if !ok {
-			return commons.NewServiceResponse(errStr), nil
+		anlogger.Infof(lc, "delete.go : user with userId [%s] takes part in report, so don't delete the user but mark as hidden", userId)
+		authErr := apimodel.DisableCurrentAccessToken(userId, userProfileTable, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
+		}
+		//the deletion is completed when the report is resolved (see lambda-handle-stream)
+		authErr = apimodel.MarkDeletionRequested(userId, userProfileTable, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
+		}
+		//hidden user must not get pushes
+		pushToken, authErr := apimodel.DeleteAllPushTokens(userId, pushTokensTable, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
+		}
+		authErr = apimodel.SendPushTokenUnregisteredEvent(req.Ctx, userId, req.SourceIp, pushToken, commonStreamName, awsKinesisClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
 		}
 	} else {
-		ok, errStr = apimodel.DeleteUserFromAuthService(userId, userProfileTable, userSettingsTable, awsDbClient, anlogger, lc)
-		if !ok {
-			return commons.NewServiceResponse(errStr), nil
+		pushToken, authErr := apimodel.DeleteUserFromAuthService(userId, userProfileTable, userSettingsTable, pushTokensTable, referralCodesTable, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
+		}
+		authErr = apimodel.SendPushTokenUnregisteredEvent(req.Ctx, userId, req.SourceIp, pushToken, commonStreamName, awsKinesisClient, anlogger, lc)
+		if authErr != nil {
+			return nil, authErr
 		}
 	}
 
-	resp := commons.BaseResponse{}
-	body, err := json.Marshal(resp)
-	if err != nil {
-		anlogger.Errorf(lc, "delete.go : error while marshaling resp object %v for userId [%s] : %v", resp, userId, err)
-		anlogger.Errorf(lc, "delete.go : userId [%s], return %s to client", userId, errStr)
-		return commons.NewServiceResponse(commons.InternalServerError), nil
-	}
-	anlogger.Debugf(lc, "delete.go : return body=%s to client, userId [%s]", string(body), userId)
-	return commons.NewServiceResponse(string(body)), nil
+	anlogger.Infof(lc, "delete.go : successfully handle delete request for userId [%s]", userId)
+	return commons.BaseResponse{}, nil
 }
 
-func parseParams(params string, lc *lambdacontext.LambdaContext) (*apimodel.DeleteReq, bool) {
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
 	var req apimodel.DeleteReq
 	err := json.Unmarshal([]byte(params), &req)
 
 	if err != nil {
-		anlogger.Errorf(lc, "delete.go : error unmarshal required params from the string %s : %v", params, err)
-		return nil, false
+		anlogger.Errorf(lc, "delete.go : error unmarshal required params from the string %s : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrWrongRequestParams.Wrap(err)
 	}
 
 	if req.AccessToken == "" {
 		anlogger.Errorf(lc, "delete.go : one of the required param is nil or empty, req %v", req)
-		return nil, false
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
-	return &req, true
+	return &req, nil
 }
 
 func main() {
-	basicLambda.Start(handler)
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Params.(*apimodel.DeleteReq).AccessToken },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
 }
@@ -1,60 +1,85 @@
 package main
 
 import (
+	"context"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"fmt"
 	"encoding/json"
 	"errors"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/ringoid/commons"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"../apimodel"
 )
 
-func block(body []byte, userProfileTable string,
-	awsDbClient *dynamodb.DynamoDB, lc *lambdacontext.LambdaContext, anlogger *commons.Logger) error {
+func init() {
+	register(commons.UserBlockEvent, func(ctx context.Context, recordId string, body []byte, lc *lambdacontext.LambdaContext) error {
+		return block(recordId, body, userProfileTable, awsDbClient, lc, anlogger)
+	})
+}
+
+//block is retried after the failed update of the second user, so every update is applied once per record
+func block(recordId string, body []byte, userProfileTable string,
+	awsDbClient dynamodbiface.DynamoDBAPI, lc *lambdacontext.LambdaContext, anlogger *commons.Logger) error {
 
 	var aEvent commons.UserBlockOtherEvent
 	err := json.Unmarshal([]byte(body), &aEvent)
 	if err != nil {
-		anlogger.Errorf(lc, "block.go : error unmarshal body [%s] to UserBlockOtherEvent: %v", string(body), err)
-		return errors.New(fmt.Sprintf("error unmarshal body %s : %v", string(body), err))
+		anlogger.Errorf(lc, "block.go : error unmarshal body [%s] to UserBlockOtherEvent: %v", apimodel.Scrub(string(body)), err)
+		return permanent(errors.New(fmt.Sprintf("error unmarshal body to UserBlockOtherEvent : %v", err)))
 	}
 
 	anlogger.Debugf(lc, "block.go : handle block event %v", aEvent)
 
-	ok, errStr := markUserAsPartOfReport(aEvent.TargetUserId, userProfileTable, awsDbClient, lc, anlogger)
-	if !ok {
-		return errors.New(errStr)
+	authErr := markUserAsPartOfReport(recordId, aEvent.TargetUserId, userProfileTable, awsDbClient, lc, anlogger)
+	if authErr != nil {
+		return authErr
 	}
-	ok, errStr = markUserAsPartOfReport(aEvent.UserId, userProfileTable, awsDbClient, lc, anlogger)
-	if !ok {
-		return errors.New(errStr)
+	authErr = markUserAsPartOfReport(recordId, aEvent.UserId, userProfileTable, awsDbClient, lc, anlogger)
+	if authErr != nil {
+		return authErr
 	}
 
 	anlogger.Debugf(lc, "block.go : successfully handle block event %v", aEvent)
 	return nil
 }
 
-//return ok and error string
-func markUserAsPartOfReport(userId, userProfileTable string, awsDbClient *dynamodb.DynamoDB, lc *lambdacontext.LambdaContext, anlogger *commons.Logger) (bool, string) {
+//return error if something went wrong
+func markUserAsPartOfReport(recordId, userId, userProfileTable string, awsDbClient dynamodbiface.DynamoDBAPI, lc *lambdacontext.LambdaContext, anlogger *commons.Logger) *apimodel.AuthError {
 	input := &dynamodb.UpdateItemInput{
 		ExpressionAttributeNames: map[string]*string{
-			"#reportStatus": aws.String(commons.UserReportStatusColumnName),
+			"#userId":         aws.String(commons.UserIdColumnName),
+			"#reportStatus":   aws.String(commons.UserReportStatusColumnName),
+			"#openReports":    aws.String(apimodel.OpenReportsCountColumnName),
+			"#appliedRecords": aws.String(apimodel.AppliedReportRecordsColumnName),
 		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":reportStatusV": {
 				S: aws.String(commons.UserTakePartInReport),
 			},
+			":zeroV": {
+				N: aws.String("0"),
+			},
+			":oneV": {
+				N: aws.String("1"),
+			},
+			":recordIdV": {
+				S: aws.String(recordId),
+			},
+			":recordIdSetV": {
+				SS: []*string{aws.String(recordId)},
+			},
 		},
 		Key: map[string]*dynamodb.AttributeValue{
 			commons.UserIdColumnName: {
 				S: aws.String(userId),
 			},
 		},
-		ConditionExpression: aws.String(fmt.Sprintf("attribute_exists(%v)", commons.UserIdColumnName)),
+		ConditionExpression: aws.String("attribute_exists(#userId) AND NOT contains(#appliedRecords, :recordIdV)"),
 		TableName:           aws.String(userProfileTable),
-		UpdateExpression:    aws.String("SET #reportStatus = :reportStatusV"),
+		UpdateExpression:    aws.String("SET #reportStatus = :reportStatusV, #openReports = if_not_exists(#openReports, :zeroV) + :oneV ADD #appliedRecords :recordIdSetV"),
 	}
 
 	_, err := awsDbClient.UpdateItem(input)
@@ -63,15 +88,15 @@ func markUserAsPartOfReport(userId, userProfileTable string, awsDbClient *dynamo
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case dynamodb.ErrCodeConditionalCheckFailedException:
-				anlogger.Warnf(lc, "block.go : warning when mark user like take part in report, user with userId [%s] doesn't exist", userId)
-				return true, ""
+				anlogger.Warnf(lc, "block.go : warning when mark user like take part in report, user with userId [%s] doesn't exist or record [%s] was already applied", userId, recordId)
+				return nil
 			}
 		}
 		anlogger.Warnf(lc, "block.go : error mark user with userId [%s] like take part in report : %v", userId, err)
-		return false, commons.InternalServerError
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	anlogger.Infof(lc, "block.go : successfully mark user userId [%s] like take part in report", userId)
 
-	return true, ""
+	return nil
 }
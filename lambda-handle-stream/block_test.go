@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"github.com/ringoid/commons"
+)
+
+//update of the second user fails, the retried record must not mark the first user twice
+func TestBlockRetryMarksUserOnce(t *testing.T) {
+	db := newFakeProfiles()
+	db.addUser("first", 0, commons.UserCleanReportStatus)
+	db.addUser("second", 1, commons.UserTakePartInReport)
+	//target user is marked first
+	db.failures["first"] = 1
+	body := []byte(`{"userId":"first","targetUserId":"second","eventType":"` + commons.UserBlockEvent + `"}`)
+	logger := testLogger(t)
+
+	err := block("record-1", body, userProfileTable, db, nil, logger)
+	if err == nil || !retryable(err) {
+		t.Fatalf("block() error = %v, want retryable error", err)
+	}
+	//retry after the failure and redelivery of the handled record
+	for i := 0; i < 2; i++ {
+		if err := block("record-1", body, userProfileTable, db, nil, logger); err != nil {
+			t.Fatalf("block() error = %v", err)
+		}
+	}
+	if db.openReports("first") != 1 || db.openReports("second") != 2 {
+		t.Errorf("open reports = %d/%d, want 1/2", db.openReports("first"), db.openReports("second"))
+	}
+	if db.reportStatus("first") != commons.UserTakePartInReport {
+		t.Errorf("report status of the first user = %s, want %s", db.reportStatus("first"), commons.UserTakePartInReport)
+	}
+
+	if err := block("record-2", body, userProfileTable, db, nil, logger); err != nil {
+		t.Fatalf("block() error = %v", err)
+	}
+	if db.openReports("first") != 2 || db.openReports("second") != 3 {
+		t.Errorf("open reports after the next record = %d/%d, want 2/3", db.openReports("first"), db.openReports("second"))
+	}
+}
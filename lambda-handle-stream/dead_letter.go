@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/aws"
+	"../apimodel"
+)
+
+const (
+	deadLetterSinkSqs  = "sqs"
+	deadLetterSinkFile = "file"
+)
+
+//deadLetter is the record which could not be handled, it has the raw payload, so the record could be replayed
+type deadLetter struct {
+	EventType      string `json:"eventType"`
+	EventId        string `json:"eventId"`
+	EventSourceArn string `json:"eventSourceArn"`
+	PartitionKey   string `json:"partitionKey"`
+	SequenceNumber string `json:"sequenceNumber"`
+	Data           string `json:"data"`
+	Error          string `json:"error"`
+	Attempts       int    `json:"attempts"`
+	UnixTime       int64  `json:"unixTime"`
+}
+
+func newDeadLetter(record events.KinesisEventRecord, cause error, attempts int) deadLetter {
+	return deadLetter{
+		EventType:      eventTypeOf(record.Kinesis.Data),
+		EventId:        record.EventID,
+		EventSourceArn: record.EventSourceArn,
+		PartitionKey:   record.Kinesis.PartitionKey,
+		SequenceNumber: record.Kinesis.SequenceNumber,
+		Data:           string(record.Kinesis.Data),
+		Error:          cause.Error(),
+		Attempts:       attempts,
+		UnixTime:       time.Now().Unix(),
+	}
+}
+
+type deadLetterSink interface {
+	send(letter deadLetter, lc *lambdacontext.LambdaContext) error
+}
+
+//sqsSink sends dead letters into SQS queue
+type sqsSink struct {
+	client   *sqs.SQS
+	queueUrl string
+}
+
+func (s *sqsSink) send(letter deadLetter, lc *lambdacontext.LambdaContext) error {
+	body, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(s.queueUrl),
+		MessageBody: aws.String(string(body)),
+	})
+	return err
+}
+
+//fileSink appends dead letters as json lines to the file, it's a stand-in for the dev server
+type fileSink struct {
+	mu       sync.Mutex
+	fileName string
+}
+
+func (s *fileSink) send(letter deadLetter, lc *lambdacontext.LambdaContext) error {
+	body, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(s.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(body, '\n'))
+	return err
+}
+
+//permanentError means that retry doesn't help (e.g. broken payload), such record goes to the dead letters at once
+type permanentError struct {
+	cause error
+}
+
+func (e *permanentError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.cause
+}
+
+func permanent(err error) error {
+	return &permanentError{cause: err}
+}
+
+//retryable returns false for permanent errors and service errors which are not retryable
+func retryable(err error) bool {
+	var permanentErr *permanentError
+	if errors.As(err, &permanentErr) {
+		return false
+	}
+	var authErr *apimodel.AuthError
+	if errors.As(err, &authErr) {
+		return authErr.Retryable
+	}
+	return true
+}
+
+func newDeadLetterSink(sink, queueUrl, fileName string, client *sqs.SQS) (deadLetterSink, error) {
+	switch sink {
+	case deadLetterSinkSqs:
+		if queueUrl == "" {
+			return nil, fmt.Errorf("dead letter queue url is required for %s sink", sink)
+		}
+		return &sqsSink{client: client, queueUrl: queueUrl}, nil
+	case deadLetterSinkFile:
+		return &fileSink{fileName: fileName}, nil
+	}
+	return nil, fmt.Errorf("unknown dead letter sink [%s]", sink)
+}
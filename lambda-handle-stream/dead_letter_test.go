@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"github.com/aws/aws-lambda-go/events"
+	"../apimodel"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"plain error", errors.New("connection reset"), true},
+		{"permanent error", permanent(errors.New("broken payload")), false},
+		{"wrapped permanent error", fmt.Errorf("handle event : %w", permanent(errors.New("broken payload"))), false},
+		{"retryable service error", apimodel.ErrInternalServer.Wrap(errors.New("db is down")), true},
+		{"not retryable service error", apimodel.ErrWrongRequestParams, false},
+		{"wrapped not retryable service error", fmt.Errorf("handle event : %w", apimodel.ErrVersionConflict.Wrap(nil)), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.want {
+				t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermanentKeepsCause(t *testing.T) {
+	cause := errors.New("broken payload")
+	err := permanent(cause)
+	if err.Error() != cause.Error() || !errors.Is(err, cause) {
+		t.Errorf("permanent(%v) = %v, cause is lost", cause, err)
+	}
+}
+
+func TestNewDeadLetter(t *testing.T) {
+	record := events.KinesisEventRecord{
+		EventID:        "shardId-000000000000:49590338271490256608559692538361571095921575989136588898",
+		EventSourceArn: "arn:aws:kinesis:eu-west-1:123456789012:stream/test-internal-event-stream",
+	}
+	record.Kinesis.PartitionKey = "userId"
+	record.Kinesis.SequenceNumber = "49590338271490256608559692538361571095921575989136588898"
+	record.Kinesis.Data = []byte(`{"eventType":"USER_BANNED","userId":"userId"}`)
+
+	letter := newDeadLetter(record, errors.New("db is down"), 3)
+	if letter.EventType != "USER_BANNED" || letter.EventId != record.EventID || letter.EventSourceArn != record.EventSourceArn ||
+		letter.PartitionKey != "userId" || letter.SequenceNumber != record.Kinesis.SequenceNumber {
+		t.Errorf("newDeadLetter() = %+v, record fields are lost", letter)
+	}
+	if letter.Data != string(record.Kinesis.Data) || letter.Error != "db is down" || letter.Attempts != 3 || letter.UnixTime == 0 {
+		t.Errorf("newDeadLetter() = %+v, payload or failure is lost", letter)
+	}
+
+	record.Kinesis.Data = []byte(`not json`)
+	if letter = newDeadLetter(record, errors.New("broken"), 1); letter.EventType != "" || letter.Data != "not json" {
+		t.Errorf("newDeadLetter() of broken payload = %+v", letter)
+	}
+}
+
+func TestNewDeadLetterSink(t *testing.T) {
+	tests := []struct {
+		name     string
+		sink     string
+		queueUrl string
+		wantErr  bool
+	}{
+		{"sqs", deadLetterSinkSqs, "https://sqs.eu-west-1.amazonaws.com/123456789012/test-auth-stream-dead-letters", false},
+		{"sqs without queue", deadLetterSinkSqs, "", true},
+		{"file", deadLetterSinkFile, "", false},
+		{"unknown", "s3", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := newDeadLetterSink(tt.sink, tt.queueUrl, "/tmp/dead-letters.jsonl", nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newDeadLetterSink(%q) error = %v, wantErr %v", tt.sink, err, tt.wantErr)
+			}
+			if !tt.wantErr && sink == nil {
+				t.Errorf("newDeadLetterSink(%q) returns nil sink", tt.sink)
+			}
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink := &fileSink{fileName: fileName}
+
+	for i := 1; i <= 2; i++ {
+		if err := sink.send(deadLetter{EventType: "USER_BANNED", Attempts: i}, nil); err != nil {
+			t.Fatalf("send() error = %v", err)
+		}
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var letters []deadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var letter deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatalf("line [%s] is not a dead letter : %v", scanner.Text(), err)
+		}
+		letters = append(letters, letter)
+	}
+	if len(letters) != 2 || letters[0].Attempts != 1 || letters[1].Attempts != 2 {
+		t.Errorf("file has %+v, want two appended dead letters", letters)
+	}
+}
+
+//dead letter keeps the payload in Data, so the error must not repeat it
+func TestPermanentErrorWithoutBody(t *testing.T) {
+	body := []byte(`{"userId":"secret-user-id","accessToken":"secret-token"`)
+
+	for eventType, handler := range handlers {
+		err := handler(context.Background(), "record-id", body, nil)
+		if err == nil || retryable(err) {
+			t.Fatalf("handler of [%s] error = %v, want permanent", eventType, err)
+		}
+		if strings.Contains(err.Error(), "secret") {
+			t.Errorf("handler of [%s] error [%v] contains the body", eventType, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/ringoid/commons"
+)
+
+//ProcessedRecords table keeps ids of the handled records, so redelivered records are skipped,
+//rows are removed by dynamodb ttl when the stream can't redeliver the record anymore
+const (
+	recordIdColumnName    = "record_id"
+	eventTypeColumnName   = "eventType"
+	processedAtColumnName = "processedAt"
+	//unix time in seconds, ttl attribute of the table
+	expiresAtColumnName = "expiresAt"
+)
+
+//processedRecordId is the event id of the record (shard id with the sequence number). Shard id is known only from
+//the event id, so the record without it (e.g. in local runs) is identified by the stream, partition key and sequence number.
+func processedRecordId(record events.KinesisEventRecord) string {
+	if record.EventID != "" {
+		return record.EventID
+	}
+	return record.EventSourceArn + ":" + record.Kinesis.PartitionKey + ":" + record.Kinesis.SequenceNumber
+}
+
+//eventTypeOf returns type of the event, empty string if the payload is broken
+func eventTypeOf(body []byte) string {
+	var aEvent commons.BaseInternalEvent
+	_ = json.Unmarshal(body, &aEvent)
+	return aEvent.EventType
+}
+
+//return true if the record was already handled and error if something went wrong
+func alreadyProcessed(recordId string, lc *lambdacontext.LambdaContext) (bool, error) {
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			recordIdColumnName: {
+				S: aws.String(recordId),
+			},
+		},
+		TableName:            aws.String(processedRecordsTable),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#recordId"),
+		ExpressionAttributeNames: map[string]*string{
+			"#recordId": aws.String(recordIdColumnName),
+		},
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "dedup.go : error check processed record [%s] : %v", recordId, err)
+		return false, fmt.Errorf("error check processed record %s : %v", recordId, err)
+	}
+	return len(result.Item) != 0, nil
+}
+
+//return error if something went wrong
+func markProcessed(recordId, eventType string, lc *lambdacontext.LambdaContext) error {
+	now := time.Now()
+	input := &dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			recordIdColumnName: {
+				S: aws.String(recordId),
+			},
+			eventTypeColumnName: {
+				S: aws.String(eventType),
+			},
+			processedAtColumnName: {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+			expiresAtColumnName: {
+				N: aws.String(strconv.FormatInt(now.Add(processedRecordsTtl).Unix(), 10)),
+			},
+		},
+		TableName: aws.String(processedRecordsTable),
+	}
+
+	_, err := awsDbClient.PutItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "dedup.go : error mark record [%s] as processed : %v", recordId, err)
+		return fmt.Errorf("error mark record %s as processed : %v", recordId, err)
+	}
+	return nil
+}
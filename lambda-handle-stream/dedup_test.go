@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestProcessedRecordId(t *testing.T) {
+	arn := "arn:aws:kinesis:eu-west-1:123456789012:stream/test-internal-event-stream"
+	sequenceNumber := "49590338271490256608559692538361571095921575989136588898"
+
+	tests := []struct {
+		name    string
+		eventId string
+		arn     string
+		want    string
+	}{
+		{"event id", "shardId-000000000001:" + sequenceNumber, arn, "shardId-000000000001:" + sequenceNumber},
+		{"no event id", "", arn, arn + ":userId:" + sequenceNumber},
+		{"no event id and stream", "", "", ":userId:" + sequenceNumber},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := events.KinesisEventRecord{EventID: tt.eventId, EventSourceArn: tt.arn}
+			record.Kinesis.PartitionKey = "userId"
+			record.Kinesis.SequenceNumber = sequenceNumber
+			if got := processedRecordId(record); got != tt.want {
+				t.Errorf("processedRecordId() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessedRecordIdDiffersBetweenStreams(t *testing.T) {
+	first := events.KinesisEventRecord{EventSourceArn: "arn:aws:kinesis:eu-west-1:123456789012:stream/first"}
+	second := events.KinesisEventRecord{EventSourceArn: "arn:aws:kinesis:eu-west-1:123456789012:stream/second"}
+	for _, record := range []*events.KinesisEventRecord{&first, &second} {
+		record.Kinesis.PartitionKey = "userId"
+		record.Kinesis.SequenceNumber = "1"
+	}
+	if processedRecordId(first) == processedRecordId(second) {
+		t.Errorf("records of different streams have the same id [%s]", processedRecordId(first))
+	}
+}
+
+func TestEventTypeOf(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"eventType":"USER_DELETED","userId":"userId"}`, "USER_DELETED"},
+		{`{"userId":"userId"}`, ""},
+		{`not json`, ""},
+		{``, ""},
+	}
+	for _, tt := range tests {
+		if got := eventTypeOf([]byte(tt.body)); got != tt.want {
+			t.Errorf("eventTypeOf(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
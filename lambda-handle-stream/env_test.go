@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+//init of the lambda loads the config and exits when it's not valid, package variables are initialized
+//before any init, so the test config is set here
+var _ = setTestEnv()
+
+func setTestEnv() bool {
+	for name, value := range map[string]string{
+		"ENV":                        "test",
+		"PAPERTRAIL_LOG_ADDRESS":     "127.0.0.1:514",
+		"BASE_CLOUD_WATCH_NAMESPACE": "test-auth-service",
+		"USER_PROFILE_TABLE":         "test-Profile",
+		"USER_SETTINGS_TABLE":        "test-UserSettings",
+		"PUSH_TOKENS_TABLE":          "test-PushTokens",
+		"REFERRAL_CODES_TABLE":       "test-ReferralCodes",
+		"COMMON_STREAM":              "test-common-stream",
+		"PROCESSED_RECORDS_TABLE":    "test-ProcessedRecords",
+		"STREAM_RETRY_DELAY_MS":      "0",
+		"DEAD_LETTER_SINK":           "file",
+		"DEAD_LETTER_FILE":           filepath.Join(os.TempDir(), "test-auth-dead-letters.jsonl"),
+	} {
+		os.Setenv(name, value)
+	}
+	return true
+}
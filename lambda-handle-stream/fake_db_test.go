@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/ringoid/commons"
+	"../apimodel"
+)
+
+//fakeProfiles is UserProfile table which evaluates the conditions and updates of block.go and report.go
+type fakeProfiles struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+	//number of the next updates of the user which fail
+	failures map[string]int
+}
+
+func newFakeProfiles() *fakeProfiles {
+	return &fakeProfiles{
+		items:    make(map[string]map[string]*dynamodb.AttributeValue),
+		failures: make(map[string]int),
+	}
+}
+
+func (f *fakeProfiles) addUser(userId string, openReports int, reportStatus string) {
+	f.items[userId] = map[string]*dynamodb.AttributeValue{
+		commons.UserIdColumnName:            {S: aws.String(userId)},
+		apimodel.OpenReportsCountColumnName: {N: aws.String(strconv.Itoa(openReports))},
+		commons.UserReportStatusColumnName:  {S: aws.String(reportStatus)},
+	}
+}
+
+func (f *fakeProfiles) openReports(userId string) int {
+	openReports, _ := strconv.Atoi(*f.items[userId][apimodel.OpenReportsCountColumnName].N)
+	return openReports
+}
+
+func (f *fakeProfiles) reportStatus(userId string) string {
+	return *f.items[userId][commons.UserReportStatusColumnName].S
+}
+
+func (f *fakeProfiles) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: copyItem(f.items[*input.Key[commons.UserIdColumnName].S])}, nil
+}
+
+func (f *fakeProfiles) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	userId := *input.Key[commons.UserIdColumnName].S
+	if f.failures[userId] > 0 {
+		f.failures[userId]--
+		return nil, errors.New("provisioned throughput exceeded")
+	}
+
+	conditionFailed := awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed", nil)
+	condition, update := *input.ConditionExpression, *input.UpdateExpression
+	item, ok := f.items[userId]
+	if !ok {
+		return nil, conditionFailed
+	}
+
+	applied := item[apimodel.AppliedReportRecordsColumnName]
+	if strings.Contains(condition, "NOT contains(#appliedRecords, :recordIdV)") && applied != nil {
+		for _, each := range applied.SS {
+			if *each == *input.ExpressionAttributeValues[":recordIdV"].S {
+				return nil, conditionFailed
+			}
+		}
+	}
+
+	counter, hasCounter := item[apimodel.OpenReportsCountColumnName]
+	openReports := 0
+	if hasCounter {
+		openReports, _ = strconv.Atoi(*counter.N)
+	}
+	if hasCounter && (strings.Contains(condition, "#openReports > :zeroV") && openReports <= 0 ||
+		strings.Contains(condition, "#openReports = :zeroV") && openReports != 0) {
+		return nil, conditionFailed
+	}
+
+	switch {
+	case strings.Contains(update, "+ :oneV"):
+		item[apimodel.OpenReportsCountColumnName] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(openReports + 1))}
+	case strings.Contains(update, "- :oneV"):
+		if !hasCounter {
+			openReports = 1
+		}
+		item[apimodel.OpenReportsCountColumnName] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(openReports - 1))}
+	}
+	if strings.Contains(update, "#reportStatus = :reportStatusV") {
+		item[commons.UserReportStatusColumnName] = input.ExpressionAttributeValues[":reportStatusV"]
+	}
+	if strings.Contains(update, "ADD #appliedRecords :recordIdSetV") {
+		if applied == nil {
+			applied = &dynamodb.AttributeValue{}
+		}
+		applied.SS = append(applied.SS, input.ExpressionAttributeValues[":recordIdSetV"].SS...)
+		item[apimodel.AppliedReportRecordsColumnName] = applied
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: copyItem(item)}, nil
+}
+
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	result := make(map[string]*dynamodb.AttributeValue, len(item))
+	for name, value := range item {
+		result[name] = value
+	}
+	return result
+}
@@ -13,45 +13,81 @@ import (
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/ringoid/commons"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"time"
 )
 
 var anlogger *commons.Logger
 var awsDbClient *dynamodb.DynamoDB
 var userProfileTable string
+var userSettingsTable string
+var pushTokensTable string
+var referralCodesTable string
+var commonStreamName string
+var awsKinesisClient *kinesis.Kinesis
+
+var maxAttempts int
+var retryDelay time.Duration
+var deadLetters deadLetterSink
+
+var processedRecordsTable string
+var processedRecordsTtl time.Duration
+
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable   string `env:"USER_PROFILE_TABLE" validate:"required"`
+	UserSettingsTable  string `env:"USER_SETTINGS_TABLE" validate:"required"`
+	PushTokensTable    string `env:"PUSH_TOKENS_TABLE" validate:"required"`
+	ReferralCodesTable string `env:"REFERRAL_CODES_TABLE" validate:"required"`
+	CommonStreamName   string `env:"COMMON_STREAM" validate:"required"`
+	//how many times the record is handled before it goes to the dead letters
+	MaxAttempts  int `env:"STREAM_MAX_ATTEMPTS" default:"3" validate:"min=1,max=10"`
+	RetryDelayMs int `env:"STREAM_RETRY_DELAY_MS" default:"200" validate:"min=0,max=5000"`
+	//sqs or file (stand-in for the dev server)
+	DeadLetterSink     string `env:"DEAD_LETTER_SINK" default:"sqs" validate:"oneof=sqs file"`
+	DeadLetterQueueUrl string `env:"DEAD_LETTER_QUEUE_URL"`
+	DeadLetterFile     string `env:"DEAD_LETTER_FILE" default:"/tmp/auth-dead-letters.jsonl"`
+	//should be not less than retention period of the stream
+	ProcessedRecordsTable    string `env:"PROCESSED_RECORDS_TABLE" validate:"required"`
+	ProcessedRecordsTtlHours int    `env:"PROCESSED_RECORDS_TTL_HOURS" default:"168" validate:"min=1"`
+}
 
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : handle_stream.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : handle_stream.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : handle_stream.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : handle_stream.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : handle_stream.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : handle_stream.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "internal-handle-stream-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "internal-handle-stream-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : handle_stream.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : handle_stream.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : handle_stream.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : handle_stream.go : env can not be empty USER_PROFILE_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : handle_stream.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
+	userProfileTable = cfg.UserProfileTable
+	userSettingsTable = cfg.UserSettingsTable
+	pushTokensTable = cfg.PushTokensTable
+	referralCodesTable = cfg.ReferralCodesTable
+	commonStreamName = cfg.CommonStreamName
+	maxAttempts = cfg.MaxAttempts
+	retryDelay = time.Duration(cfg.RetryDelayMs) * time.Millisecond
+	processedRecordsTable = cfg.ProcessedRecordsTable
+	processedRecordsTtl = time.Duration(cfg.ProcessedRecordsTtlHours) * time.Hour
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -61,36 +97,120 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : handle_stream.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "internal-handle-stream-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : handle_stream.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : handle_stream.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : handle_stream.go : dynamodb client was successfully initialized")
+
+	awsKinesisClient = kinesis.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : handle_stream.go : kinesis client was successfully initialized")
+
+	deadLetters, err = newDeadLetterSink(cfg.DeadLetterSink, cfg.DeadLetterQueueUrl, cfg.DeadLetterFile, sqs.New(awsSession))
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : handle_stream.go : error during dead letter sink initialization : %v", err)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : handle_stream.go : dead letter sink [%s] was successfully initialized", cfg.DeadLetterSink)
 }
 
-func handler(ctx context.Context, event events.KinesisEvent) (error) {
+//failed record is reported in BatchItemFailures, lambda retries the batch starting from it,
+//so the records after the failed one are not handled in this invocation
+func handler(ctx context.Context, event events.KinesisEvent) (events.KinesisEventResponse, error) {
 	lc, _ := lambdacontext.FromContext(ctx)
 
 	anlogger.Debugf(lc, "handle_stream.go : start handle request with [%d] records", len(event.Records))
 
-	for _, record := range event.Records {
-		body := record.Kinesis.Data
+	resp := events.KinesisEventResponse{BatchItemFailures: make([]events.KinesisBatchItemFailure, 0)}
+	for i, record := range event.Records {
+		if !processRecord(ctx, record, lc) {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.KinesisBatchItemFailure{
+				ItemIdentifier: record.Kinesis.SequenceNumber,
+			})
+			anlogger.Warnf(lc, "handle_stream.go : record with sequence number [%s] failed, [%d] records will be retried",
+				record.Kinesis.SequenceNumber, len(event.Records)-i)
+			return resp, nil
+		}
+	}
+
+	anlogger.Debugf(lc, "handle_stream.go : successfully complete handling [%d] records", len(event.Records))
+	return resp, nil
+}
+
+//processRecord skips already processed (redelivered) record and handles the new one with bounded retries,
+//record which keeps failing goes to the dead letters. Return false if the record must be retried by lambda
+//(processed records or dead letters are not available).
+func processRecord(ctx context.Context, record events.KinesisEventRecord, lc *lambdacontext.LambdaContext) bool {
+	id := processedRecordId(record)
+	eventType := eventTypeOf(record.Kinesis.Data)
+
+	processed, err := alreadyProcessed(id, lc)
+	if err != nil {
+		return false
+	}
+	if processed {
+		anlogger.Infof(lc, "handle_stream.go : record [%s] with event type [%s] was already processed, skip it", id, eventType)
+		countEvent(eventType, metrics.ResultDuplicate)
+		return true
+	}
 
-		var aEvent commons.BaseInternalEvent
-		err := json.Unmarshal(body, &aEvent)
-		if err != nil {
-			anlogger.Errorf(lc, "handle_stream.go : error unmarshal body [%s] to BaseInternalEvent : %v", body, err)
-			return fmt.Errorf("error unmarshal body %s : %v", body, err)
+	attempts := 0
+	for attempts < maxAttempts {
+		attempts++
+		err = handleRecord(ctx, record, lc)
+		if err == nil {
+			//error is logged, the worst case is one more run of the handler after redelivery
+			markProcessed(id, eventType, lc)
+			return true
 		}
-		anlogger.Debugf(lc, "handle_stream.go : handle record %v", aEvent)
-		switch aEvent.EventType {
-		case commons.UserBlockEvent:
-			err = block(body, userProfileTable, awsDbClient, lc, anlogger)
-			if err != nil {
-				return err
-			}
+		if !retryable(err) {
+			break
+		}
+		if attempts < maxAttempts {
+			time.Sleep(retryDelay * time.Duration(attempts))
 		}
 	}
 
-	anlogger.Debugf(lc, "handle_stream.go : successfully complete handling [%d] records", len(event.Records))
-	return nil
+	anlogger.Errorf(lc, "handle_stream.go : give up record with sequence number [%s] after [%d] attempts : %v",
+		record.Kinesis.SequenceNumber, attempts, err)
+
+	sendErr := deadLetters.send(newDeadLetter(record, err, attempts), lc)
+	if sendErr != nil {
+		anlogger.Errorf(lc, "handle_stream.go : error send record with sequence number [%s] to dead letters : %v",
+			record.Kinesis.SequenceNumber, sendErr)
+		return false
+	}
+	markProcessed(id, eventType, lc)
+	metrics.Count(metrics.StreamDeadLetterMetricName, nil)
+	anlogger.Warnf(lc, "handle_stream.go : record with sequence number [%s] was sent to dead letters", record.Kinesis.SequenceNumber)
+	return true
+}
+
+//every record continues the trace of the producer (if the event has trace context)
+func handleRecord(ctx context.Context, record events.KinesisEventRecord, lc *lambdacontext.LambdaContext) (err error) {
+	body := record.Kinesis.Data
+
+	ctx, span := tracing.StartInvocation(tracing.ExtractEvent(ctx, body), trace.SpanKindConsumer,
+		attribute.String("kinesis.sequenceNumber", record.Kinesis.SequenceNumber))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	var aEvent commons.BaseInternalEvent
+	err = json.Unmarshal(body, &aEvent)
+	if err != nil {
+		anlogger.Errorf(lc, "handle_stream.go : error unmarshal body [%s] to BaseInternalEvent : %v", apimodel.Scrub(string(body)), err)
+		return permanent(fmt.Errorf("error unmarshal body to BaseInternalEvent : %v", err))
+	}
+	span.SetAttributes(attribute.String("eventType", aEvent.EventType))
+
+	anlogger.Debugf(lc, "handle_stream.go : handle record %v", aEvent)
+	return handlers.dispatch(ctx, aEvent.EventType, processedRecordId(record), body, anlogger, lc)
 }
 
 func main() {
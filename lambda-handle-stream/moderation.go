@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"../apimodel"
+)
+
+func init() {
+	register(apimodel.UserBannedEventType, banned)
+	register(apimodel.UserDeletedEventType, deleted)
+}
+
+//banned user is hidden (like user who takes part in report and deletes the account), so the session is finished
+//and the user doesn't get pushes anymore
+func banned(ctx context.Context, recordId string, body []byte, lc *lambdacontext.LambdaContext) error {
+	aEvent, err := unmarshalModerationEvent(body, lc)
+	if err != nil || aEvent == nil {
+		return err
+	}
+
+	anlogger.Debugf(lc, "moderation.go : handle banned event %v", aEvent)
+
+	authErr := apimodel.DisableCurrentAccessToken(aEvent.UserId, userProfileTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return authErr
+	}
+	pushToken, authErr := apimodel.DeleteAllPushTokens(aEvent.UserId, pushTokensTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return authErr
+	}
+	authErr = apimodel.SendPushTokenUnregisteredEvent(ctx, aEvent.UserId, "", pushToken, commonStreamName, awsKinesisClient, anlogger, lc)
+	if authErr != nil {
+		return authErr
+	}
+
+	anlogger.Infof(lc, "moderation.go : successfully handle banned event %v", aEvent)
+	return nil
+}
+
+//user which was deleted by another service is deleted from auth service as well
+func deleted(ctx context.Context, recordId string, body []byte, lc *lambdacontext.LambdaContext) error {
+	aEvent, err := unmarshalModerationEvent(body, lc)
+	if err != nil || aEvent == nil {
+		return err
+	}
+
+	anlogger.Debugf(lc, "moderation.go : handle deleted event %v", aEvent)
+
+	pushToken, authErr := apimodel.DeleteUserFromAuthService(aEvent.UserId, userProfileTable, userSettingsTable, pushTokensTable, referralCodesTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return authErr
+	}
+	authErr = apimodel.SendPushTokenUnregisteredEvent(ctx, aEvent.UserId, "", pushToken, commonStreamName, awsKinesisClient, anlogger, lc)
+	if authErr != nil {
+		return authErr
+	}
+
+	anlogger.Infof(lc, "moderation.go : successfully handle deleted event %v", aEvent)
+	return nil
+}
+
+//return nil event if it can't be handled (retry doesn't help) and error if something went wrong
+func unmarshalModerationEvent(body []byte, lc *lambdacontext.LambdaContext) (*apimodel.UserModerationEvent, error) {
+	var aEvent apimodel.UserModerationEvent
+	err := json.Unmarshal(body, &aEvent)
+	if err != nil {
+		anlogger.Errorf(lc, "moderation.go : error unmarshal body [%s] to UserModerationEvent : %v", apimodel.Scrub(string(body)), err)
+		return nil, permanent(fmt.Errorf("error unmarshal body to UserModerationEvent : %v", err))
+	}
+	if aEvent.UserId == "" {
+		anlogger.Errorf(lc, "moderation.go : empty userId in event %v, skip it", aEvent)
+		return nil, nil
+	}
+	return &aEvent, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/ringoid/commons"
+	"../metrics"
+)
+
+//eventHandler handles one record of the stream, body is the whole event json, recordId identifies the record
+//(see dedup.go) for the handlers which must apply a change only once, returned error means the record must be retried
+type eventHandler func(ctx context.Context, recordId string, body []byte, lc *lambdacontext.LambdaContext) error
+
+//registry maps event type to its handler
+type registry map[string]eventHandler
+
+//handlers is filled from init of the files with the handlers
+var handlers = make(registry)
+
+//register adds the handler of the event type
+func register(eventType string, handler eventHandler) {
+	handlers.register(eventType, handler)
+}
+
+func (r registry) register(eventType string, handler eventHandler) {
+	if _, ok := r[eventType]; ok {
+		panic(fmt.Sprintf("handler for event type [%s] is already registered", eventType))
+	}
+	r[eventType] = handler
+}
+
+//dispatch calls the handler of the event type, events without handler are ignored
+func (r registry) dispatch(ctx context.Context, eventType, recordId string, body []byte,
+	anlogger *commons.Logger, lc *lambdacontext.LambdaContext) error {
+	handler, ok := r[eventType]
+	if !ok {
+		anlogger.Debugf(lc, "registry.go : there is no handler for event type [%s], ignore it", eventType)
+		countEvent(eventType, metrics.ResultIgnored)
+		return nil
+	}
+
+	err := handler(ctx, recordId, body, lc)
+	if err != nil {
+		anlogger.Errorf(lc, "registry.go : error handle event type [%s] : %v", eventType, err)
+		countEvent(eventType, metrics.ResultFailed)
+		return err
+	}
+	countEvent(eventType, metrics.ResultHandled)
+	return nil
+}
+
+func countEvent(eventType, result string) {
+	metrics.Count(metrics.StreamEventMetricName, metrics.Dimensions{
+		metrics.EventTypeDimension: eventType,
+		metrics.ResultDimension:    result,
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/ringoid/commons"
+	"../apimodel"
+	"../metrics"
+)
+
+func TestDispatch(t *testing.T) {
+	handlerErr := errors.New("db is down")
+	r := make(registry)
+	r.register("TEST_HANDLED", func(ctx context.Context, recordId string, body []byte, lc *lambdacontext.LambdaContext) error {
+		return nil
+	})
+	r.register("TEST_FAILED", func(ctx context.Context, recordId string, body []byte, lc *lambdacontext.LambdaContext) error {
+		return handlerErr
+	})
+	logger := testLogger(t)
+
+	tests := []struct {
+		eventType  string
+		wantErr    error
+		wantResult string
+	}{
+		{"TEST_HANDLED", nil, metrics.ResultHandled},
+		{"TEST_FAILED", handlerErr, metrics.ResultFailed},
+		{"TEST_WITHOUT_HANDLER", nil, metrics.ResultIgnored},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.eventType, func(t *testing.T) {
+			var out bytes.Buffer
+			metrics.SetOutput(&out)
+			defer metrics.SetOutput(os.Stdout)
+
+			err := r.dispatch(context.Background(), tt.eventType, "record-id", []byte(`{"eventType":"`+tt.eventType+`"}`), logger, nil)
+			if err != tt.wantErr {
+				t.Errorf("dispatch() error = %v, want %v", err, tt.wantErr)
+			}
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(bytes.TrimSpace(out.Bytes()), &entry); err != nil {
+				t.Fatalf("metric output [%s] is not one json entry : %v", out.String(), err)
+			}
+			if entry[metrics.StreamEventMetricName] != float64(1) {
+				t.Errorf("metric %s is not counted in %v", metrics.StreamEventMetricName, entry)
+			}
+			if entry[metrics.EventTypeDimension] != tt.eventType || entry[metrics.ResultDimension] != tt.wantResult {
+				t.Errorf("metric dimensions = %v/%v, want %s/%s",
+					entry[metrics.EventTypeDimension], entry[metrics.ResultDimension], tt.eventType, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	noop := func(ctx context.Context, recordId string, body []byte, lc *lambdacontext.LambdaContext) error { return nil }
+	r := make(registry)
+	r.register("TEST_TWICE", noop)
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "TEST_TWICE") {
+			t.Errorf("second register() of the event type recovered %v, want panic", r)
+		}
+	}()
+	r.register("TEST_TWICE", noop)
+}
+
+func TestHandlersAreRegistered(t *testing.T) {
+	for _, eventType := range []string{commons.UserBlockEvent, apimodel.UserBannedEventType,
+		apimodel.UserDeletedEventType, apimodel.ReportResolvedEventType} {
+		if _, ok := handlers[eventType]; !ok {
+			t.Errorf("there is no handler for event type [%s]", eventType)
+		}
+	}
+}
+
+func testLogger(t *testing.T) *commons.Logger {
+	logger, err := commons.New("127.0.0.1:514", "test-internal-handle-stream-auth", false)
+	if err != nil {
+		t.Fatalf("error create logger : %v", err)
+	}
+	return logger
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/ringoid/commons"
+	"../apimodel"
+)
+
+func init() {
+	register(apimodel.ReportResolvedEventType, func(ctx context.Context, recordId string, body []byte, lc *lambdacontext.LambdaContext) error {
+		return reportResolved(ctx, recordId, body, awsDbClient, lc)
+	})
+}
+
+//reportResolved closes the report for both users (see block.go). User without other open reports gets clean status
+//back, except the reported user when the violation was confirmed. Hidden user who requested the deletion meanwhile
+//is deleted when there are no open reports anymore. Counter of the user is changed once per record, so the record
+//is retried after the failed update of the second user without closing the report twice for the first one.
+func reportResolved(ctx context.Context, recordId string, body []byte, awsDbClient dynamodbiface.DynamoDBAPI, lc *lambdacontext.LambdaContext) error {
+	var aEvent apimodel.ReportResolvedEvent
+	err := json.Unmarshal(body, &aEvent)
+	if err != nil {
+		anlogger.Errorf(lc, "report.go : error unmarshal body [%s] to ReportResolvedEvent : %v", apimodel.Scrub(string(body)), err)
+		return permanent(fmt.Errorf("error unmarshal body to ReportResolvedEvent : %v", err))
+	}
+
+	anlogger.Debugf(lc, "report.go : handle report resolved event %v", aEvent)
+
+	switch aEvent.Resolution {
+	case apimodel.ReportResolutionDismissed, apimodel.ReportResolutionViolation:
+	default:
+		anlogger.Errorf(lc, "report.go : unknown resolution [%s] of the report, event %v", aEvent.Resolution, aEvent)
+		return permanent(fmt.Errorf("unknown resolution %s", aEvent.Resolution))
+	}
+
+	for _, userId := range []string{aEvent.UserId, aEvent.TargetUserId} {
+		if userId == "" {
+			continue
+		}
+		keepHidden := aEvent.Resolution == apimodel.ReportResolutionViolation && userId == aEvent.TargetUserId
+		authErr := closeReport(ctx, recordId, userId, keepHidden, awsDbClient, lc)
+		if authErr != nil {
+			return authErr
+		}
+	}
+
+	anlogger.Debugf(lc, "report.go : successfully handle report resolved event %v", aEvent)
+	return nil
+}
+
+//return error if something went wrong
+func closeReport(ctx context.Context, recordId, userId string, keepHidden bool, awsDbClient dynamodbiface.DynamoDBAPI, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
+	openReports, profile, authErr := decrementOpenReports(recordId, userId, awsDbClient, lc)
+	if authErr != nil {
+		return authErr
+	}
+	if openReports > 0 {
+		anlogger.Infof(lc, "report.go : userId [%s] still takes part in [%d] reports, keep report status", userId, openReports)
+		return nil
+	}
+
+	if !keepHidden {
+		profile, authErr = clearReportStatus(userId, awsDbClient, lc)
+		if authErr != nil {
+			return authErr
+		}
+	}
+	if profile == nil {
+		return nil
+	}
+
+	if _, ok := profile[apimodel.DeletionRequestedColumnName]; !ok {
+		return nil
+	}
+
+	anlogger.Infof(lc, "report.go : hidden user with userId [%s] requested the deletion, complete it", userId)
+	pushToken, authErr := apimodel.DeleteUserFromAuthService(userId, userProfileTable, userSettingsTable, pushTokensTable, referralCodesTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return authErr
+	}
+	return apimodel.SendPushTokenUnregisteredEvent(ctx, userId, "", pushToken, commonStreamName, awsKinesisClient, anlogger, lc)
+}
+
+//return number of the reports which are still open, profile after the update (nil if there is no such user)
+//and error if something went wrong. Users who were reported before the counter was added have no counter
+//and are treated as taking part in one report. When the record was already applied or there is no open report
+//the current profile is returned, so the retried record completes the steps after the counter.
+func decrementOpenReports(recordId, userId string, awsDbClient dynamodbiface.DynamoDBAPI, lc *lambdacontext.LambdaContext) (int, map[string]*dynamodb.AttributeValue, *apimodel.AuthError) {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#userId":         aws.String(commons.UserIdColumnName),
+			"#openReports":    aws.String(apimodel.OpenReportsCountColumnName),
+			"#appliedRecords": aws.String(apimodel.AppliedReportRecordsColumnName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zeroV": {
+				N: aws.String("0"),
+			},
+			":oneV": {
+				N: aws.String("1"),
+			},
+			":recordIdV": {
+				S: aws.String(recordId),
+			},
+			":recordIdSetV": {
+				SS: []*string{aws.String(recordId)},
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(#userId) AND NOT contains(#appliedRecords, :recordIdV) AND " +
+			"(attribute_not_exists(#openReports) OR #openReports > :zeroV)"),
+		TableName:        aws.String(userProfileTable),
+		UpdateExpression: aws.String("SET #openReports = if_not_exists(#openReports, :oneV) - :oneV ADD #appliedRecords :recordIdSetV"),
+		ReturnValues:        aws.String(dynamodb.ReturnValueAllNew),
+	}
+
+	result, err := awsDbClient.UpdateItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			anlogger.Warnf(lc, "report.go : user with userId [%s] doesn't exist, has no open reports or record [%s] was already applied",
+				userId, recordId)
+			return currentOpenReports(userId, awsDbClient, lc)
+		}
+		anlogger.Errorf(lc, "report.go : error decrement open reports for userId [%s] : %v", userId, err)
+		return 0, nil, apimodel.ErrInternalServer.Wrap(err)
+	}
+
+	return openReportsOf(userId, result.Attributes, lc)
+}
+
+//return number of the open reports, profile (nil if there is no such user) and error if something went wrong
+func currentOpenReports(userId string, awsDbClient dynamodbiface.DynamoDBAPI, lc *lambdacontext.LambdaContext) (int, map[string]*dynamodb.AttributeValue, *apimodel.AuthError) {
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		TableName:      aws.String(userProfileTable),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	result, err := awsDbClient.GetItem(input)
+	if err != nil {
+		anlogger.Errorf(lc, "report.go : error get profile of userId [%s] : %v", userId, err)
+		return 0, nil, apimodel.ErrInternalServer.Wrap(err)
+	}
+	if len(result.Item) == 0 {
+		return 0, nil, nil
+	}
+	return openReportsOf(userId, result.Item, lc)
+}
+
+//return number of the open reports in the profile (0 if there is no counter), the profile and error if something went wrong
+func openReportsOf(userId string, profile map[string]*dynamodb.AttributeValue, lc *lambdacontext.LambdaContext) (int, map[string]*dynamodb.AttributeValue, *apimodel.AuthError) {
+	openReports := 0
+	if value, ok := profile[apimodel.OpenReportsCountColumnName]; ok && value.N != nil {
+		var err error
+		openReports, err = strconv.Atoi(*value.N)
+		if err != nil {
+			anlogger.Errorf(lc, "report.go : can not convert open reports [%s] for userId [%s] : %v", *value.N, userId, err)
+			return 0, nil, apimodel.ErrInternalServer.Wrap(err)
+		}
+	}
+	return openReports, profile, nil
+}
+
+//return profile after the update (nil if there is no such user or a new report was opened)
+//and error if something went wrong
+func clearReportStatus(userId string, awsDbClient dynamodbiface.DynamoDBAPI, lc *lambdacontext.LambdaContext) (map[string]*dynamodb.AttributeValue, *apimodel.AuthError) {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#userId":       aws.String(commons.UserIdColumnName),
+			"#reportStatus": aws.String(commons.UserReportStatusColumnName),
+			"#openReports":  aws.String(apimodel.OpenReportsCountColumnName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":reportStatusV": {
+				S: aws.String(commons.UserCleanReportStatus),
+			},
+			":zeroV": {
+				N: aws.String("0"),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			commons.UserIdColumnName: {
+				S: aws.String(userId),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(#userId) AND (attribute_not_exists(#openReports) OR #openReports = :zeroV)"),
+		TableName:           aws.String(userProfileTable),
+		UpdateExpression:    aws.String("SET #reportStatus = :reportStatusV"),
+		ReturnValues:        aws.String(dynamodb.ReturnValueAllNew),
+	}
+
+	result, err := awsDbClient.UpdateItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			anlogger.Warnf(lc, "report.go : report status of userId [%s] is not cleared, user doesn't exist or takes part in a new report", userId)
+			return nil, nil
+		}
+		anlogger.Errorf(lc, "report.go : error clear report status for userId [%s] : %v", userId, err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
+	}
+
+	anlogger.Infof(lc, "report.go : successfully clear report status for userId [%s]", userId)
+	return result.Attributes, nil
+}
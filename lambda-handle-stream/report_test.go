@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"github.com/ringoid/commons"
+)
+
+//cases which are decided before the profiles are touched
+func TestReportResolvedPayload(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{"broken payload", `not json`, true, true},
+		{"unknown resolution", `{"userId":"first","targetUserId":"second","resolution":"unknown"}`, true, true},
+		{"no resolution", `{"userId":"first","targetUserId":"second"}`, true, true},
+		{"dismissed without users", `{"resolution":"dismissed"}`, false, false},
+		{"violation without users", `{"resolution":"violation"}`, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := reportResolved(context.Background(), "record-id", []byte(tt.body), nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reportResolved() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && retryable(err) == tt.wantPermanent {
+				t.Errorf("reportResolved() error = %v, retryable %v", err, retryable(err))
+			}
+		})
+	}
+}
+
+//update of the second user fails, the retried record must not close the report twice for the first user
+func TestReportResolvedRetryClosesOnce(t *testing.T) {
+	db := newFakeProfiles()
+	//first user takes part in one more report
+	db.addUser("first", 2, commons.UserTakePartInReport)
+	db.addUser("second", 1, commons.UserTakePartInReport)
+	db.failures["second"] = 1
+	body := []byte(`{"userId":"first","targetUserId":"second","resolution":"dismissed"}`)
+
+	err := reportResolved(context.Background(), "record-1", body, db, nil)
+	if err == nil || !retryable(err) {
+		t.Fatalf("reportResolved() error = %v, want retryable error", err)
+	}
+	//retry after the failure and redelivery of the handled record
+	for i := 0; i < 2; i++ {
+		if err := reportResolved(context.Background(), "record-1", body, db, nil); err != nil {
+			t.Fatalf("reportResolved() error = %v", err)
+		}
+	}
+	if db.openReports("first") != 1 || db.openReports("second") != 0 {
+		t.Errorf("open reports = %d/%d, want 1/0", db.openReports("first"), db.openReports("second"))
+	}
+	if db.reportStatus("first") != commons.UserTakePartInReport || db.reportStatus("second") != commons.UserCleanReportStatus {
+		t.Errorf("report status = %s/%s, want %s/%s", db.reportStatus("first"), db.reportStatus("second"),
+			commons.UserTakePartInReport, commons.UserCleanReportStatus)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	basicLambda "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+	"os"
+	"fmt"
+	"strings"
+	"time"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/ringoid/commons"
+	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var anlogger *commons.Logger
+var awsDbClient *dynamodb.DynamoDB
+var referralCodesTable string
+
+type lambdaConfig struct {
+	config.Base
+	ReferralCodesTable string `env:"REFERRAL_CODES_TABLE" validate:"required"`
+}
+
+func init() {
+	var env string
+	var err error
+	var awsSession *session.Session
+
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : internal_campaign_code.go : %v\n", err)
+		os.Exit(1)
+	}
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : internal_campaign_code.go : start with config %+v\n", cfg)
+
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "internal-campaign-code-auth"), apimodel.IsDebugLogEnabled)
+	if err != nil {
+		fmt.Printf("lambda-initialization :  internal_campaign_code.go : error during startup : %v\n", err)
+		os.Exit(1)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : internal_campaign_code.go : logger was successfully initialized")
+
+	referralCodesTable = cfg.ReferralCodesTable
+
+	awsSession, err = session.NewSession(aws.NewConfig().
+		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
+		WithLogger(aws.LoggerFunc(func(args ...interface{}) { anlogger.AwsLog(args) })).WithLogLevel(aws.LogOff))
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : internal_campaign_code.go : error during initialization : %v", err)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : internal_campaign_code.go : aws session was successfully initialized")
+
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "internal-campaign-code-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : internal_campaign_code.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : internal_campaign_code.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
+	awsDbClient = dynamodb.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : internal_campaign_code.go : dynamodb client was successfully initialized")
+}
+
+//how many times we try to generate unique code
+const maxGenerateAttempts = 5
+
+func handler(ctx context.Context, request apimodel.InternalIssueCampaignCodeReq) (apimodel.InternalIssueCampaignCodeResp, error) {
+	lc, _ := lambdacontext.FromContext(ctx)
+	ctx, span := tracing.StartInvocation(ctx, trace.SpanKindServer)
+	defer span.End()
+
+	anlogger.Debugf(lc, "internal_campaign_code.go : start handle request %v", request)
+
+	if request.WarmUpRequest {
+		return apimodel.InternalIssueCampaignCodeResp{}, nil
+	}
+
+	resp := apimodel.InternalIssueCampaignCodeResp{}
+
+	campaign := strings.TrimSpace(request.Campaign)
+	code := apimodel.NormalizeReferralCode(request.Code)
+	if campaign == "" || len(code) > 256 || (request.ExpiresAt > 0 && request.ExpiresAt <= time.Now().Unix()) {
+		anlogger.Errorf(lc, "internal_campaign_code.go : wrong request %v", request)
+		resp.ErrorCode = apimodel.ErrWrongRequestParams.Code
+		resp.ErrorMessage = apimodel.ErrWrongRequestParams.Message
+		return resp, nil
+	}
+
+	referralCode := apimodel.ReferralCode{
+		Code:      code,
+		OwnerType: apimodel.ReferralCodeOwnerCampaign,
+		OwnerId:   campaign,
+		ExpiresAt: request.ExpiresAt,
+	}
+
+	//generate the code if it was not provided, the code which was provided has only one attempt
+	attempts := 1
+	if code == "" {
+		attempts = maxGenerateAttempts
+	}
+	for i := 0; i < attempts; i++ {
+		if code == "" {
+			generated, err := apimodel.GenerateReferralCode()
+			if err != nil {
+				anlogger.Errorf(lc, "internal_campaign_code.go : error generate referral code for campaign [%s] : %v", campaign, err)
+				resp.ErrorCode = apimodel.ErrInternalServer.Code
+				resp.ErrorMessage = apimodel.ErrInternalServer.Message
+				return resp, nil
+			}
+			referralCode.Code = generated
+		}
+
+		issued, authErr := apimodel.IssueReferralCode(referralCode, referralCodesTable, awsDbClient, anlogger, lc)
+		if authErr != nil {
+			resp.ErrorCode = authErr.Code
+			resp.ErrorMessage = authErr.Message
+			return resp, nil
+		}
+		if issued {
+			resp.Code = referralCode.Code
+			anlogger.Infof(lc, "internal_campaign_code.go : successfully issue referral code %v", referralCode)
+			return resp, nil
+		}
+	}
+
+	anlogger.Errorf(lc, "internal_campaign_code.go : can not issue referral code for request %v, code already exists", request)
+	resp.ErrorCode = apimodel.ErrWrongRequestParams.Code
+	resp.ErrorMessage = apimodel.ErrWrongRequestParams.Message
+	return resp, nil
+}
+
+func main() {
+	basicLambda.Start(handler)
+}
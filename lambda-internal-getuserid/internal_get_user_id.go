@@ -10,9 +10,13 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/service/kinesis"
-	"strings"
+	"errors"
 	"github.com/ringoid/commons"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var anlogger *commons.Logger
@@ -22,39 +26,35 @@ var secretWord string
 var commonStreamName string
 var awsKinesisClient *kinesis.Kinesis
 
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable string `env:"USER_PROFILE_TABLE" validate:"required"`
+	CommonStreamName string `env:"COMMON_STREAM" validate:"required"`
+}
+
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : internal_get_user_id.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : internal_get_user_id.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : internal_get_user_id.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : internal_get_user_id.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : internal_get_user_id.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : internal_get_user_id.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "internal-get-user-id-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "internal-get-user-id-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization :  internal_get_user_id.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization :  internal_get_user_id.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : internal_get_user_id.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : internal_get_user_id.go : env can not be empty USER_PROFILE_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : internal_get_user_id.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
+	userProfileTable = cfg.UserProfileTable
+	commonStreamName = cfg.CommonStreamName
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -64,25 +64,30 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : internal_get_user_id.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "internal-get-user-id-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : internal_get_user_id.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : internal_get_user_id.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : internal_get_user_id.go : dynamodb client was successfully initialized")
 
-	commonStreamName, ok = os.LookupEnv("COMMON_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : internal_get_user_id.go : env can not be empty COMMON_STREAM")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : internal_get_user_id.go : start with COMMON_STREAM = [%s]", commonStreamName)
-
 	awsKinesisClient = kinesis.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : internal_get_user_id.go : kinesis client was successfully initialized")
 }
 
 func handler(ctx context.Context, request commons.InternalGetUserIdReq) (commons.InternalGetUserIdResp, error) {
 	lc, _ := lambdacontext.FromContext(ctx)
+	ctx, span := tracing.StartInvocation(ctx, trace.SpanKindServer)
+	defer span.End()
 
-	anlogger.Debugf(lc, "internal_get_user_id.go : start handle request %v", request)
+	anlogger.Debugf(lc, "internal_get_user_id.go : start handle request %s", apimodel.Scrubf("%v", request))
 
 	if request.WarmUpRequest {
 		return commons.InternalGetUserIdResp{}, nil
@@ -92,22 +97,16 @@ func handler(ctx context.Context, request commons.InternalGetUserIdReq) (commons
 
 	userId, _, userReportStatus, ok, errStr := commons.Login(request.BuildNum, request.IsItAndroid, request.AccessToken, secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger, lc)
 	if !ok {
-		anlogger.Debugf(lc, "internal_get_user_id.go : return %s to client", errStr)
-
-		if strings.Contains(errStr, "InvalidAccessTokenClientError") {
-			resp.ErrorCode = "InvalidAccessTokenClientError"
-			resp.ErrorMessage = "Invalid access token"
-			return resp, nil
-		}
+		authErr := apimodel.FromErrorString(errStr)
+		anlogger.Debugf(lc, "internal_get_user_id.go : return %v to client", authErr)
 
-		if strings.Contains(errStr, "TooOldAppVersionClientError") {
-			resp.ErrorCode = "TooOldAppVersionClientError"
-			resp.ErrorMessage = "Too old app version"
-			return resp, nil
+		//only these errors are meaningful for the caller, everything else is reported like internal one
+		if !errors.Is(authErr, apimodel.ErrInvalidAccessToken) && !errors.Is(authErr, apimodel.ErrTooOldAppVersion) {
+			authErr = apimodel.ErrInternalServer
 		}
 
-		resp.ErrorCode = "InternalServerError"
-		resp.ErrorMessage = "Internal Server Error"
+		resp.ErrorCode = authErr.Code
+		resp.ErrorMessage = authErr.Message
 		return resp, nil
 	}
 
@@ -1,21 +1,23 @@
 package main
 
 import (
-	"context"
 	basicLambda "github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	"os"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"encoding/json"
-	"github.com/aws/aws-lambda-go/events"
+	"strings"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/ringoid/commons"
-	"strings"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
 )
 
 var anlogger *commons.Logger
@@ -27,40 +29,37 @@ var secretWord string
 var commonStreamName string
 var awsKinesisClient *kinesis.Kinesis
 
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable   string `env:"USER_PROFILE_TABLE" validate:"required"`
+	CommonStreamName   string `env:"COMMON_STREAM" validate:"required"`
+	DeliveryStreamName string `env:"DELIVERY_STREAM" validate:"required"`
+}
+
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : update_profile.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : update_profile.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : update_profile.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : update_profile.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : update_profile.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : update_profile.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "update-profile-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "update-profile-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : update_profile.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : update_profile.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : update_profile.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : update_profile.go : env can not be empty USER_PROFILE_TABLE")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : update_profile.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
+	userProfileTable = cfg.UserProfileTable
+	commonStreamName = cfg.CommonStreamName
+	deliveryStreamName = cfg.DeliveryStreamName
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -70,107 +69,100 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : update_profile.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "update-profile-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : update_profile.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : update_profile.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : update_profile.go : dynamodb client was successfully initialized")
 
-	commonStreamName, ok = os.LookupEnv("COMMON_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : update_profile.go : env can not be empty COMMON_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : update_profile.go : start with DELIVERY_STREAM = [%s]", commonStreamName)
-
 	awsKinesisClient = kinesis.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : update_profile.go : kinesis client was successfully initialized")
 
-	deliveryStreamName, ok = os.LookupEnv("DELIVERY_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : update_profile.go : env can not be empty DELIVERY_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : update_profile.go : start with DELIVERY_STREAM = [%s]", deliveryStreamName)
-
 	awsDeliveryStreamClient = firehose.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : update_profile.go : firehose client was successfully initialized")
 }
 
-func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
-	lc, _ := lambdacontext.FromContext(ctx)
-
-	userAgent := request.Headers["user-agent"]
-	if strings.HasPrefix(userAgent, "ELB-HealthChecker") {
-		return commons.NewServiceResponse("{}"), nil
-	}
-
-	if request.HTTPMethod != "POST" {
-		return commons.NewWrongHttpMethodServiceResponse(), nil
-	}
-	sourceIp := request.Headers["x-forwarded-for"]
-
-	anlogger.Debugf(lc, "update_profile.go : start handle request %v", request)
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	reqParam := req.Params.(*apimodel.UpdateProfileRequest)
+	userId := req.UserId
 
-	appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(request.Headers, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "update_profile.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
+	if reqParam.Partial {
+		changed, removed, version, authErr := patchUserProfile(userId, userProfileTable, reqParam, lc)
+		if authErr != nil {
+			return nil, authErr
+		}
+		if len(changed) == 0 && len(removed) == 0 {
+			return apimodel.UpdateResponse{Version: version}, nil
+		}
 
-	reqParam, ok, errStr := parseParams(request.Body, lc)
-	if !ok {
-		anlogger.Errorf(lc, "update_profile.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
+		event, err := apimodel.NewUserProfilePatchedEvent(userId, req.SourceIp, changed)
+		if err != nil {
+			anlogger.Errorf(lc, "update_profile.go : error create profile updated event for userId [%s] : %v", userId, err)
+			return nil, apimodel.ErrInternalServer.Wrap(err)
+		}
+		commons.SendAnalyticEvent(event, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
-	userId, _, _, ok, errStr := commons.Login(appVersion, isItAndroid, reqParam.AccessToken, secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "update_profile.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+		partitionKey := userId
+		ok, errStr := commons.SendCommonEvent(apimodel.TracedEvent(req.Ctx, event), userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
+		if !ok {
+			return nil, apimodel.FromErrorString(errStr)
+		}
+		return apimodel.UpdateResponse{Version: version}, nil
 	}
 
-	ok, errStr = updateUserProfile(userId, userProfileTable, reqParam, lc)
-	if !ok {
-		anlogger.Errorf(lc, "update_profile.go : userId [%s], return %s to client", userId, errStr)
-		return commons.NewServiceResponse(errStr), nil
+	version, authErr := updateUserProfile(userId, userProfileTable, reqParam, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
-	event := commons.NewUserProfileUpdatedEvent(userId, sourceIp, reqParam.Property, reqParam.Transport, reqParam.Income,
+	event := commons.NewUserProfileUpdatedEvent(userId, req.SourceIp, reqParam.Property, reqParam.Transport, reqParam.Income,
 		reqParam.Height, reqParam.Education, reqParam.HairColor, reqParam.Children,
 		reqParam.Name, reqParam.JobTitle, reqParam.Company, reqParam.EducationText, reqParam.About, reqParam.Instagram,
 		reqParam.TikTok, reqParam.WhereLive, reqParam.WhereFrom, reqParam.StatusText)
 	commons.SendAnalyticEvent(event, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
 	partitionKey := userId
-	ok, errStr = commons.SendCommonEvent(event, userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
+	ok, errStr := commons.SendCommonEvent(apimodel.TracedEvent(req.Ctx, event), userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
 	if !ok {
-		anlogger.Errorf(lc, "update_profile.go : userId [%s], return %s to client", userId, errStr)
-		return commons.NewServiceResponse(errStr), nil
+		return nil, apimodel.FromErrorString(errStr)
 	}
 
-	resp := commons.BaseResponse{}
-	body, err := json.Marshal(resp)
-	if err != nil {
-		anlogger.Errorf(lc, "update_profile.go : error while marshaling resp object for userId [%s] : %v", userId, err)
-		return commons.NewServiceResponse(commons.InternalServerError), nil
-	}
-	anlogger.Debugf(lc, "update_profile.go : return body=%s for userId [%s]", string(body), userId)
-	//return OK with AccessToken
-	return commons.NewServiceResponse(string(body)), nil
+	return apimodel.UpdateResponse{Version: version}, nil
 }
 
-func parseParams(params string, lc *lambdacontext.LambdaContext) (*apimodel.UpdateProfileRequest, bool, string) {
-	anlogger.Debugf(lc, "update_profile.go : parse request body [%s]", params)
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
 	var req apimodel.UpdateProfileRequest
 	err := json.Unmarshal([]byte(params), &req)
 	if err != nil {
-		anlogger.Errorf(lc, "update_profile.go : error marshaling required params from the string [%s] : %v", params, err)
-		return nil, false, commons.InternalServerError
+		anlogger.Errorf(lc, "update_profile.go : error marshaling required params from the string [%s] : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	if req.AccessToken == "" {
 		anlogger.Errorf(lc, "update_profile.go : empty or nil accessToken request param, req %v", req)
-		return nil, false, commons.WrongRequestParamsClientError
+		return nil, apimodel.ErrWrongRequestParams
+	}
+
+	fieldErrors := apimodel.Validate(&req)
+	if len(fieldErrors) != 0 {
+		anlogger.Errorf(lc, "update_profile.go : wrong request params %v, req %v", fieldErrors, req)
+		return nil, apimodel.ErrWrongRequestParams.WithFieldErrors(fieldErrors)
+	}
+
+	//absent fields are not touched in partial mode, so don't fill them
+	if req.Partial {
+		anlogger.Debugf(lc, "update_profile.go : successfully parse partial request %v, present %v, cleared %v",
+			req, req.Present, req.Cleared)
+		return &req, nil
 	}
 
 	if len(req.Name) == 0 {
@@ -213,12 +205,12 @@ func parseParams(params string, lc *lambdacontext.LambdaContext) (*apimodel.Upda
 		req.StatusText = "unknown"
 	}
 
-	anlogger.Debugf(lc, "update_profile.go : successfully parse request string [%s] to %v", params, req)
-	return &req, true, ""
+	anlogger.Debugf(lc, "update_profile.go : successfully parse request %v", req)
+	return &req, nil
 }
 
-//return ok and error string
-func updateUserProfile(userId, userProfileTableName string, req *apimodel.UpdateProfileRequest, lc *lambdacontext.LambdaContext) (bool, string) {
+//return new version of the profile and error if something went wrong
+func updateUserProfile(userId, userProfileTableName string, req *apimodel.UpdateProfileRequest, lc *lambdacontext.LambdaContext) (int64, *apimodel.AuthError) {
 	anlogger.Debugf(lc, "update_profile.go : start update user profile for userId [%s], profile=%v", userId, req)
 	expressionAttrNames := map[string]*string{
 		"#property":  aws.String(commons.UserProfilePropertyColumnName),
@@ -333,16 +325,159 @@ func updateUserProfile(userId, userProfileTableName string, req *apimodel.Update
 			UpdateExpression: aws.String(updateExp),
 		}
 
-	_, err := awsDbClient.UpdateItem(input)
+	apimodel.AddVersionCheck(input, req.Version)
+
+	output, err := awsDbClient.UpdateItem(input)
+	if err != nil {
+		return 0, profileUpdateError(userId, req, err, lc)
+	}
+
+	version := apimodel.VersionFromAttributes(output.Attributes)
+	anlogger.Infof(lc, "update_profile.go : successfully update user profile for userId [%s], version [%d], settings=%v", userId, version, req)
+	return version, nil
+}
+
+//version check is the only condition of the profile update
+func profileUpdateError(userId string, req *apimodel.UpdateProfileRequest, err error, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		anlogger.Warnf(lc, "update_profile.go : stale version [%v] of the profile for userId [%s]", aws.Int64Value(req.Version), userId)
+		return apimodel.ErrVersionConflict.Wrap(err)
+	}
+	anlogger.Errorf(lc, "update_profile.go : error update user profile for userId [%s], profile=%v : %v", userId, req, err)
+	return apimodel.ErrInternalServer.Wrap(err)
+}
+
+//json names of the request fields and the columns where they are stored
+var profileColumns = []struct {
+	field  string
+	column string
+}{
+	{"property", commons.UserProfilePropertyColumnName},
+	{"transport", commons.UserProfileTransportColumnName},
+	{"income", commons.UserProfileIncomeColumnName},
+	{"height", commons.UserProfileHeightColumnName},
+	{"educationLevel", commons.UserProfileEducationLevelColumnName},
+	{"hairColor", commons.UserProfileHairColorColumnName},
+	{"children", commons.UserProfileChildrenColumnName},
+	{"name", commons.UserProfileNameColumnName},
+	{"jobTitle", commons.UserProfileJobTitleColumnName},
+	{"company", commons.UserProfileCompanyColumnName},
+	{"education", commons.UserProfileEducationTextColumnName},
+	{"about", commons.UserProfileAboutColumnName},
+	{"instagram", commons.UserProfileInstagramColumnName},
+	{"tikTok", commons.UserProfileTikTokColumnName},
+	{"whereLive", commons.UserProfileWhereILiveColumnName},
+	{"whereFrom", commons.UserProfileWhereIFromColumnName},
+	{"statusText", commons.UserProfileStatusTextColumnName},
+}
+
+func profileValues(req *apimodel.UpdateProfileRequest) map[string]interface{} {
+	return map[string]interface{}{
+		"property":       req.Property,
+		"transport":      req.Transport,
+		"income":         req.Income,
+		"height":         req.Height,
+		"educationLevel": req.Education,
+		"hairColor":      req.HairColor,
+		"children":       req.Children,
+		"name":           req.Name,
+		"jobTitle":       req.JobTitle,
+		"company":        req.Company,
+		"education":      req.EducationText,
+		"about":          req.About,
+		"instagram":      req.Instagram,
+		"tikTok":         req.TikTok,
+		"whereLive":      req.WhereLive,
+		"whereFrom":      req.WhereFrom,
+		"statusText":     req.StatusText,
+	}
+}
+
+//SET fields which are present in the request and REMOVE fields which are null,
+//return changed values, removed fields, new version of the profile and error if something went wrong
+func patchUserProfile(userId, userProfileTableName string, req *apimodel.UpdateProfileRequest,
+	lc *lambdacontext.LambdaContext) (map[string]interface{}, []string, int64, *apimodel.AuthError) {
+	anlogger.Debugf(lc, "update_profile.go : start patch user profile for userId [%s], profile=%v", userId, req)
+
+	values := profileValues(req)
+	changed := make(map[string]interface{})
+	removed := make([]string, 0)
+	expressionAttrNames := make(map[string]*string)
+	expressionAttributeValues := make(map[string]*dynamodb.AttributeValue)
+	setParts := make([]string, 0)
+	removeParts := make([]string, 0)
+
+	for i, each := range profileColumns {
+		attrName := fmt.Sprintf("#f%d", i)
+		switch {
+		case req.Cleared[each.field]:
+			expressionAttrNames[attrName] = aws.String(each.column)
+			removeParts = append(removeParts, attrName)
+			removed = append(removed, each.field)
+			//null unmarshals into zero value, the same which full update sends for the empty field
+			changed[each.field] = values[each.field]
+		case req.Present[each.field]:
+			attrValueName := fmt.Sprintf(":v%d", i)
+			attrValue := &dynamodb.AttributeValue{}
+			switch value := values[each.field].(type) {
+			case int:
+				attrValue.N = aws.String(fmt.Sprintf("%v", value))
+			case string:
+				attrValue.S = aws.String(value)
+			}
+			expressionAttrNames[attrName] = aws.String(each.column)
+			expressionAttributeValues[attrValueName] = attrValue
+			setParts = append(setParts, fmt.Sprintf("%s = %s", attrName, attrValueName))
+			changed[each.field] = values[each.field]
+		}
+	}
+
+	//even empty patch goes to the db, so stale version is reported anyway
+	updateExp := ""
+	if len(setParts) != 0 {
+		updateExp = "SET " + strings.Join(setParts, ", ")
+	}
+	if len(removeParts) != 0 {
+		updateExp = strings.TrimSpace(updateExp + " REMOVE " + strings.Join(removeParts, ", "))
+	}
+	input :=
+		&dynamodb.UpdateItemInput{
+			ExpressionAttributeNames:  expressionAttrNames,
+			ExpressionAttributeValues: expressionAttributeValues,
+			Key: map[string]*dynamodb.AttributeValue{
+				commons.UserIdColumnName: {
+					S: aws.String(userId),
+				},
+			},
+			TableName:        aws.String(userProfileTableName),
+			UpdateExpression: aws.String(updateExp),
+		}
+
+	apimodel.AddVersionCheck(input, req.Version)
+
+	output, err := awsDbClient.UpdateItem(input)
 	if err != nil {
-		anlogger.Errorf(lc, "update_profile.go : error update user profile for userId [%s], profile=%v : %v", userId, req, err)
-		return false, commons.InternalServerError
+		return nil, nil, 0, profileUpdateError(userId, req, err, lc)
 	}
 
-	anlogger.Infof(lc, "update_profile.go : successfully update user profile for userId [%s], settings=%v", userId, req)
-	return true, ""
+	version := apimodel.VersionFromAttributes(output.Attributes)
+	anlogger.Infof(lc, "update_profile.go : successfully patch user profile for userId [%s], version [%d], changed %v, removed %v",
+		userId, version, changed, removed)
+	return changed, removed, version, nil
 }
 
 func main() {
-	basicLambda.Start(handler)
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Params.(*apimodel.UpdateProfileRequest).AccessToken },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
 }
@@ -1,21 +1,25 @@
 package main
 
 import (
-	"context"
 	basicLambda "github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	"os"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"encoding/json"
-	"github.com/aws/aws-lambda-go/events"
+	"strconv"
+	"strings"
+	"time"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/ringoid/commons"
-	"strings"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
 )
 
 var anlogger *commons.Logger
@@ -28,47 +32,39 @@ var secretWord string
 var commonStreamName string
 var awsKinesisClient *kinesis.Kinesis
 
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable   string `env:"USER_PROFILE_TABLE" validate:"required"`
+	UserSettingsTable  string `env:"USER_SETTINGS_TABLE" validate:"required"`
+	CommonStreamName   string `env:"COMMON_STREAM" validate:"required"`
+	DeliveryStreamName string `env:"DELIVERY_STREAM" validate:"required"`
+}
+
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : update_settings.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : update_settings.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : update_settings.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : update_settings.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : update_settings.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : update_settings.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "update-settings-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "update-settings-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : update_settings.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : update_settings.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : update_settings.go : env can not be empty USER_PROFILE_TABLE")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
-
-	userSettingsTable, ok = os.LookupEnv("USER_SETTINGS_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : update_settings.go : env can not be empty USER_SETTINGS_TABLE")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : start with USER_SETTINGS_TABLE = [%s]", userSettingsTable)
+	userProfileTable = cfg.UserProfileTable
+	userSettingsTable = cfg.UserSettingsTable
+	commonStreamName = cfg.CommonStreamName
+	deliveryStreamName = cfg.DeliveryStreamName
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -78,415 +74,212 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "update-settings-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : update_settings.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : dynamodb client was successfully initialized")
 
-	commonStreamName, ok = os.LookupEnv("COMMON_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : update_settings.go : env can not be empty COMMON_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : start with DELIVERY_STREAM = [%s]", commonStreamName)
-
 	awsKinesisClient = kinesis.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : kinesis client was successfully initialized")
 
-	deliveryStreamName, ok = os.LookupEnv("DELIVERY_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : update_settings.go : env can not be empty DELIVERY_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : start with DELIVERY_STREAM = [%s]", deliveryStreamName)
-
 	awsDeliveryStreamClient = firehose.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : update_settings.go : firehose client was successfully initialized")
 }
 
-func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
-	lc, _ := lambdacontext.FromContext(ctx)
-
-	userAgent := request.Headers["user-agent"]
-	if strings.HasPrefix(userAgent, "ELB-HealthChecker") {
-		return commons.NewServiceResponse("{}"), nil
-	}
-
-	if request.HTTPMethod != "POST" {
-		return commons.NewWrongHttpMethodServiceResponse(), nil
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	reqParam := req.Params.(*apimodel.SettingsPatch)
+	userId := req.UserId
+
+	//legacy offset is kept for old clients and consumers
+	if reqParam.TimeZoneName != nil && reqParam.TimeZone == nil {
+		location, err := apimodel.LoadTimeZone(*reqParam.TimeZoneName)
+		if err != nil {
+			anlogger.Errorf(lc, "update_settings.go : error load time zone [%s] for userId [%s] : %v", *reqParam.TimeZoneName, userId, err)
+			return nil, apimodel.ErrWrongRequestParams.Wrap(err)
+		}
+		reqParam.TimeZone = aws.Int(apimodel.LegacyTimeZone(location, time.Now()))
 	}
-	sourceIp := request.Headers["x-forwarded-for"]
 
-	anlogger.Debugf(lc, "update_settings.go : start handle request %v", request)
-
-	appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(request.Headers, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "update_settings.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	version, authErr := updateUserSettings(userId, reqParam, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
-
-	reqParamMap, ok, errStr := parseParams(request.Body, lc)
-	if !ok {
-		anlogger.Errorf(lc, "update_settings.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	if len(reqParam.Changes()) == 0 {
+		return apimodel.UpdateResponse{Version: version}, nil
 	}
 
-	userId, _, _, ok, errStr := commons.Login(appVersion, isItAndroid, reqParamMap["accessToken"].(string), secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "update_settings.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
+	event :=
+		commons.NewUserSettingsUpdatedEvent(userId, req.SourceIp, aws.StringValue(reqParam.Locale), reqParam.Locale != nil,
+			aws.BoolValue(reqParam.Push), aws.BoolValue(reqParam.PushNewLike), aws.BoolValue(reqParam.PushNewMatch), aws.BoolValue(reqParam.PushNewMessage),
+			reqParam.Push != nil, reqParam.PushNewLike != nil, reqParam.PushNewMatch != nil, reqParam.PushNewMessage != nil,
+			aws.BoolValue(reqParam.PushVibration), reqParam.PushVibration != nil,
+			timeZoneValue(reqParam.TimeZone), reqParam.TimeZone != nil)
+	extendedEvent := apimodel.ExtendSettingsEvent(event, reqParam.Changes(), time.Now())
+	commons.SendAnalyticEvent(extendedEvent, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
-	ok, errStr = updateUserSettings(userId, reqParamMap, lc)
+	partitionKey := userId
+	ok, errStr := commons.SendCommonEvent(apimodel.TracedEvent(req.Ctx, extendedEvent), userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
 	if !ok {
-		anlogger.Errorf(lc, "update_settings.go : userId [%s], return %s to client", userId, errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	localeIntr, localeOk := reqParamMap["locale"]
-	var localeStr string
-	if localeOk {
-		localeStr = localeIntr.(string)
-	}
-	pushIntr, pushOk := reqParamMap["push"]
-	var pushBool bool
-	if pushOk {
-		pushBool = pushIntr.(bool)
-	}
-
-	pushNewLikeIntr, pushNewLikeOk := reqParamMap["pushNewLike"]
-	var pushNewLikeBool bool
-	if pushNewLikeOk {
-		pushNewLikeBool = pushNewLikeIntr.(bool)
+		return nil, apimodel.FromErrorString(errStr)
 	}
 
-	pushNewMessageIntr, pushNewMessageOk := reqParamMap["pushNewMessage"]
-	var pushNewMessageBool bool
-	if pushNewMessageOk {
-		pushNewMessageBool = pushNewMessageIntr.(bool)
-	}
+	return apimodel.UpdateResponse{Version: version}, nil
+}
 
-	pushNewMatchIntr, pushNewMatchOk := reqParamMap["pushNewMatch"]
-	var pushNewMatchBool bool
-	if pushNewMatchOk {
-		pushNewMatchBool = pushNewMatchIntr.(bool)
+func timeZoneValue(timeZone *int) int {
+	if timeZone == nil {
+		return 0
 	}
+	return *timeZone
+}
 
-	pushVibrationIntr, pushVibrationOk := reqParamMap["vibration"]
-	var pushVibrationBool bool
-	if pushVibrationOk {
-		pushVibrationBool = pushVibrationIntr.(bool)
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
+	var req apimodel.SettingsPatch
+	err := json.Unmarshal([]byte(params), &req)
+	if err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			anlogger.Errorf(lc, "update_settings.go : wrong type of [%s] request param, req [%s] : %v", typeErr.Field, apimodel.Scrub(params), err)
+			return nil, apimodel.ErrWrongRequestParams.WithFieldErrors([]apimodel.FieldError{
+				{Field: typeErr.Field, Message: fmt.Sprintf("must be %s", typeErr.Type)},
+			})
+		}
+		anlogger.Errorf(lc, "update_settings.go : error marshaling required params from the string [%s] : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
-	timeZoneFlt, timeZoneOk := reqParamMap["timeZone"]
-	var timeZoneInt int
-	if timeZoneOk {
-		timeZoneInt = int(timeZoneFlt.(float64))
+	if req.AccessToken == "" {
+		anlogger.Errorf(lc, "update_settings.go : empty or nil accessToken request param, req %v", req)
+		return nil, apimodel.ErrWrongRequestParams
 	}
-	event :=
-		commons.NewUserSettingsUpdatedEvent(userId, sourceIp, localeStr, localeOk,
-			pushBool, pushNewLikeBool, pushNewMatchBool, pushNewMessageBool,
-			pushOk, pushNewLikeOk, pushNewMatchOk, pushNewMessageOk,
-			pushVibrationBool, pushVibrationOk,
-			timeZoneInt, timeZoneOk)
-	commons.SendAnalyticEvent(event, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
 
-	partitionKey := userId
-	ok, errStr = commons.SendCommonEvent(event, userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "update_settings.go : userId [%s], return %s to client", userId, errStr)
-		return commons.NewServiceResponse(errStr), nil
+	fieldErrors := apimodel.Validate(&req)
+	if len(fieldErrors) != 0 {
+		anlogger.Errorf(lc, "update_settings.go : wrong request params %v, req %v", fieldErrors, req)
+		return nil, apimodel.ErrWrongRequestParams.WithFieldErrors(fieldErrors)
 	}
 
-	resp := commons.BaseResponse{}
-	body, err := json.Marshal(resp)
-	if err != nil {
-		anlogger.Errorf(lc, "update_settings.go : error while marshaling resp object for userId [%s] : %v", userId, err)
-		return commons.NewServiceResponse(commons.InternalServerError), nil
-	}
-	anlogger.Debugf(lc, "update_settings.go : return body=%s for userId [%s]", string(body), userId)
-	//return OK with AccessToken
-	return commons.NewServiceResponse(string(body)), nil
+	anlogger.Debugf(lc, "update_settings.go : successfully parse request %v", req)
+	return &req, nil
 }
 
-func parseParams(params string, lc *lambdacontext.LambdaContext) (map[string]interface{}, bool, string) {
-	anlogger.Debugf(lc, "update_settings.go : parse request body [%s]", params)
-	var reqMap map[string]interface{}
-	err := json.Unmarshal([]byte(params), &reqMap)
-	if err != nil {
-		anlogger.Errorf(lc, "update_settings.go : error marshaling required params from the string [%s] : %v", params, err)
-		return nil, false, commons.InternalServerError
-	}
+//request param name to UserSettings column
+var settingsColumns = []struct {
+	field  string
+	column string
+}{
+	{"locale", commons.LocaleColumnName},
+	{"push", commons.PushColumnName},
+	{"pushNewLike", commons.PushNewLikeColumnName},
+	{"pushNewMessage", commons.PushNewMessageColumnName},
+	{"pushNewMatch", commons.PushNewMatchColumnName},
+	{"vibration", commons.PushVibrationColumnName},
+	{"timeZone", commons.TimeZoneColumnName},
+	{"timeZoneName", apimodel.TimeZoneNameColumnName},
+	{"quietHours", apimodel.QuietHoursColumnName},
+	{"quietHoursStart", apimodel.QuietHoursStartColumnName},
+	{"quietHoursEnd", apimodel.QuietHoursEndColumnName},
+	{"digestNewLike", apimodel.DigestNewLikeColumnName},
+	{"digestNewMatch", apimodel.DigestNewMatchColumnName},
+	{"digestNewMessage", apimodel.DigestNewMessageColumnName},
+}
 
-	accessTokenInter, ok := reqMap["accessToken"]
-	if !ok {
-		anlogger.Errorf(lc, "update_settings.go : empty or nil accessToken request param, req %v", reqMap)
-		return nil, false, commons.WrongRequestParamsClientError
-	}
-	accessToken, ok := accessTokenInter.(string)
-	if !ok || accessToken == "" {
-		anlogger.Errorf(lc, "update_settings.go : wrong format or empty accessToken request param, req %v", reqMap)
-		return nil, false, commons.WrongRequestParamsClientError
-	}
+//all sent settings and the version are written by one conditional update, so the update is never applied partially,
+//return new version and error if something went wrong
+func updateUserSettings(userId string, req *apimodel.SettingsPatch, lc *lambdacontext.LambdaContext) (int64, *apimodel.AuthError) {
+	changes := req.Changes()
+	anlogger.Debugf(lc, "update_settings.go : start update user settings for userId [%s], settings=%v", userId, changes)
 
-	pushIntr, ok := reqMap["push"]
-	if ok {
-		_, ok = pushIntr.(bool)
-		if !ok {
-			anlogger.Errorf(lc, "update_settings.go : error format of push in request param, req %v", reqMap)
-			return nil, false, commons.WrongRequestParamsClientError
-		}
-	}
+	expressionAttrNames := make(map[string]*string)
+	expressionAttributeValues := make(map[string]*dynamodb.AttributeValue)
+	setParts := make([]string, 0)
+	removeParts := make([]string, 0)
 
-	pushNewLikeIntr, ok := reqMap["pushNewLike"]
-	if ok {
-		_, ok = pushNewLikeIntr.(bool)
-		if !ok {
-			anlogger.Errorf(lc, "update_settings.go : error format of pushNewLike in request param, req %v", reqMap)
-			return nil, false, commons.WrongRequestParamsClientError
-		}
+	//only legacy offset was sent, so the stored zone name doesn't describe the user anymore
+	if req.TimeZone != nil && req.TimeZoneName == nil {
+		expressionAttrNames["#timeZoneName"] = aws.String(apimodel.TimeZoneNameColumnName)
+		removeParts = append(removeParts, "#timeZoneName")
 	}
 
-	pushNewMatchIntr, ok := reqMap["pushNewMatch"]
-	if ok {
-		_, ok = pushNewMatchIntr.(bool)
+	for i, each := range settingsColumns {
+		value, ok := changes[each.field]
 		if !ok {
-			anlogger.Errorf(lc, "update_settings.go : error format of pushNewMatch in request param, req %v", reqMap)
-			return nil, false, commons.WrongRequestParamsClientError
+			continue
 		}
-	}
-
-	pushNewMessageIntr, ok := reqMap["pushNewMessage"]
-	if ok {
-		_, ok = pushNewMessageIntr.(bool)
-		if !ok {
-			anlogger.Errorf(lc, "update_settings.go : error format of pushNewMessage in request param, req %v", reqMap)
-			return nil, false, commons.WrongRequestParamsClientError
+		attrName := fmt.Sprintf("#s%d", i)
+		attrValueName := fmt.Sprintf(":s%d", i)
+		attrValue := &dynamodb.AttributeValue{}
+		switch typed := value.(type) {
+		case string:
+			attrValue.S = aws.String(typed)
+		case bool:
+			attrValue.BOOL = aws.Bool(typed)
+		case int:
+			attrValue.N = aws.String(strconv.Itoa(typed))
 		}
-	}
-
-	timeZoneFlt, ok := reqMap["timeZone"]
-	if ok {
-		_, ok = timeZoneFlt.(float64)
-		if !ok {
-			anlogger.Errorf(lc, "update_settings.go : error format of timeZone in request param, req %v", reqMap)
-			return nil, false, commons.WrongRequestParamsClientError
+		expressionAttrNames[attrName] = aws.String(each.column)
+		expressionAttributeValues[attrValueName] = attrValue
+		setParts = append(setParts, fmt.Sprintf("%s = %s", attrName, attrValueName))
+	}
+
+	//even empty update goes to the db, so stale version is reported anyway
+	updateExp := ""
+	if len(setParts) != 0 {
+		updateExp = "SET " + strings.Join(setParts, ", ")
+	}
+	if len(removeParts) != 0 {
+		updateExp = strings.TrimSpace(updateExp + " REMOVE " + strings.Join(removeParts, ", "))
+	}
+	input :=
+		&dynamodb.UpdateItemInput{
+			ExpressionAttributeNames:  expressionAttrNames,
+			ExpressionAttributeValues: expressionAttributeValues,
+			Key: map[string]*dynamodb.AttributeValue{
+				commons.UserIdColumnName: {
+					S: aws.String(userId),
+				},
+			},
+			TableName:        aws.String(userSettingsTable),
+			UpdateExpression: aws.String(updateExp),
 		}
-	}
+	apimodel.AddVersionCheck(input, req.Version)
 
-	pushVibrationIntr, ok := reqMap["vibration"]
-	if ok {
-		_, ok = pushVibrationIntr.(bool)
-		if !ok {
-			anlogger.Errorf(lc, "update_settings.go : error format of vibration in request param, req %v", reqMap)
-			return nil, false, commons.WrongRequestParamsClientError
+	output, err := awsDbClient.UpdateItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			anlogger.Warnf(lc, "update_settings.go : stale version [%v] of the settings for userId [%s]", aws.Int64Value(req.Version), userId)
+			return 0, apimodel.ErrVersionConflict.Wrap(err)
 		}
+		anlogger.Errorf(lc, "update_settings.go : error update user settings for userId [%s], settings=%v : %v", userId, changes, err)
+		return 0, apimodel.ErrInternalServer.Wrap(err)
 	}
 
-	anlogger.Debugf(lc, "update_settings.go : successfully parse request string [%s] to %v", params, reqMap)
-	return reqMap, true, ""
-}
-
-//return ok and error string
-func updateUserSettings(userId string, mapSettings map[string]interface{}, lc *lambdacontext.LambdaContext) (bool, string) {
-	anlogger.Debugf(lc, "update_settings.go : start update user settings for userId [%s], settings=%v", userId, mapSettings)
-
-	for key, value := range mapSettings {
-		anlogger.Debugf(lc, "update_settings.go : update key [%v], value [%v]", key, value)
-		if key == "locale" {
-			input :=
-				&dynamodb.UpdateItemInput{
-					ExpressionAttributeNames: map[string]*string{
-						"#locale": aws.String(commons.LocaleColumnName),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":localeV": {
-							S: aws.String(value.(string)),
-						},
-					},
-					Key: map[string]*dynamodb.AttributeValue{
-						commons.UserIdColumnName: {
-							S: aws.String(userId),
-						},
-					},
-
-					TableName:        aws.String(userSettingsTable),
-					UpdateExpression: aws.String("SET #locale = :localeV"),
-				}
-
-			_, err := awsDbClient.UpdateItem(input)
-			if err != nil {
-				anlogger.Errorf(lc, "update_settings.go : error update user locale settings for userId [%s], settings=%v : %v", userId, mapSettings, err)
-				return false, commons.InternalServerError
-			}
-		} else if key == "timeZone" {
-			input :=
-				&dynamodb.UpdateItemInput{
-					ExpressionAttributeNames: map[string]*string{
-						"#timeZone": aws.String(commons.TimeZoneColumnName),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":timeZoneV": {
-							N: aws.String(fmt.Sprintf("%v", value.(float64))),
-						},
-					},
-					Key: map[string]*dynamodb.AttributeValue{
-						commons.UserIdColumnName: {
-							S: aws.String(userId),
-						},
-					},
-
-					TableName:        aws.String(userSettingsTable),
-					UpdateExpression: aws.String("SET #timeZone = :timeZoneV"),
-				}
-
-			_, err := awsDbClient.UpdateItem(input)
-			if err != nil {
-				anlogger.Errorf(lc, "update_settings.go : error update user timeZone settings for userId [%s], settings=%v : %v", userId, mapSettings, err)
-				return false, commons.InternalServerError
-			}
-		} else if key == "push" {
-			//we already checked that we can convert to bool in parse param
-			input :=
-				&dynamodb.UpdateItemInput{
-					ExpressionAttributeNames: map[string]*string{
-						"#push": aws.String(commons.PushColumnName),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":pushV": {
-							BOOL: aws.Bool(value.(bool)),
-						},
-					},
-					Key: map[string]*dynamodb.AttributeValue{
-						commons.UserIdColumnName: {
-							S: aws.String(userId),
-						},
-					},
-
-					TableName:        aws.String(userSettingsTable),
-					UpdateExpression: aws.String("SET #push = :pushV"),
-				}
-
-			_, err := awsDbClient.UpdateItem(input)
-			if err != nil {
-				anlogger.Errorf(lc, "update_settings.go : error update user push settings for userId [%s], settings=%v : %v", userId, mapSettings, err)
-				return false, commons.InternalServerError
-			}
-		} else if key == "pushNewLike" {
-			//we already checked that we can convert to bool in parse param
-			input :=
-				&dynamodb.UpdateItemInput{
-					ExpressionAttributeNames: map[string]*string{
-						"#pushNewLike": aws.String(commons.PushNewLikeColumnName),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":pushNewLikeV": {
-							BOOL: aws.Bool(value.(bool)),
-						},
-					},
-					Key: map[string]*dynamodb.AttributeValue{
-						commons.UserIdColumnName: {
-							S: aws.String(userId),
-						},
-					},
-
-					TableName:        aws.String(userSettingsTable),
-					UpdateExpression: aws.String("SET #pushNewLike = :pushNewLikeV"),
-				}
-
-			_, err := awsDbClient.UpdateItem(input)
-			if err != nil {
-				anlogger.Errorf(lc, "update_settings.go : error update user pushNewLike settings for userId [%s], settings=%v : %v", userId, mapSettings, err)
-				return false, commons.InternalServerError
-			}
-		} else if key == "pushNewMatch" {
-			//we already checked that we can convert to bool in parse param
-			input :=
-				&dynamodb.UpdateItemInput{
-					ExpressionAttributeNames: map[string]*string{
-						"#pushNewMatch": aws.String(commons.PushNewMatchColumnName),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":pushNewMatchV": {
-							BOOL: aws.Bool(value.(bool)),
-						},
-					},
-					Key: map[string]*dynamodb.AttributeValue{
-						commons.UserIdColumnName: {
-							S: aws.String(userId),
-						},
-					},
-
-					TableName:        aws.String(userSettingsTable),
-					UpdateExpression: aws.String("SET #pushNewMatch = :pushNewMatchV"),
-				}
-
-			_, err := awsDbClient.UpdateItem(input)
-			if err != nil {
-				anlogger.Errorf(lc, "update_settings.go : error update user pushNewMatch settings for userId [%s], settings=%v : %v", userId, mapSettings, err)
-				return false, commons.InternalServerError
-			}
-		} else if key == "pushNewMessage" {
-			//we already checked that we can convert to bool in parse param
-			input :=
-				&dynamodb.UpdateItemInput{
-					ExpressionAttributeNames: map[string]*string{
-						"#pushNewMessage": aws.String(commons.PushNewMessageColumnName),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":pushNewMessageV": {
-							BOOL: aws.Bool(value.(bool)),
-						},
-					},
-					Key: map[string]*dynamodb.AttributeValue{
-						commons.UserIdColumnName: {
-							S: aws.String(userId),
-						},
-					},
-
-					TableName:        aws.String(userSettingsTable),
-					UpdateExpression: aws.String("SET #pushNewMessage = :pushNewMessageV"),
-				}
-
-			_, err := awsDbClient.UpdateItem(input)
-			if err != nil {
-				anlogger.Errorf(lc, "update_settings.go : error update user pushNewMessage settings for userId [%s], settings=%v : %v", userId, mapSettings, err)
-				return false, commons.InternalServerError
-			}
-		} else if key == "vibration" {
-			//we already checked that we can convert to bool in parse param
-			input :=
-				&dynamodb.UpdateItemInput{
-					ExpressionAttributeNames: map[string]*string{
-						"#pushVibration": aws.String(commons.PushVibrationColumnName),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":pushVibrationV": {
-							BOOL: aws.Bool(value.(bool)),
-						},
-					},
-					Key: map[string]*dynamodb.AttributeValue{
-						commons.UserIdColumnName: {
-							S: aws.String(userId),
-						},
-					},
-
-					TableName:        aws.String(userSettingsTable),
-					UpdateExpression: aws.String("SET #pushVibration = :pushVibrationV"),
-				}
-
-			_, err := awsDbClient.UpdateItem(input)
-			if err != nil {
-				anlogger.Errorf(lc, "update_settings.go : error update user vibration settings for userId [%s], settings=%v : %v", userId, mapSettings, err)
-				return false, commons.InternalServerError
-			}
-		}
-	} //end for
-
-	anlogger.Infof(lc, "update_settings.go : successfully update user settings for userId [%s], settings=%v", userId, mapSettings)
-	return true, ""
+	version := apimodel.VersionFromAttributes(output.Attributes)
+	anlogger.Infof(lc, "update_settings.go : successfully update user settings for userId [%s], version [%d], settings=%v", userId, version, changes)
+	return version, nil
 }
 
 func main() {
-	basicLambda.Start(handler)
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Params.(*apimodel.SettingsPatch).AccessToken },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
 }
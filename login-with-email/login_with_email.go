@@ -10,11 +10,14 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"encoding/json"
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/ringoid/commons"
-	"strings"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"github.com/satori/go.uuid"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"math/rand"
@@ -37,44 +40,37 @@ var emailAuthTable string
 var authConfirmTable string
 var mailgunApiKey string
 
+type lambdaConfig struct {
+	config.Base
+	EmailAuthTable     string `env:"EMAIL_AUTH_TABLE" validate:"required"`
+	AuthConfirmTable   string `env:"AUTH_CONFIRM_TABLE" validate:"required"`
+	DeliveryStreamName string `env:"DELIVERY_STREAM" validate:"required"`
+}
+
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : login_with_email.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : login_with_email.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : login_with_email.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : login_with_email.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : login_with_email.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : login_with_email.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "login-with-email-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "login-with-email-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : login_with_email.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : login_with_email.go : error during startup : %v\n", err)
+		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : logger was successfully initialized")
 
-	emailAuthTable, ok = os.LookupEnv("EMAIL_AUTH_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : login_with_email.go : env can not be empty EMAIL_AUTH_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : start with EMAIL_AUTH_TABLE = [%s]", emailAuthTable)
-
-	authConfirmTable, ok = os.LookupEnv("AUTH_CONFIRM_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : login_with_email.go : env can not be empty AUTH_CONFIRM_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : start with AUTH_CONFIRM_TABLE = [%s]", authConfirmTable)
+	emailAuthTable = cfg.EmailAuthTable
+	authConfirmTable = cfg.AuthConfirmTable
+	deliveryStreamName = cfg.DeliveryStreamName
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -84,129 +80,87 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "login-with-email-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : login_with_email.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	mailgunApiKey = commons.GetSecret(fmt.Sprintf(commons.MailGunApiKeyBase, env), commons.MailGunApiKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : dynamodb client was successfully initialized")
 
-	deliveryStreamName, ok = os.LookupEnv("DELIVERY_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : login_with_email.go : env can not be empty DELIVERY_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : start with DELIVERY_STREAM = [%s]", deliveryStreamName)
-
 	awsDeliveryStreamClient = firehose.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : firehose client was successfully initialized")
 }
 
-func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
-	lc, _ := lambdacontext.FromContext(ctx)
-
-	userAgent := request.Headers["user-agent"]
-	if strings.HasPrefix(userAgent, "ELB-HealthChecker") {
-		return commons.NewServiceResponse("{}"), nil
-	}
-
-	if request.HTTPMethod != "POST" {
-		return commons.NewWrongHttpMethodServiceResponse(), nil
-	}
-	//sourceIp := request.Headers["x-forwarded-for"]
-
-	anlogger.Debugf(lc, "login_with_email.go : start handle request %v", request)
-
-	appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(request.Headers, anlogger, lc)
-
-	ok, errStr = commons.CheckAppVersion(appVersion, isItAndroid, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "login_with_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	if !ok {
-		anlogger.Errorf(lc, "login_with_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	reqParam, ok, errStr := parseParams(request.Body, lc)
-	if !ok {
-		anlogger.Errorf(lc, "login_with_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	reqParam := req.Params.(*apimodel.LoginWithEmailRequest)
 
 	authSessionId, err := uuid.NewV4()
 	if err != nil {
-		errStr := commons.InternalServerError
 		anlogger.Errorf(lc, "login_with_email.go : error while generate authSessionId : %v", err)
-		anlogger.Errorf(lc, "login_with_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	resp := apimodel.LoginWithEmailResponse{}
 	resp.AuthSessionId = authSessionId.String()
 
-	ok, errStr = tryUpdateAuthStatus(reqParam.Email, authSessionId.String(), lc)
-	if !ok {
-		if len(errStr) != 0 {
-			anlogger.Errorf(lc, "login_with_email.go : return %s to client", errStr)
-			return commons.NewServiceResponse(errStr), nil
-		}
+	updated, authErr := tryUpdateAuthStatus(reqParam.Email, authSessionId.String(), lc)
+	if authErr != nil {
+		return nil, authErr
+	}
 
-		userId, ok, errStr := readUserIdFromEmailAuth(reqParam.Email, lc)
-		if !ok {
-			anlogger.Errorf(lc, "login_with_email.go : return %s to client", errStr)
-			return commons.NewServiceResponse(errStr), nil
+	if !updated {
+		userId, authErr := readUserIdFromEmailAuth(reqParam.Email, lc)
+		if authErr != nil {
+			return nil, authErr
 		}
 
 		pinCode := rand.Intn(89999) + 10000
-		ok, errStr = startEmailConfirmation(userId, reqParam.Email, authSessionId.String(), pinCode, lc)
-		if !ok {
-			anlogger.Errorf(lc, "login_with_email.go : return %s to client", errStr)
-			return commons.NewServiceResponse(errStr), nil
+		authErr = startEmailConfirmation(userId, reqParam.Email, authSessionId.String(), pinCode, lc)
+		if authErr != nil {
+			return nil, authErr
 		}
 
-		ok, errStr = sendEmailWithPin(reqParam.Email, reqParam.Locale, pinCode, lc)
-		if !ok {
-			anlogger.Errorf(lc, "login_with_email.go : return %s to client", errStr)
-			return commons.NewServiceResponse(errStr), nil
+		authErr = sendEmailWithPin(req.Ctx, reqParam.Email, reqParam.Locale, pinCode, lc)
+		if authErr != nil {
+			return nil, authErr
 		}
 
 		resp.ErrorCode = commons.ErrorCodeEmailNotVerifiedClientError
 		resp.ErrorMessage = commons.ErrorMessageEmailNotVerifiedClientError
 	}
 
-	body, err := json.Marshal(resp)
-	if err != nil {
-		anlogger.Errorf(lc, "login_with_email.go : error while marshaling resp object : %v", err)
-		return commons.NewServiceResponse(commons.InternalServerError), nil
-	}
-	anlogger.Debugf(lc, "login_with_email.go : return body=%s", string(body))
-
-	return commons.NewServiceResponse(string(body)), nil
+	return resp, nil
 }
 
-func parseParams(params string, lc *lambdacontext.LambdaContext) (*apimodel.LoginWithEmailRequest, bool, string) {
-	anlogger.Debugf(lc, "login_with_email.go : parse request body [%s]", params)
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
 	var req apimodel.LoginWithEmailRequest
 	err := json.Unmarshal([]byte(params), &req)
 	if err != nil {
-		anlogger.Errorf(lc, "login_with_email.go : error marshaling required params from the string [%s] : %v", params, err)
-		return nil, false, commons.InternalServerError
+		anlogger.Errorf(lc, "login_with_email.go : error marshaling required params from the string [%s] : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	if req.Email == "" {
 		anlogger.Errorf(lc, "login_with_email.go : empty or nil email request param, req %v", req)
-		return nil, false, commons.WrongRequestParamsClientError
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
 	//todo:implement email validation
-	anlogger.Debugf(lc, "login_with_email.go : successfully parse request string [%s] to %v", params, req)
-	return &req, true, ""
+	anlogger.Debugf(lc, "login_with_email.go : successfully parse request %v", req)
+	return &req, nil
 }
 
-//return userId, ok and error string
-func readUserIdFromEmailAuth(email string, lc *lambdacontext.LambdaContext) (string, bool, string) {
-	anlogger.Debugf(lc, "login_with_email.go : read userId for email [%s]", email)
+//return userId and error if something went wrong
+func readUserIdFromEmailAuth(email string, lc *lambdacontext.LambdaContext) (string, *apimodel.AuthError) {
+	anlogger.Debugf(lc, "login_with_email.go : read userId for email [%s]", apimodel.MaskEmail(email))
 
 	input := &dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
@@ -220,23 +174,23 @@ func readUserIdFromEmailAuth(email string, lc *lambdacontext.LambdaContext) (str
 
 	result, err := awsDbClient.GetItem(input)
 	if err != nil {
-		anlogger.Errorf(lc, "login_with_email.go : error get email auth record for email [%s] : %v", email, err)
-		return "", false, commons.InternalServerError
+		anlogger.Errorf(lc, "login_with_email.go : error get email auth record for email [%s] : %v", apimodel.MaskEmail(email), err)
+		return "", apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	if len(result.Item) == 0 {
-		anlogger.Errorf(lc, "login_with_email.go : there is no email auth record with email [%s]", email)
-		return "", false, commons.InternalServerError
+		anlogger.Errorf(lc, "login_with_email.go : there is no email auth record with email [%s]", apimodel.MaskEmail(email))
+		return "", apimodel.ErrInternalServer
 	}
 
 	ok, userId := getStringValueProfileProperty(commons.EmailAuthUserIdColumnName, result, lc)
 	if !ok {
-		anlogger.Errorf(lc, "login_with_email.go : there is no userId in email auth record, email [%s]", email)
-		return "", false, commons.InternalServerError
+		anlogger.Errorf(lc, "login_with_email.go : there is no userId in email auth record, email [%s]", apimodel.MaskEmail(email))
+		return "", apimodel.ErrInternalServer
 	}
 
-	anlogger.Debugf(lc, "login_with_email.go : successfully read userId [%s] for email [%s]", userId, email)
-	return userId, true, ""
+	anlogger.Debugf(lc, "login_with_email.go : successfully read userId [%s] for email [%s]", userId, apimodel.MaskEmail(email))
+	return userId, nil
 }
 
 //ok and string value
@@ -250,10 +204,10 @@ func getStringValueProfileProperty(propertyName string, result *dynamodb.GetItem
 	return false, ""
 }
 
-//return ok and error string
-func tryUpdateAuthStatus(email, authSessionId string, lc *lambdacontext.LambdaContext) (bool, string) {
+//return was auth status updated and error if something went wrong (existing email is not an error)
+func tryUpdateAuthStatus(email, authSessionId string, lc *lambdacontext.LambdaContext) (bool, *apimodel.AuthError) {
 	anlogger.Debugf(lc, "login_with_email.go : update auth status to started state, email [%s], auth session id [%s]",
-		email, authSessionId)
+		apimodel.MaskEmail(email), apimodel.MaskToken(authSessionId))
 
 	input := &dynamodb.UpdateItemInput{
 		ExpressionAttributeNames: map[string]*string{
@@ -285,25 +239,26 @@ func tryUpdateAuthStatus(email, authSessionId string, lc *lambdacontext.LambdaCo
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case dynamodb.ErrCodeConditionalCheckFailedException:
-				anlogger.Warnf(lc, "login_with_email.go : warning, try to login with email which already exists, email [%s]", email)
-				return false, ""
+				anlogger.Warnf(lc, "login_with_email.go : warning, try to login with email which already exists, email [%s]", apimodel.MaskEmail(email))
+				return false, nil
 			default:
-				anlogger.Errorf(lc, "login_with_email.go : error to login with email [%s] : %v", email, aerr)
-				return false, commons.InternalServerError
+				anlogger.Errorf(lc, "login_with_email.go : error to login with email [%s] : %v", apimodel.MaskEmail(email), aerr)
+				return false, apimodel.ErrInternalServer.Wrap(aerr)
 			}
 		}
-		anlogger.Errorf(lc, "login_with_email.go : error to login with email [%s] : %v", email, err)
-		return false, commons.InternalServerError
+		anlogger.Errorf(lc, "login_with_email.go : error to login with email [%s] : %v", apimodel.MaskEmail(email), err)
+		return false, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	anlogger.Infof(lc, "login_with_email.go : successfully update auth status to started state, email [%s], auth session id [%s]",
-		email, authSessionId)
-	return true, ""
+		apimodel.MaskEmail(email), apimodel.MaskToken(authSessionId))
+	return true, nil
 }
 
-func startEmailConfirmation(userId, email, authSessionId string, pin int, lc *lambdacontext.LambdaContext) (bool, string) {
-	anlogger.Debugf(lc, "login_with_email.go : start email confirmation, email [%s], userId [%s], pin [%d], auth session id [%s]",
-		email, userId, pin, authSessionId)
+//return error if something went wrong
+func startEmailConfirmation(userId, email, authSessionId string, pin int, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
+	anlogger.Debugf(lc, "login_with_email.go : start email confirmation, email [%s], userId [%s], auth session id [%s]",
+		apimodel.MaskEmail(email), userId, apimodel.MaskToken(authSessionId))
 
 	input := &dynamodb.UpdateItemInput{
 		ExpressionAttributeNames: map[string]*string{
@@ -337,19 +292,20 @@ func startEmailConfirmation(userId, email, authSessionId string, pin int, lc *la
 
 	_, err := awsDbClient.UpdateItem(input)
 	if err != nil {
-		anlogger.Errorf(lc, "login_with_email.go : error to start confirmation email [%s], userId [%s], pin [%d] and auth session id [%s] : %v",
-			email, userId, pin, authSessionId, err)
-		return false, commons.InternalServerError
+		anlogger.Errorf(lc, "login_with_email.go : error to start confirmation email [%s], userId [%s] and auth session id [%s] : %v",
+			apimodel.MaskEmail(email), userId, apimodel.MaskToken(authSessionId), err)
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
-	anlogger.Infof(lc, "login_with_email.go : successfully start confirmation with email [%s], userId [%s], pin [%d] and auth session id [%s]",
-		email, userId, pin, authSessionId)
+	anlogger.Infof(lc, "login_with_email.go : successfully start confirmation with email [%s], userId [%s] and auth session id [%s]",
+		apimodel.MaskEmail(email), userId, apimodel.MaskToken(authSessionId))
 
-	return true, ""
+	return nil
 }
 
-func sendEmailWithPin(email, locale string, pin int, lc *lambdacontext.LambdaContext) (bool, string) {
-	anlogger.Infof(lc, "login_with_email.go : send verification code [%d] for [%s]", pin, email)
+//return error if something went wrong
+func sendEmailWithPin(parentCtx context.Context, email, locale string, pin int, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
+	anlogger.Infof(lc, "login_with_email.go : send verification code for [%s]", apimodel.MaskEmail(email))
 	mg := mailgun.NewMailgun(ringoidAppDomain, mailgunApiKey)
 	mg.SetAPIBase(mailgun.APIBaseEU)
 	subject := fmt.Sprintf("%d is your verification code", pin)
@@ -366,23 +322,37 @@ func sendEmailWithPin(email, locale string, pin int, lc *lambdacontext.LambdaCon
 		message.AddVariable("en", true)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	spanCtx, span := tracing.Start(parentCtx, "mailgun.Send", trace.SpanKindClient,
+		attribute.String("mailgun.template", emailTemplate), attribute.String("mailgun.locale", locale))
+	ctx, cancel := context.WithTimeout(spanCtx, time.Second*5)
 	defer cancel()
 
 	// Send the message	with a 10 second timeout
 	resp, id, err := mg.Send(ctx, message)
+	tracing.End(span, err)
 
 	if err != nil {
-		anlogger.Errorf(lc, "login_with_email.go : error sending verification code [%d] for [%s] : %v", pin, email, err)
-		return false, commons.InternalServerError
+		metrics.Count(metrics.EmailSendFailureMetricName, nil)
+		anlogger.Errorf(lc, "login_with_email.go : error sending verification code for [%s] : %v", apimodel.MaskEmail(email), err)
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
-	anlogger.Infof(lc, "login_with_email.go : successfully sent verification code [%d] for [%s] with id [%s] and resp [%s]",
-		pin, email, id, resp)
+	anlogger.Infof(lc, "login_with_email.go : successfully sent verification code for [%s] with id [%s] and resp [%s]",
+		apimodel.MaskEmail(email), id, resp)
 
-	return true, ""
+	return nil
 }
 
 func main() {
-	basicLambda.Start(handler)
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
 }
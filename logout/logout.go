@@ -0,0 +1,159 @@
+package main
+
+import (
+	basicLambda "github.com/aws/aws-lambda-go/lambda"
+	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"os"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/ringoid/commons"
+	"github.com/satori/go.uuid"
+)
+
+var anlogger *commons.Logger
+var secretWord string
+var awsDbClient *dynamodb.DynamoDB
+var userProfileTable string
+var pushTokensTable string
+var awsDeliveryStreamClient *firehose.Firehose
+var deliveryStreamName string
+var commonStreamName string
+var awsKinesisClient *kinesis.Kinesis
+
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable   string `env:"USER_PROFILE_TABLE" validate:"required"`
+	PushTokensTable    string `env:"PUSH_TOKENS_TABLE" validate:"required"`
+	DeliveryStreamName string `env:"DELIVERY_STREAM" validate:"required"`
+	CommonStreamName   string `env:"COMMON_STREAM" validate:"required"`
+}
+
+func init() {
+	var env string
+	var err error
+	var awsSession *session.Session
+
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : logout.go : %v\n", err)
+		os.Exit(1)
+	}
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : logout.go : start with config %+v\n", cfg)
+
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "logout-auth"), apimodel.IsDebugLogEnabled)
+	if err != nil {
+		fmt.Printf("lambda-initialization : logout.go : error during startup : %v\n", err)
+		os.Exit(1)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : logout.go : logger was successfully initialized")
+
+	userProfileTable = cfg.UserProfileTable
+	pushTokensTable = cfg.PushTokensTable
+	deliveryStreamName = cfg.DeliveryStreamName
+	commonStreamName = cfg.CommonStreamName
+
+	awsSession, err = session.NewSession(aws.NewConfig().
+		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
+		WithLogger(aws.LoggerFunc(func(args ...interface{}) { anlogger.AwsLog(args) })).WithLogLevel(aws.LogOff))
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : logout.go : error during initialization : %v", err)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : logout.go : aws session was successfully initialized")
+
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "logout-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : logout.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : logout.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
+	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
+
+	awsDbClient = dynamodb.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : logout.go : dynamodb client was successfully initialized")
+
+	awsDeliveryStreamClient = firehose.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : logout.go : firehose client was successfully initialized")
+
+	awsKinesisClient = kinesis.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : logout.go : kinesis client was successfully initialized")
+}
+
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	userId := req.UserId
+
+	//switch session token to the random one, so presented access token (and any other issued before) becomes invalid
+	newSessionToken, err := uuid.NewV4()
+	if err != nil {
+		anlogger.Errorf(lc, "logout.go : error while generate new sessionToken for userId [%s] : %v", userId, err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
+	}
+
+	authErr := apimodel.SwithCurrentAccessToken(userId, newSessionToken.String(), userProfileTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+
+	event := apimodel.NewUserLogoutEvent(userId, req.SourceIp)
+	commons.SendAnalyticEvent(event, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
+
+	//device of the finished session must not get pushes anymore
+	pushToken, authErr := apimodel.DeleteAllPushTokens(userId, pushTokensTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	authErr = apimodel.SendPushTokenUnregisteredEvent(req.Ctx, userId, req.SourceIp, pushToken, commonStreamName, awsKinesisClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+
+	anlogger.Infof(lc, "logout.go : successfully logout userId [%s]", userId)
+	return commons.BaseResponse{}, nil
+}
+
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
+	var req apimodel.LogoutRequest
+	err := json.Unmarshal([]byte(params), &req)
+
+	if err != nil {
+		anlogger.Errorf(lc, "logout.go : error unmarshal required params from the string %s : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrWrongRequestParams.Wrap(err)
+	}
+
+	if req.AccessToken == "" {
+		anlogger.Errorf(lc, "logout.go : one of the required param is nil or empty, req %v", req)
+		return nil, apimodel.ErrWrongRequestParams
+	}
+
+	return &req, nil
+}
+
+func main() {
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Params.(*apimodel.LogoutRequest).AccessToken },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+//Metrics are written to stdout in CloudWatch embedded metric format (EMF), CloudWatch extracts them
+//from the lambda logs, so there is no api call on the request path.
+//https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+
+const (
+	UnitCount        = "Count"
+	UnitMilliseconds = "Milliseconds"
+
+	LatencyMetricName                = "Latency"
+	ErrorMetricName                  = "Error"
+	PinVerificationSuccessMetricName = "PinVerificationSuccess"
+	PinVerificationFailureMetricName = "PinVerificationFailure"
+	EmailSendFailureMetricName       = "EmailSendFailure"
+	LoginMetricName                  = "Login"
+	//events of the internal stream, see lambda-handle-stream
+	StreamEventMetricName      = "StreamEvent"
+	StreamDeadLetterMetricName = "StreamDeadLetter"
+
+	EndpointDimension   = "Endpoint"
+	ErrorCodeDimension  = "ErrorCode"
+	PlatformDimension   = "Platform"
+	AppVersionDimension = "AppVersion"
+	EventTypeDimension  = "EventType"
+	ResultDimension     = "Result"
+
+	ResultHandled = "handled"
+	ResultIgnored = "ignored"
+	ResultFailed  = "failed"
+	//redelivered record which was already handled
+	ResultDuplicate = "duplicate"
+
+	PlatformAndroid = "android"
+	PlatformIos     = "ios"
+)
+
+type Dimensions map[string]string
+
+var (
+	mu        sync.Mutex
+	out       io.Writer = os.Stdout
+	namespace string
+)
+
+//Init must be called once during lambda initialization
+func Init(metricsNamespace string) {
+	mu.Lock()
+	defer mu.Unlock()
+	namespace = metricsNamespace
+}
+
+//SetOutput replaces stdout, useful for local runs
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+func Platform(isItAndroid bool) string {
+	if isItAndroid {
+		return PlatformAndroid
+	}
+	return PlatformIos
+}
+
+//Count adds 1 to the metric, Endpoint dimension (name of the lambda function) is always added
+func Count(name string, dimensions Dimensions) {
+	Emit(name, 1, UnitCount, dimensions)
+}
+
+//Latency reports duration in milliseconds
+func Latency(name string, duration time.Duration, dimensions Dimensions) {
+	Emit(name, float64(duration.Nanoseconds())/float64(time.Millisecond), UnitMilliseconds, dimensions)
+}
+
+//Emit writes one EMF entry with one metric
+func Emit(name string, value float64, unit string, dimensions Dimensions) {
+	entry := map[string]interface{}{
+		EndpointDimension: lambdacontext.FunctionName,
+		name:              value,
+	}
+	dimensionNames := []string{EndpointDimension}
+	for k, v := range dimensions {
+		if k == EndpointDimension {
+			continue
+		}
+		entry[k] = v
+		dimensionNames = append(dimensionNames, k)
+	}
+	//keep the same dimension set for the same metric
+	sort.Strings(dimensionNames[1:])
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	entry["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []interface{}{
+			map[string]interface{}{
+				"Namespace":  namespace,
+				"Dimensions": [][]string{dimensionNames},
+				"Metrics": []interface{}{
+					map[string]string{"Name": name, "Unit": unit},
+				},
+			},
+		},
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Fprintf(out, "metrics.go : error marshaling metric %s : %v\n", name, err)
+		return
+	}
+	out.Write(append(line, '\n'))
+}
@@ -0,0 +1,173 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	//spans are written by stdouttrace exporter (json, not OTLP) into the file, useful for local runs
+	ExporterFile = "file"
+
+	//name of the field with propagated trace context inside kinesis event payload
+	EventTraceContextField = "traceContext"
+
+	tracerName = "github.com/ringoid/auth"
+)
+
+var (
+	tracer = otel.Tracer(tracerName)
+
+	//lambda container handles one invocation at a time, so we keep the context of the current one
+	//for the code which doesn't have the context (aws sdk calls without WithContext, commons functions)
+	currentMu sync.Mutex
+	current   = context.Background()
+)
+
+//Init configures global tracer provider, nothing is exported with ExporterNone
+//but spans are still created and trace context is still propagated
+func Init(serviceName, exporterName, fileName string) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes("", attribute.String("service.name", serviceName))),
+	}
+
+	var out io.Writer
+	switch exporterName {
+	case ExporterStdout:
+		out = os.Stdout
+	case ExporterFile:
+		file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("error open traces file %s : %v", fileName, err)
+		}
+		out = file
+	}
+
+	if out != nil {
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(out))
+		if err != nil {
+			return fmt.Errorf("error create traces exporter : %v", err)
+		}
+		//lambda could be frozen right after the response, so export synchronously
+		options = append(options, sdktrace.WithSyncer(exporter))
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(options...))
+	tracer = otel.Tracer(tracerName)
+	return nil
+}
+
+//Start starts new span, parent is taken from ctx
+func Start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = Current()
+	}
+	return tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+//End marks span as failed if err is not nil and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//StartInvocation starts root span of the lambda invocation and makes its context current,
+//span is named after the lambda function
+func StartInvocation(ctx context.Context, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := Start(ctx, lambdacontext.FunctionName, kind, attrs...)
+	SetCurrent(ctx)
+	return ctx, span
+}
+
+func SetCurrent(ctx context.Context) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = ctx
+}
+
+func Current() context.Context {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	return current
+}
+
+//InstrumentSession adds span for every aws sdk call, must be called before clients are created
+//from the session, because clients copy the handlers
+func InstrumentSession(sess *session.Session) {
+	sess.Handlers.Build.PushFrontNamed(request.NamedHandler{
+		Name: "tracing.StartSpan",
+		Fn: func(r *request.Request) {
+			parent := r.Context()
+			if parent == nil || !trace.SpanFromContext(parent).SpanContext().IsValid() {
+				parent = Current()
+			}
+			operation := ""
+			if r.Operation != nil {
+				operation = r.Operation.Name
+			}
+			ctx, _ := Start(parent, fmt.Sprintf("%s.%s", r.ClientInfo.ServiceName, operation), trace.SpanKindClient,
+				attribute.String("aws.service", r.ClientInfo.ServiceName),
+				attribute.String("aws.operation", operation),
+			)
+			r.SetContext(ctx)
+		},
+	})
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "tracing.EndSpan",
+		Fn: func(r *request.Request) {
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(attribute.Int("aws.retryCount", r.RetryCount))
+			if r.HTTPResponse != nil {
+				span.SetAttributes(attribute.Int("http.statusCode", r.HTTPResponse.StatusCode))
+			}
+			End(span, r.Error)
+		},
+	})
+}
+
+//Inject returns trace context of ctx as a map which could be put into the event payload
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+//ExtractEvent returns context with the trace context which producer put into the event payload,
+//ctx is returned as is if the event doesn't have one
+func ExtractEvent(ctx context.Context, body []byte) context.Context {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ctx
+	}
+	raw, ok := payload[EventTraceContextField]
+	if !ok {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{}
+	if err := json.Unmarshal(raw, &carrier); err != nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	basicLambda "github.com/aws/aws-lambda-go/lambda"
+	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"os"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/ringoid/commons"
+)
+
+var anlogger *commons.Logger
+var secretWord string
+var awsDbClient *dynamodb.DynamoDB
+var userProfileTable string
+var pushTokensTable string
+var awsDeliveryStreamClient *firehose.Firehose
+var deliveryStreamName string
+var commonStreamName string
+var awsKinesisClient *kinesis.Kinesis
+
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable   string `env:"USER_PROFILE_TABLE" validate:"required"`
+	PushTokensTable    string `env:"PUSH_TOKENS_TABLE" validate:"required"`
+	DeliveryStreamName string `env:"DELIVERY_STREAM" validate:"required"`
+	CommonStreamName   string `env:"COMMON_STREAM" validate:"required"`
+}
+
+func init() {
+	var env string
+	var err error
+	var awsSession *session.Session
+
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : unregister_push_token.go : %v\n", err)
+		os.Exit(1)
+	}
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : unregister_push_token.go : start with config %+v\n", cfg)
+
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "unregister-push-token-auth"), apimodel.IsDebugLogEnabled)
+	if err != nil {
+		fmt.Printf("lambda-initialization : unregister_push_token.go : error during startup : %v\n", err)
+		os.Exit(1)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : unregister_push_token.go : logger was successfully initialized")
+
+	userProfileTable = cfg.UserProfileTable
+	pushTokensTable = cfg.PushTokensTable
+	deliveryStreamName = cfg.DeliveryStreamName
+	commonStreamName = cfg.CommonStreamName
+
+	awsSession, err = session.NewSession(aws.NewConfig().
+		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
+		WithLogger(aws.LoggerFunc(func(args ...interface{}) { anlogger.AwsLog(args) })).WithLogLevel(aws.LogOff))
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : unregister_push_token.go : error during initialization : %v", err)
+	}
+	anlogger.Debugf(nil, "lambda-initialization : unregister_push_token.go : aws session was successfully initialized")
+
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "unregister-push-token-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : unregister_push_token.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : unregister_push_token.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
+	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
+
+	awsDbClient = dynamodb.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : unregister_push_token.go : dynamodb client was successfully initialized")
+
+	awsDeliveryStreamClient = firehose.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : unregister_push_token.go : firehose client was successfully initialized")
+
+	awsKinesisClient = kinesis.New(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : unregister_push_token.go : kinesis client was successfully initialized")
+}
+
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	userId := req.UserId
+	reqParam := req.Params.(*apimodel.PushTokenRequest)
+
+	deleted, authErr := apimodel.DeletePushToken(userId, reqParam.PushToken, pushTokensTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
+	}
+	//token was already replaced or removed, nothing to tell
+	if !deleted {
+		return commons.BaseResponse{}, nil
+	}
+
+	event := apimodel.NewPushTokenUnregisteredEvent(userId, req.SourceIp, reqParam.PushToken)
+	commons.SendAnalyticEvent(event, userId, deliveryStreamName, awsDeliveryStreamClient, anlogger, lc)
+
+	partitionKey := userId
+	ok, errStr := commons.SendCommonEvent(apimodel.TracedEvent(req.Ctx, event), userId, commonStreamName, partitionKey, awsKinesisClient, anlogger, lc)
+	if !ok {
+		return nil, apimodel.FromErrorString(errStr)
+	}
+
+	anlogger.Infof(lc, "unregister_push_token.go : successfully unregister push token for userId [%s]", userId)
+	return commons.BaseResponse{}, nil
+}
+
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
+	var req apimodel.PushTokenRequest
+	err := json.Unmarshal([]byte(params), &req)
+
+	if err != nil {
+		anlogger.Errorf(lc, "unregister_push_token.go : error unmarshal required params from the string %s : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrWrongRequestParams.Wrap(err)
+	}
+
+	if req.AccessToken == "" {
+		anlogger.Errorf(lc, "unregister_push_token.go : one of the required param is nil or empty, req %v", req)
+		return nil, apimodel.ErrWrongRequestParams
+	}
+
+	fieldErrors := apimodel.Validate(&req)
+	if len(fieldErrors) != 0 {
+		anlogger.Errorf(lc, "unregister_push_token.go : wrong request params %v, req %v", fieldErrors, req)
+		return nil, apimodel.ErrWrongRequestParams.WithFieldErrors(fieldErrors)
+	}
+
+	return &req, nil
+}
+
+func main() {
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+		apimodel.Auth(func(req *apimodel.Request) string { return req.Params.(*apimodel.PushTokenRequest).AccessToken },
+			secretWord, userProfileTable, commonStreamName, awsDbClient, awsKinesisClient, anlogger),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
+}
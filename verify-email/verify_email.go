@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	basicLambda "github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/aws"
@@ -10,12 +9,14 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"encoding/json"
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/ringoid/commons"
-	"strings"
 	"../apimodel"
+	"../config"
+	"../tracing"
+	"../metrics"
 	"strconv"
+	"errors"
 	"github.com/satori/go.uuid"
 	"github.com/dgrijalva/jwt-go"
 )
@@ -32,52 +33,39 @@ var userProfileTable string
 var emailAuthTable string
 var authConfirmTable string
 
+type lambdaConfig struct {
+	config.Base
+	UserProfileTable   string `env:"USER_PROFILE_TABLE" validate:"required"`
+	EmailAuthTable     string `env:"EMAIL_AUTH_TABLE" validate:"required"`
+	AuthConfirmTable   string `env:"AUTH_CONFIRM_TABLE" validate:"required"`
+	DeliveryStreamName string `env:"DELIVERY_STREAM" validate:"required"`
+}
+
 func init() {
 	var env string
-	var ok bool
-	var papertrailAddress string
 	var err error
 	var awsSession *session.Session
 
-	env, ok = os.LookupEnv("ENV")
-	if !ok {
-		fmt.Printf("lambda-initialization : verify_email.go : env can not be empty ENV\n")
-		os.Exit(1)
-	}
-	fmt.Printf("lambda-initialization : verify_email.go : start with ENV = [%s]\n", env)
-
-	papertrailAddress, ok = os.LookupEnv("PAPERTRAIL_LOG_ADDRESS")
-	if !ok {
-		fmt.Printf("lambda-initialization : verify_email.go : env can not be empty PAPERTRAIL_LOG_ADDRESS\n")
+	var cfg lambdaConfig
+	err = config.Load(&cfg)
+	if err != nil {
+		fmt.Printf("lambda-initialization : verify_email.go : %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("lambda-initialization : verify_email.go : start with PAPERTRAIL_LOG_ADDRESS = [%s]\n", papertrailAddress)
+	env = cfg.Env
+	fmt.Printf("lambda-initialization : verify_email.go : start with config %+v\n", cfg)
 
-	anlogger, err = commons.New(papertrailAddress, fmt.Sprintf("%s-%s", env, "verify-email-auth"), apimodel.IsDebugLogEnabled)
+	anlogger, err = commons.New(cfg.PapertrailAddress, fmt.Sprintf("%s-%s", env, "verify-email-auth"), apimodel.IsDebugLogEnabled)
 	if err != nil {
-		fmt.Errorf("lambda-initialization : verify_email.go : error during startup : %v\n", err)
+		fmt.Printf("lambda-initialization : verify_email.go : error during startup : %v\n", err)
 		os.Exit(1)
 	}
 	anlogger.Debugf(nil, "lambda-initialization : verify_email.go : logger was successfully initialized")
 
-	userProfileTable, ok = os.LookupEnv("USER_PROFILE_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : verify_email.go : env can not be empty USER_PROFILE_TABLE")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : verify_email.go : start with USER_PROFILE_TABLE = [%s]", userProfileTable)
-
-	emailAuthTable, ok = os.LookupEnv("EMAIL_AUTH_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : login_with_email.go : env can not be empty EMAIL_AUTH_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : start with EMAIL_AUTH_TABLE = [%s]", emailAuthTable)
-
-	authConfirmTable, ok = os.LookupEnv("AUTH_CONFIRM_TABLE")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : login_with_email.go : env can not be empty AUTH_CONFIRM_TABLE")
-	}
-	anlogger.Debugf(nil, "lambda-initialization : login_with_email.go : start with AUTH_CONFIRM_TABLE = [%s]", authConfirmTable)
+	userProfileTable = cfg.UserProfileTable
+	emailAuthTable = cfg.EmailAuthTable
+	authConfirmTable = cfg.AuthConfirmTable
+	deliveryStreamName = cfg.DeliveryStreamName
 
 	awsSession, err = session.NewSession(aws.NewConfig().
 		WithRegion(commons.Region).WithMaxRetries(commons.MaxRetries).
@@ -87,80 +75,52 @@ func init() {
 	}
 	anlogger.Debugf(nil, "lambda-initialization : verify_email.go : aws session was successfully initialized")
 
+	err = tracing.Init(fmt.Sprintf("%s-%s", env, "verify-email-auth"), cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		anlogger.Fatalf(nil, "lambda-initialization : verify_email.go : error during tracing initialization : %v", err)
+	}
+	tracing.InstrumentSession(awsSession)
+	anlogger.Debugf(nil, "lambda-initialization : verify_email.go : tracing was successfully initialized")
+
+	metrics.Init(cfg.BaseCloudWatchNamespace)
+
 	secretWord = commons.GetSecret(fmt.Sprintf(commons.SecretWordKeyBase, env), commons.SecretWordKeyName, awsSession, anlogger, nil)
 
 	awsDbClient = dynamodb.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : verify_email.go : dynamodb client was successfully initialized")
 
-	deliveryStreamName, ok = os.LookupEnv("DELIVERY_STREAM")
-	if !ok {
-		anlogger.Fatalf(nil, "lambda-initialization : verify_email.go : env can not be empty DELIVERY_STREAM")
-		os.Exit(1)
-	}
-	anlogger.Debugf(nil, "lambda-initialization : verify_email.go : start with DELIVERY_STREAM = [%s]", deliveryStreamName)
-
 	awsDeliveryStreamClient = firehose.New(awsSession)
 	anlogger.Debugf(nil, "lambda-initialization : verify_email.go : firehose client was successfully initialized")
 }
 
-func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
-	lc, _ := lambdacontext.FromContext(ctx)
-
-	userAgent := request.Headers["user-agent"]
-	if strings.HasPrefix(userAgent, "ELB-HealthChecker") {
-		return commons.NewServiceResponse("{}"), nil
-	}
-
-	if request.HTTPMethod != "POST" {
-		return commons.NewWrongHttpMethodServiceResponse(), nil
-	}
-	//sourceIp := request.Headers["x-forwarded-for"]
-
-	anlogger.Debugf(lc, "verify_email.go : start handle request %v", request)
-
-	appVersion, isItAndroid, ok, errStr := commons.ParseAppVersionFromHeaders(request.Headers, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "verify_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	ok, errStr = commons.CheckAppVersion(appVersion, isItAndroid, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "verify_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
-
-	reqParam, ok, errStr := parseParams(request.Body, lc)
-	if !ok {
-		anlogger.Errorf(lc, "verify_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
-	}
+func handler(req *apimodel.Request) (interface{}, *apimodel.AuthError) {
+	lc := req.Lc
+	reqParam := req.Params.(*apimodel.VerifyEmailRequest)
 
-	ok, errStr = baseCheck(reqParam.Email, reqParam.AuthSessionId, lc)
-	if !ok {
-		anlogger.Errorf(lc, "verify_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	authErr := baseCheck(reqParam.Email, reqParam.AuthSessionId, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
 	piCode, _ := strconv.Atoi(reqParam.PinCode)
-	userId, ok, errStr := completeEmailConfirmation(reqParam.Email, reqParam.AuthSessionId, piCode, lc)
-	if !ok {
-		anlogger.Errorf(lc, "verify_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	userId, authErr := completeEmailConfirmation(reqParam.Email, reqParam.AuthSessionId, piCode, lc)
+	if authErr != nil {
+		if errors.Is(authErr, apimodel.ErrWrongPinCode) {
+			metrics.Count(metrics.PinVerificationFailureMetricName, nil)
+		}
+		return nil, authErr
 	}
+	metrics.Count(metrics.PinVerificationSuccessMetricName, nil)
 
 	newSessionToken, err := uuid.NewV4()
 	if err != nil {
 		anlogger.Errorf(lc, "verify_email.go : error while generate new sessionToken for userId [%s] : %v", userId, err)
-		errStr = commons.InternalServerError
-		anlogger.Errorf(lc, "verify_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
-	ok, errStr = apimodel.SwithCurrentAccessToken(userId, newSessionToken.String(), userProfileTable, awsDbClient, anlogger, lc)
-	if !ok {
-		anlogger.Errorf(lc, "verify_email.go : return %s to client", errStr)
-		return commons.NewServiceResponse(errStr), nil
+	authErr = apimodel.SwithCurrentAccessToken(userId, newSessionToken.String(), userProfileTable, awsDbClient, anlogger, lc)
+	if authErr != nil {
+		return nil, authErr
 	}
 
 	//create access token
@@ -171,63 +131,59 @@ func handler(ctx context.Context, request events.ALBTargetGroupRequest) (events.
 
 	tokenToString, err := accessToken.SignedString([]byte(secretWord))
 	if err != nil {
-		errStr = commons.InternalServerError
-		anlogger.Errorf(lc, "verify_email.go : error sign the token for userId [%s], return %s to the client : %v", userId, errStr, err)
-		return commons.NewServiceResponse(errStr), nil
+		anlogger.Errorf(lc, "verify_email.go : error sign the token for userId [%s] : %v", userId, err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
+	metrics.Count(metrics.LoginMetricName, metrics.Dimensions{
+		metrics.PlatformDimension:   metrics.Platform(req.IsItAndroid),
+		metrics.AppVersionDimension: strconv.Itoa(req.AppVersion),
+	})
+
 	resp := apimodel.VerifyEmailResponse{}
 	resp.AccessToken = tokenToString
 
-	body, err := json.Marshal(resp)
-	if err != nil {
-		anlogger.Errorf(lc, "verify_email.go : error while marshaling resp object : %v", err)
-		return commons.NewServiceResponse(commons.InternalServerError), nil
-	}
-	anlogger.Debugf(lc, "verify_email.go : return body=%s", string(body))
-
-	return commons.NewServiceResponse(string(body)), nil
+	return resp, nil
 }
 
-func parseParams(params string, lc *lambdacontext.LambdaContext) (*apimodel.VerifyEmailRequest, bool, string) {
-	anlogger.Debugf(lc, "verify_email.go : parse request body [%s]", params)
+func parseParams(params string, lc *lambdacontext.LambdaContext) (interface{}, *apimodel.AuthError) {
 	var req apimodel.VerifyEmailRequest
 	err := json.Unmarshal([]byte(params), &req)
 	if err != nil {
-		anlogger.Errorf(lc, "verify_email.go : error marshaling required params from the string [%s] : %v", params, err)
-		return nil, false, commons.InternalServerError
+		anlogger.Errorf(lc, "verify_email.go : error marshaling required params from the string [%s] : %v", apimodel.Scrub(params), err)
+		return nil, apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	if req.Email == "" {
 		anlogger.Errorf(lc, "verify_email.go : empty or nil email request param, req %v", req)
-		return nil, false, commons.WrongRequestParamsClientError
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
 	if req.AuthSessionId == "" {
 		anlogger.Errorf(lc, "verify_email.go : empty or nil authSessionId request param, req %v", req)
-		return nil, false, commons.WrongRequestParamsClientError
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
 	if req.PinCode == "" {
 		anlogger.Errorf(lc, "verify_email.go : empty or nil pinCode request param, req %v", req)
-		return nil, false, commons.WrongRequestParamsClientError
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
 	_, err = strconv.Atoi(req.PinCode)
 	if err != nil {
-		anlogger.Errorf(lc, "verify_email.go : pin code is not int number, pin [%v]", req.PinCode)
-		return nil, false, commons.WrongRequestParamsClientError
+		anlogger.Errorf(lc, "verify_email.go : pin code is not int number, pin [%v]", apimodel.MaskToken(req.PinCode))
+		return nil, apimodel.ErrWrongRequestParams
 	}
 
 	//todo:implement email validation
-	anlogger.Debugf(lc, "verify_email.go : successfully parse request string [%s] to %v", params, req)
-	return &req, true, ""
+	anlogger.Debugf(lc, "verify_email.go : successfully parse request %v", req)
+	return &req, nil
 }
 
-//return userId, ok and error string
-func completeEmailConfirmation(email, authSessionId string, pin int, lc *lambdacontext.LambdaContext) (string, bool, string) {
-	anlogger.Debugf(lc, "verify_email.go : complete email confirmation, email [%s], pin [%d], auth session id [%s]",
-		email, pin, authSessionId)
+//return userId and error if something went wrong
+func completeEmailConfirmation(email, authSessionId string, pin int, lc *lambdacontext.LambdaContext) (string, *apimodel.AuthError) {
+	anlogger.Debugf(lc, "verify_email.go : complete email confirmation, email [%s], auth session id [%s]",
+		apimodel.MaskEmail(email), apimodel.MaskToken(authSessionId))
 
 	input := &dynamodb.UpdateItemInput{
 		ExpressionAttributeNames: map[string]*string{
@@ -262,29 +218,29 @@ func completeEmailConfirmation(email, authSessionId string, pin int, lc *lambdac
 
 	res, err := awsDbClient.UpdateItem(input)
 	if err != nil {
-		anlogger.Errorf(lc, "verify_email.go : error to complete confirmation email [%s], pin [%d] and auth session id [%s] : %v",
-			email, pin, authSessionId, err)
-		return "", false, commons.WrongPinCodeClientError
+		anlogger.Errorf(lc, "verify_email.go : error to complete confirmation email [%s] and auth session id [%s] : %v",
+			apimodel.MaskEmail(email), apimodel.MaskToken(authSessionId), err)
+		return "", apimodel.ErrWrongPinCode.Wrap(err)
 	}
 
 	propertyP, ok := res.Attributes[commons.AuthConfirmUserIdColumnName]
 	if !ok || propertyP.S == nil {
-		anlogger.Errorf(lc, "verify_email.go : error to complete confirmation, userId is empty, email [%s], pin [%d] and auth session id [%s] : %v",
-			email, pin, authSessionId, err)
-		return "", false, commons.EmailInvalidVerificationClientError
+		anlogger.Errorf(lc, "verify_email.go : error to complete confirmation, userId is empty, email [%s] and auth session id [%s] : %v",
+			apimodel.MaskEmail(email), apimodel.MaskToken(authSessionId), err)
+		return "", apimodel.ErrEmailInvalidVerification
 	}
 	userId := *propertyP.S
 
-	anlogger.Infof(lc, "verify_email.go : successfully complete confirmation with email [%s], pin [%d] and auth session id [%s] with userId [%s]",
-		email, pin, authSessionId, userId)
+	anlogger.Infof(lc, "verify_email.go : successfully complete confirmation with email [%s] and auth session id [%s] with userId [%s]",
+		apimodel.MaskEmail(email), apimodel.MaskToken(authSessionId), userId)
 
-	return userId, true, ""
+	return userId, nil
 }
 
-//return ok and error string
-func baseCheck(email, authSessionId string, lc *lambdacontext.LambdaContext) (bool, string) {
+//return error if we can not proceed with pin
+func baseCheck(email, authSessionId string, lc *lambdacontext.LambdaContext) *apimodel.AuthError {
 	anlogger.Debugf(lc, "verify_email.go : base check that we can proceed with pin, for email [%s] and "+
-		"authSessionId [%s]", email, authSessionId)
+		"authSessionId [%s]", apimodel.MaskEmail(email), apimodel.MaskToken(authSessionId))
 
 	input := &dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
@@ -298,30 +254,30 @@ func baseCheck(email, authSessionId string, lc *lambdacontext.LambdaContext) (bo
 
 	result, err := awsDbClient.GetItem(input)
 	if err != nil {
-		anlogger.Errorf(lc, "verify_email.go : error get email confirm state for email [%s] : %v", email, err)
-		return false, commons.InternalServerError
+		anlogger.Errorf(lc, "verify_email.go : error get email confirm state for email [%s] : %v", apimodel.MaskEmail(email), err)
+		return apimodel.ErrInternalServer.Wrap(err)
 	}
 
 	if len(result.Item) == 0 {
-		anlogger.Errorf(lc, "get_profile.go : there is no email confirm record with email [%s]", email)
-		return false, commons.EmailInvalidVerificationClientError
+		anlogger.Errorf(lc, "get_profile.go : there is no email confirm record with email [%s]", apimodel.MaskEmail(email))
+		return apimodel.ErrEmailInvalidVerification
 	}
 
 	ok, authSId := getStringValueProfileProperty(commons.AuthConfirmSessionIdColumnName, result, lc)
 	if !ok || authSessionId != authSId {
 		anlogger.Errorf(lc, "get_profile.go : there is no authSessionId in email confirm record or they are different, email [%s], "+
-			"session id stored in DB [%s], target session id [%s]", email, authSId, authSessionId)
-		return false, commons.EmailInvalidVerificationClientError
+			"session id stored in DB [%s], target session id [%s]", apimodel.MaskEmail(email), apimodel.MaskToken(authSId), apimodel.MaskToken(authSessionId))
+		return apimodel.ErrEmailInvalidVerification
 	}
 
 	ok, confirmState := getStringValueProfileProperty(commons.AuthConfirmStatusColumnName, result, lc)
 	if !ok || confirmState != commons.AuthConfirmStatusStartedValue {
 		anlogger.Errorf(lc, "get_profile.go : there is no confirmation status in email confirm record or they are different, email [%s], "+
-			"state stored in DB [%s], target state id [%s]", email, confirmState, commons.AuthConfirmStatusStartedValue)
-		return false, commons.EmailInvalidVerificationClientError
+			"state stored in DB [%s], target state id [%s]", apimodel.MaskEmail(email), confirmState, commons.AuthConfirmStatusStartedValue)
+		return apimodel.ErrEmailInvalidVerification
 	}
 
-	return true, ""
+	return nil
 }
 
 //ok and string value
@@ -336,5 +292,15 @@ func getStringValueProfileProperty(propertyName string, result *dynamodb.GetItem
 }
 
 func main() {
-	basicLambda.Start(handler)
+	handlerChain := apimodel.Chain(apimodel.Typed(anlogger, handler),
+		apimodel.Recovery(anlogger),
+		apimodel.HealthCheck(),
+		apimodel.Tracing(),
+		apimodel.Metrics(),
+		apimodel.RequestLogging(anlogger),
+		apimodel.Method("POST"),
+		apimodel.AppVersion(anlogger),
+		apimodel.Body(anlogger, parseParams),
+	)
+	basicLambda.Start(apimodel.ALBHandler(handlerChain))
 }